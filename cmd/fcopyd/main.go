@@ -0,0 +1,42 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/containers/libhvee/pkg/fcopy"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	if len(os.Args) > 2 {
+		fmt.Printf("Usage: %s [<device>]\n\n", os.Args[0])
+		fmt.Printf("Receives the files the host copies into the guest like hv_fcopy_daemon.\n")
+		fmt.Printf("The device is %s unless one is given.\n", fcopy.KernelDevice)
+		fmt.Printf("It is provided by the hv_utils driver of Linux 6.9 and older, Linux 6.10\n")
+		fmt.Printf("and later serve file copies with hv_fcopy_uio_daemon instead.\n\n")
+		os.Exit(1)
+	}
+
+	if os.Getenv("FCOPYD_DEBUG") != "" {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	daemon := fcopy.NewDaemon()
+	if len(os.Args) == 2 {
+		daemon.DevicePath = os.Args[1]
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := daemon.Run(ctx); err != nil {
+		logrus.Errorf("fcopy daemon failed: %v", err)
+		os.Exit(1)
+	}
+}
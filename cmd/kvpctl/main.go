@@ -53,7 +53,7 @@ func printHelp() {
 	fmt.Printf("Usage: %s <vm name> (get|add|add-ign|rm|edit|put|clear) [<key>] [<value>]\n\n", os.Args[0])
 	fmt.Printf("\tget   = get all keys or a specific key\n")
 	fmt.Printf("\tadd   = create a key if it doesn't exist\n")
-	fmt.Printf("\tadd-ign   = split and add key-value pairs for an Ignition config\n")
+	fmt.Printf("\tadd-ign   = split and add or replace key-value pairs for an Ignition config\n")
 	fmt.Printf("\tedit  = change a key that exists\n")
 	fmt.Printf("\tput   = create or edit a key\n")
 	fmt.Printf("\trm    = delete one or more keys\n")
@@ -90,11 +90,7 @@ func main() {
 	case add:
 		err = vm.AddKeyValuePair(os.Args[3], os.Args[4])
 	case rm:
-		for _, key := range os.Args[3:] {
-			if err := vm.RemoveKeyValuePair(key); err != nil {
-				exitOnError(err)
-			}
-		}
+		err = vm.RemoveKeyValuePairs(os.Args[3:])
 	case edit:
 		err = vm.ModifyKeyValuePair(os.Args[3], os.Args[4])
 	case put:
@@ -180,21 +176,24 @@ loop:
 		return err
 	}
 
-	count := 0
+	keys := make([]string, 0, len(pairs))
 	for key := range pairs {
-		err := vm.RemoveKeyValuePair(key)
-		if err != nil {
+		keys = append(keys, key)
+	}
+
+	count := len(keys)
+	if err := vm.RemoveKeyValuePairsWithOptions(keys, &hypervctl.KvpBatchOptions{PerItem: true}); err != nil {
+		var batchErr *hypervctl.KvpBatchError
+		if !errors.As(err, &batchErr) {
+			return err
+		}
+		for key := range batchErr.Errors {
 			fmt.Printf("WARN: could not remove key %q\n", key)
-		} else {
-			fmt.Print(".")
-			count++
-			if count%40 == 0 {
-				fmt.Println()
-			}
 		}
+		count -= len(batchErr.Errors)
 	}
 
-	fmt.Printf("\n%d keys deleted!\n", count)
+	fmt.Printf("%d keys deleted!\n", count)
 	return nil
 }
 
@@ -234,12 +233,12 @@ func addIgnFile(vm *hypervctl.VirtualMachine, inputFilename string) error {
 	if err != nil {
 		return err
 	}
-	for i, v := range parts {
-		key := fmt.Sprintf("ignition.config.%d", i)
-		if err := vm.AddKeyValuePair(key, v); err != nil {
-			return err
-		}
-		fmt.Println("added key: ", key)
+	if err := vm.ReplaceIgnition("ignition.config.", bytes.NewReader(b)); err != nil {
+		return err
+	}
+	for i := range parts {
+		fmt.Println("added key: ", fmt.Sprintf("ignition.config.%d", i))
 	}
+	fmt.Println("added key: ", "ignition.config."+ginsu.ManifestSuffix)
 	return nil
 }
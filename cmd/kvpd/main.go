@@ -0,0 +1,40 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/containers/libhvee/pkg/kvp"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	if len(os.Args) > 2 {
+		fmt.Printf("Usage: %s [<pool directory>]\n\n", os.Args[0])
+		fmt.Printf("Serves the Hyper-V key-value pair exchange like hv_kvp_daemon.\n")
+		fmt.Printf("Pools are kept in %s unless a directory is given.\n\n", kvp.DefaultKVPFilePath)
+		os.Exit(1)
+	}
+
+	if os.Getenv("KVPD_DEBUG") != "" {
+		logrus.SetLevel(logrus.DebugLevel)
+	}
+
+	daemon := kvp.NewDaemon()
+	if len(os.Args) == 2 {
+		daemon.PoolPath = os.Args[1]
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := daemon.Run(ctx); err != nil {
+		logrus.Errorf("kvp daemon failed: %v", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/containers/libhvee/pkg/vhdx"
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	blockSize := flag.Uint("block-size", vhdx.DefaultBlockSize/vhdx.MiB, "block size in MiB")
+	flag.Usage = func() {
+		fmt.Printf("Usage: %s [-block-size <MiB>] <raw or qcow2 image> <vhdx file>\n\n", os.Args[0])
+		fmt.Printf("Converts a disk image to a dynamic VHDX file, blocks of zeros take no space.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	opts := &vhdx.WriterOptions{
+		BlockSize: uint32(*blockSize) * vhdx.MiB,
+		Creator:   "libhvee vhdxconv",
+	}
+	if err := vhdx.ConvertFile(flag.Arg(1), flag.Arg(0), opts); err != nil {
+		logrus.Errorf("conversion failed: %v", err)
+		os.Exit(1)
+	}
+
+	f, err := vhdx.Open(flag.Arg(1))
+	if err == nil {
+		err = f.Validate()
+		f.Close()
+	}
+	if err != nil {
+		logrus.Errorf("converted file is invalid: %v", err)
+		os.Exit(1)
+	}
+}
@@ -4,6 +4,7 @@ go 1.25.0
 
 require (
 	github.com/go-ole/go-ole v1.3.0
+	github.com/klauspost/compress v1.18.0
 	github.com/onsi/ginkgo/v2 v2.32.1
 	github.com/onsi/gomega v1.42.1
 	github.com/schollz/progressbar/v3 v3.19.1
@@ -0,0 +1,260 @@
+//go:build linux
+
+package fcopy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultMode is the permission of received files, the same as
+// hv_fcopy_daemon
+const DefaultMode os.FileMode = 0744
+
+// Daemon is a replacement for hv_fcopy_daemon.  It serves the kernel file
+// copy channel and writes the files the host sends.  A file is received
+// under a temporary name next to its destination and only appears there
+// once the host completed the copy, so readers never see a partial file.
+type Daemon struct {
+	// DevicePath is the kernel device to serve, KernelDevice by default
+	DevicePath string
+	// Mode is the permission of received files, DefaultMode by default
+	Mode os.FileMode
+
+	// Transport is the channel to the kernel.  If nil, DevicePath is opened.
+	Transport Transport
+
+	// transfer is the copy in progress
+	transfer *transfer
+}
+
+// transfer is a file being received
+type transfer struct {
+	file      *os.File
+	target    string
+	size      uint64
+	overwrite bool
+}
+
+// NewDaemon creates a daemon with the default settings
+func NewDaemon() *Daemon {
+	return &Daemon{
+		DevicePath: KernelDevice,
+		Mode:       DefaultMode,
+	}
+}
+
+// Run registers with the kernel and receives files until ctx is cancelled,
+// in which case it returns nil.  A copy still in progress then is dropped.
+func (d *Daemon) Run(ctx context.Context) error {
+	if d.Transport == nil {
+		t, err := OpenKernelTransport(d.DevicePath)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s: %w", d.DevicePath, ErrNoKernelDevice)
+		}
+		if err != nil {
+			return err
+		}
+		d.Transport = t
+	}
+	defer func() {
+		d.cancel()
+		_ = d.Transport.Close()
+		d.Transport = nil
+	}()
+
+	if err := writeCode(d.Transport, Version); err != nil {
+		return err
+	}
+
+	buf := make([]byte, maxMsgSize)
+	handshake := true
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		n, err := nextMessage(d.Transport, Timeout, buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+
+		if handshake {
+			// The kernel answers the registration with its own version
+			if n != 4 {
+				return ErrHandshake
+			}
+			logrus.Debugf("registered with hv_fcopy, kernel version %d", binary.LittleEndian.Uint32(buf))
+			handshake = false
+			continue
+		}
+
+		if err := writeCode(d.Transport, d.handle(buf[:n])); err != nil {
+			return err
+		}
+	}
+}
+
+// handle processes a message and returns the result for the host
+func (d *Daemon) handle(b []byte) uint32 {
+	op, err := operation(b)
+	if err == nil {
+		switch op {
+		case OpStartFileCopy:
+			var msg hvStartFcopy
+			if err = decode(b, &msg); err == nil {
+				err = d.start(&msg)
+			}
+		case OpWriteToFile:
+			var msg hvDoFcopy
+			if err = decode(b, &msg); err == nil {
+				err = d.write(&msg)
+			}
+		case OpCompleteFcopy:
+			err = d.complete()
+		case OpCancelFcopy:
+			d.cancel()
+		default:
+			err = fmt.Errorf("unsupported hv_fcopy operation %d", op)
+		}
+	}
+	if err != nil {
+		logrus.Errorf("file copy failed: %v", err)
+	}
+	return resultCode(err)
+}
+
+// resultCode maps the outcome of a message to the result the host expects
+func resultCode(err error) uint32 {
+	switch {
+	case err == nil:
+		return HvSOk
+	case errors.Is(err, os.ErrExist):
+		return HvErrorAlreadyExists
+	case errors.Is(err, unix.ENOSPC), errors.Is(err, unix.EDQUOT):
+		return HvErrorDiskFull
+	case errors.Is(err, ErrInvalidMessage), errors.Is(err, ErrInvalidPath), errors.Is(err, unix.ENAMETOOLONG):
+		return HvInvalidArg
+	}
+	return HvEFail
+}
+
+func (d *Daemon) start(msg *hvStartFcopy) error {
+	// A new copy abandons one the host never completed
+	d.cancel()
+
+	dir := utf16String(msg.PathName[:])
+	name := utf16String(msg.FileName[:])
+	if !filepath.IsAbs(dir) || name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return fmt.Errorf("%w: %q in %q", ErrInvalidPath, name, dir)
+	}
+	target := filepath.Join(dir, name)
+	overwrite := msg.CopyFlags&FlagOverwrite != 0
+
+	if msg.CopyFlags&FlagCreatePath != 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	// Checked again when the file is moved in place, failing early spares
+	// the host sending the data
+	if !overwrite {
+		if _, err := os.Lstat(target); err == nil {
+			return fmt.Errorf("%s: %w", target, os.ErrExist)
+		}
+	}
+
+	f, err := os.CreateTemp(dir, ".fcopy-")
+	if err != nil {
+		return err
+	}
+	d.transfer = &transfer{file: f, target: target, size: msg.FileSize, overwrite: overwrite}
+	logrus.Debugf("receiving %s, %d bytes", target, msg.FileSize)
+	return nil
+}
+
+func (d *Daemon) write(msg *hvDoFcopy) error {
+	if d.transfer == nil {
+		return ErrNoTransfer
+	}
+	if msg.Size > DataFragment || msg.Offset+uint64(msg.Size) > d.transfer.size {
+		return fmt.Errorf("%w: %d bytes at %d", ErrInvalidMessage, msg.Size, msg.Offset)
+	}
+	if _, err := d.transfer.file.WriteAt(msg.Data[:msg.Size], int64(msg.Offset)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (d *Daemon) complete() error {
+	t := d.transfer
+	if t == nil {
+		return ErrNoTransfer
+	}
+	d.transfer = nil
+
+	mode := d.Mode
+	if mode == 0 {
+		mode = DefaultMode
+	}
+	if err := t.finish(mode); err != nil {
+		t.abort()
+		return fmt.Errorf("%s: %w", t.target, err)
+	}
+	logrus.Debugf("received %s", t.target)
+	return nil
+}
+
+// cancel drops the copy in progress, if any
+func (d *Daemon) cancel() {
+	if d.transfer != nil {
+		d.transfer.abort()
+		d.transfer = nil
+	}
+}
+
+// finish moves the received file to its destination
+func (t *transfer) finish(mode os.FileMode) error {
+	info, err := t.file.Stat()
+	if err != nil {
+		return err
+	}
+	if uint64(info.Size()) != t.size {
+		return fmt.Errorf("%w: got %d bytes, want %d", ErrSizeMismatch, info.Size(), t.size)
+	}
+	if err := t.file.Chmod(mode); err != nil {
+		return err
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	if err := t.file.Close(); err != nil {
+		return err
+	}
+
+	if t.overwrite {
+		return os.Rename(t.file.Name(), t.target)
+	}
+	// A link fails if the destination appeared in the meantime
+	if err := os.Link(t.file.Name(), t.target); err != nil {
+		return err
+	}
+	return os.Remove(t.file.Name())
+}
+
+// abort removes the temporary file of the transfer
+func (t *transfer) abort() {
+	_ = t.file.Close()
+	_ = os.Remove(t.file.Name())
+}
@@ -0,0 +1,154 @@
+//go:build linux
+
+package fcopy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func encode(t *testing.T, msg any) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, msg); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func startMsg(t *testing.T, dir, name string, flags uint32, size uint64) []byte {
+	msg := hvStartFcopy{Hdr: hvFcopyHdr{Operation: OpStartFileCopy}, CopyFlags: flags, FileSize: size}
+	putUTF16String(msg.PathName[:], dir)
+	putUTF16String(msg.FileName[:], name)
+	return encode(t, &msg)
+}
+
+func dataMsg(t *testing.T, offset uint64, data string) []byte {
+	msg := hvDoFcopy{Hdr: hvFcopyHdr{Operation: OpWriteToFile}, Offset: offset, Size: uint32(len(data))}
+	copy(msg.Data[:], data)
+	return encode(t, &msg)
+}
+
+func opMsg(t *testing.T, op uint32) []byte {
+	return encode(t, &hvFcopyHdr{Operation: op})
+}
+
+// entries lists the names in dir
+func entries(t *testing.T, dir string) []string {
+	t.Helper()
+	list, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range list {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestMessageSizes(t *testing.T) {
+	// The sizes of the packed kernel structs
+	if hdrSize != 36 || startSize != 1088 || maxMsgSize != 6196 {
+		t.Errorf("got sizes %d, %d, %d", hdrSize, startSize, maxMsgSize)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "etc", "certs")
+	target := filepath.Join(dir, "ca.pem")
+	d := NewDaemon()
+
+	steps := []struct {
+		msg  []byte
+		want uint32
+	}{
+		// The directory is missing without FlagCreatePath
+		{startMsg(t, dir, "ca.pem", 0, 10), HvEFail},
+		{startMsg(t, dir, "ca.pem", FlagCreatePath, 10), HvSOk},
+		{dataMsg(t, 5, "world"), HvSOk},
+		{dataMsg(t, 0, "hello"), HvSOk},
+		// Past the announced size
+		{dataMsg(t, 8, "xyz"), HvInvalidArg},
+	}
+	for i, s := range steps {
+		if got := d.handle(s.msg); got != s.want {
+			t.Fatalf("step %d: got %#x, want %#x", i, got, s.want)
+		}
+	}
+	// Nothing shows up before the copy completes
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("file visible before completion: %v", err)
+	}
+
+	steps = []struct {
+		msg  []byte
+		want uint32
+	}{
+		{opMsg(t, OpCompleteFcopy), HvSOk},
+		{opMsg(t, OpCompleteFcopy), HvEFail},
+		{startMsg(t, dir, "ca.pem", 0, 3), HvErrorAlreadyExists},
+		{dataMsg(t, 0, "bad"), HvEFail},
+		{startMsg(t, "relative", "ca.pem", 0, 3), HvInvalidArg},
+		{startMsg(t, dir, "../ca.pem", 0, 3), HvInvalidArg},
+		{opMsg(t, 42), HvEFail},
+	}
+	for i, s := range steps {
+		if got := d.handle(s.msg); got != s.want {
+			t.Fatalf("step %d: got %#x, want %#x", i, got, s.want)
+		}
+	}
+	if b, err := os.ReadFile(target); err != nil || string(b) != "helloworld" {
+		t.Errorf("got %q, %v", b, err)
+	}
+	if info, err := os.Stat(target); err != nil || info.Mode().Perm() != DefaultMode {
+		t.Errorf("got mode %v, %v", info.Mode(), err)
+	}
+	if names := entries(t, dir); len(names) != 1 {
+		t.Errorf("temporary files left behind: %v", names)
+	}
+}
+
+func TestHandleIncomplete(t *testing.T) {
+	dir := t.TempDir()
+	d := NewDaemon()
+
+	// A copy completed before all data arrived is dropped
+	for _, msg := range [][]byte{startMsg(t, dir, "short", 0, 10), dataMsg(t, 0, "part")} {
+		if got := d.handle(msg); got != HvSOk {
+			t.Fatalf("got %#x", got)
+		}
+	}
+	if got := d.handle(opMsg(t, OpCompleteFcopy)); got != HvEFail {
+		t.Errorf("got %#x for a short file", got)
+	}
+
+	// So is a cancelled one, and one abandoned by a new start
+	for _, msg := range [][]byte{startMsg(t, dir, "big.img", 0, 100), dataMsg(t, 0, "partial"), opMsg(t, OpCancelFcopy), startMsg(t, dir, "other", 0, 1)} {
+		if got := d.handle(msg); got != HvSOk {
+			t.Fatalf("got %#x", got)
+		}
+	}
+	d.cancel()
+	if names := entries(t, dir); len(names) != 0 {
+		t.Errorf("files left behind: %v", names)
+	}
+
+	// A truncated message is rejected
+	if got := d.handle(startMsg(t, dir, "x", 0, 1)[:100]); got != HvInvalidArg {
+		t.Errorf("got %#x for a truncated message", got)
+	}
+}
+
+func TestRunWithoutDevice(t *testing.T) {
+	d := NewDaemon()
+	d.DevicePath = filepath.Join(t.TempDir(), "hv_fcopy")
+	if err := d.Run(context.Background()); !errors.Is(err, ErrNoKernelDevice) {
+		t.Errorf("got %v, want %v", err, ErrNoKernelDevice)
+	}
+}
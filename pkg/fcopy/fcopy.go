@@ -0,0 +1,135 @@
+//go:build linux
+
+// Package fcopy receives the files the host copies into a Linux guest with
+// the guest services integration service (Copy-VMFile), like the
+// hv_fcopy_daemon of the Linux tools.
+//
+// It needs the hv_fcopy character device of the hv_utils driver, which
+// Linux 6.9 and older provide.  Linux 6.10 removed it, the channel is
+// handed to userspace with uio_hv_generic and served by
+// hv_fcopy_uio_daemon instead, which this package does not implement.
+package fcopy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"unicode/utf16"
+)
+
+const (
+	// KernelDevice is the hyperv kernel device files are received on, up
+	// to Linux 6.9
+	KernelDevice = "/dev/vmbus/hv_fcopy"
+	// Version is the protocol version announced to the kernel
+	Version = 1
+	// Timeout is how long a read of the device blocks, in milliseconds,
+	// before the context is checked again
+	Timeout = 1000
+)
+
+// Operations of the messages sent by the kernel
+const (
+	OpStartFileCopy = 0
+	OpWriteToFile   = 1
+	OpCompleteFcopy = 2
+	OpCancelFcopy   = 3
+)
+
+// Flags of a start message
+const (
+	// FlagOverwrite replaces an existing file
+	FlagOverwrite = 0x1
+	// FlagCreatePath creates the missing directories of the path
+	FlagCreatePath = 0x2
+)
+
+// Results reported to the host
+const (
+	HvSOk                = 0
+	HvEFail              = 0x80004005
+	HvInvalidArg         = 0x80070057
+	HvErrorAlreadyExists = 0x80070050
+	HvErrorDiskFull      = 0x80070070
+)
+
+const (
+	// WMaxPath is the size of the file and path names, in UTF-16 units
+	WMaxPath = 260
+	// DataFragment is the largest chunk of file data in a message
+	DataFragment = 6 * 1024
+)
+
+var (
+	ErrInvalidMessage = errors.New("invalid hv_fcopy message")
+	ErrHandshake      = errors.New("hv_fcopy version negotiation failed")
+	// ErrInvalidPath means the host sent a relative or malformed destination
+	ErrInvalidPath = errors.New("invalid destination path")
+	// ErrNoTransfer means data or completion arrived without a started copy
+	ErrNoTransfer = errors.New("no file copy in progress")
+	// ErrSizeMismatch means the host completed a copy before sending all
+	// the data it announced
+	ErrSizeMismatch = errors.New("received size differs from the announced size")
+	// ErrNoKernelDevice means the hv_fcopy device does not exist, the guest
+	// has no hv_utils driver or runs Linux 6.10 or later
+	ErrNoKernelDevice = errors.New("hv_fcopy device not found, it needs hv_utils of Linux 6.9 or older")
+)
+
+// The messages mirror the packed structs of include/uapi/linux/hyperv.h,
+// encoding/binary reads them without padding
+
+type hvFcopyHdr struct {
+	Operation  uint32
+	ServiceID0 [16]byte
+	ServiceID1 [16]byte
+}
+
+type hvStartFcopy struct {
+	Hdr       hvFcopyHdr
+	FileName  [WMaxPath]uint16
+	PathName  [WMaxPath]uint16
+	CopyFlags uint32
+	FileSize  uint64
+}
+
+type hvDoFcopy struct {
+	Hdr    hvFcopyHdr
+	Pad    uint32
+	Offset uint64
+	Size   uint32
+	Data   [DataFragment]byte
+}
+
+var (
+	hdrSize   = binary.Size(hvFcopyHdr{})
+	startSize = binary.Size(hvStartFcopy{})
+	// maxMsgSize is the size of the largest message, a data fragment
+	maxMsgSize = binary.Size(hvDoFcopy{})
+)
+
+// decode reads a message of at least a header into msg
+func decode(b []byte, msg any) error {
+	if len(b) < binary.Size(msg) {
+		return ErrInvalidMessage
+	}
+	return binary.Read(bytes.NewReader(b), binary.LittleEndian, msg)
+}
+
+// operation returns the operation of a raw message
+func operation(b []byte) (uint32, error) {
+	if len(b) < hdrSize {
+		return 0, ErrInvalidMessage
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+// utf16String reads a NUL terminated UTF-16 string
+func utf16String(u []uint16) string {
+	for i, c := range u {
+		if c == 0 {
+			u = u[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,171 @@
+//go:build linux
+
+package fcopy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf16"
+
+	"github.com/containers/libhvee/pkg/hvutils"
+)
+
+var (
+	// ErrTransportClosed is returned once either side of a simulated
+	// transport was closed
+	ErrTransportClosed = hvutils.ErrTransportClosed
+	// ErrNoReply means the guest did not answer a simulated request in time
+	ErrNoReply = hvutils.ErrNoReply
+)
+
+// StatusError is returned when the guest answers a request with a
+// failure code
+type StatusError struct {
+	Operation uint32
+	Code      uint32
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("hv_fcopy operation %d failed with status %#x", e.Operation, e.Code)
+}
+
+// Simulator plays the kernel side of the hv_fcopy device in process.  It
+// speaks the same wire format as the kernel, so a Daemon can be exercised
+// without a Hyper-V guest.
+type Simulator struct {
+	// Version is sent to the guest when it registers
+	Version uint32
+	// ReplyTimeout bounds how long requests wait for the guest's answer
+	ReplyTimeout time.Duration
+
+	dev *hvutils.Simulator
+}
+
+// NewSimulator creates a simulator, the guest side is obtained with
+// Transport()
+func NewSimulator() *Simulator {
+	return &Simulator{
+		Version:      Version,
+		ReplyTimeout: 5 * time.Second,
+		dev:          hvutils.NewSimulator(),
+	}
+}
+
+// Transport returns the guest end of the simulated device
+func (s *Simulator) Transport() Transport {
+	return s.dev.Transport()
+}
+
+// Close shuts the simulated device down, the guest sees ErrTransportClosed
+func (s *Simulator) Close() {
+	s.dev.Close()
+}
+
+// send queues a message for the guest
+func (s *Simulator) send(msg any) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, msg); err != nil {
+		return err
+	}
+	return s.dev.Send(buf.Bytes())
+}
+
+// recv waits for the next 32-bit value written by the guest
+func (s *Simulator) recv() (uint32, error) {
+	data, err := s.dev.Recv(s.ReplyTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 4 {
+		return 0, fmt.Errorf("guest wrote %d bytes: %w", len(data), ErrInvalidMessage)
+	}
+	return binary.LittleEndian.Uint32(data), nil
+}
+
+// request sends msg and checks the reply of the guest
+func (s *Simulator) request(op uint32, msg any) error {
+	if err := s.send(msg); err != nil {
+		return err
+	}
+	code, err := s.recv()
+	if err != nil {
+		return err
+	}
+	if code != HvSOk {
+		return &StatusError{Operation: op, Code: code}
+	}
+	return nil
+}
+
+// Register waits for the guest to register and completes the handshake
+func (s *Simulator) Register() error {
+	version, err := s.recv()
+	if err != nil {
+		return err
+	}
+	if version != Version {
+		return fmt.Errorf("guest registered with version %d: %w", version, ErrHandshake)
+	}
+	return s.dev.Send(binary.LittleEndian.AppendUint32(nil, s.Version))
+}
+
+// Start announces a file of size bytes named name in the guest directory
+// dir, flags is a combination of FlagOverwrite and FlagCreatePath
+func (s *Simulator) Start(dir, name string, flags uint32, size uint64) error {
+	msg := hvStartFcopy{
+		Hdr:       hvFcopyHdr{Operation: OpStartFileCopy},
+		CopyFlags: flags,
+		FileSize:  size,
+	}
+	putUTF16String(msg.PathName[:], dir)
+	putUTF16String(msg.FileName[:], name)
+	return s.request(OpStartFileCopy, &msg)
+}
+
+// Write sends a fragment of the file, at most DataFragment bytes
+func (s *Simulator) Write(offset uint64, data []byte) error {
+	msg := hvDoFcopy{
+		Hdr:    hvFcopyHdr{Operation: OpWriteToFile},
+		Offset: offset,
+		Size:   uint32(len(data)),
+	}
+	if copy(msg.Data[:], data) != len(data) {
+		return fmt.Errorf("fragment of %d bytes: %w", len(data), ErrInvalidMessage)
+	}
+	return s.request(OpWriteToFile, &msg)
+}
+
+// Complete ends the file being copied
+func (s *Simulator) Complete() error {
+	return s.request(OpCompleteFcopy, &hvFcopyHdr{Operation: OpCompleteFcopy})
+}
+
+// Cancel abandons the file being copied
+func (s *Simulator) Cancel() error {
+	return s.request(OpCancelFcopy, &hvFcopyHdr{Operation: OpCancelFcopy})
+}
+
+// CopyFile sends a whole file in fragments like the host does, and cancels
+// the copy if the guest rejects a fragment
+func (s *Simulator) CopyFile(dir, name string, flags uint32, data []byte) error {
+	if err := s.Start(dir, name, flags, uint64(len(data))); err != nil {
+		return err
+	}
+	for off := 0; off < len(data); off += DataFragment {
+		end := min(off+DataFragment, len(data))
+		if err := s.Write(uint64(off), data[off:end]); err != nil {
+			return errors.Join(err, s.Cancel())
+		}
+	}
+	return s.Complete()
+}
+
+// putUTF16String writes s as a NUL terminated UTF-16 string, truncating it
+// if needed
+func putUTF16String(dst []uint16, s string) {
+	n := copy(dst[:len(dst)-1], utf16.Encode([]rune(s)))
+	clear(dst[n:])
+}
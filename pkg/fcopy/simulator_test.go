@@ -0,0 +1,109 @@
+//go:build linux
+
+package fcopy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func runDaemon(t *testing.T, setup func(d *Daemon)) *Simulator {
+	sim := NewSimulator()
+	d := NewDaemon()
+	d.Transport = sim.Transport()
+	if setup != nil {
+		setup(d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+
+	if err := sim.Register(); err != nil {
+		t.Fatal(err)
+	}
+	return sim
+}
+
+func TestDaemonWithSimulator(t *testing.T) {
+	sim := runDaemon(t, func(d *Daemon) { d.Mode = 0600 })
+	dir := filepath.Join(t.TempDir(), "a", "b")
+
+	// Several fragments, the last one partial
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	if err := sim.CopyFile(dir, "config.yaml", FlagCreatePath, data); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("received %d bytes, want %d", len(got), len(data))
+	}
+	if info, _ := os.Stat(filepath.Join(dir, "config.yaml")); info.Mode().Perm() != 0600 {
+		t.Errorf("got mode %v", info.Mode())
+	}
+
+	var statusErr *StatusError
+	err = sim.CopyFile(dir, "config.yaml", 0, []byte("new"))
+	if !errors.As(err, &statusErr) || statusErr.Code != HvErrorAlreadyExists {
+		t.Errorf("copy over an existing file returned %v", err)
+	}
+	if err := sim.CopyFile(dir, "config.yaml", FlagOverwrite, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "config.yaml")); string(got) != "new" {
+		t.Errorf("got %q after overwrite", got)
+	}
+
+	// An empty file has no fragments
+	if err := sim.CopyFile(dir, "empty", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "empty")); err != nil || info.Size() != 0 {
+		t.Errorf("empty file: %v, %v", info, err)
+	}
+
+	if err := sim.Start(dir, "cancelled", 0, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Write(0, []byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Write(2, []byte("cde")); !errors.As(err, &statusErr) || statusErr.Code != HvEFail {
+		t.Errorf("write after cancel returned %v", err)
+	}
+	if names := entries(t, dir); len(names) != 2 {
+		t.Errorf("got files %v", names)
+	}
+}
+
+func TestDaemonTransportClosed(t *testing.T) {
+	sim := NewSimulator()
+	d := NewDaemon()
+	d.Transport = sim.Transport()
+
+	done := make(chan error, 1)
+	go func() { done <- d.Run(context.Background()) }()
+	if err := sim.Register(); err != nil {
+		t.Fatal(err)
+	}
+	sim.Close()
+	if err := <-done; !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("got %v, want %v", err, ErrTransportClosed)
+	}
+}
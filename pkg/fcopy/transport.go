@@ -0,0 +1,45 @@
+//go:build linux
+
+package fcopy
+
+import (
+	"encoding/binary"
+
+	"github.com/containers/libhvee/pkg/hvutils"
+)
+
+// Transport carries raw hv_fcopy messages between the guest and the kernel
+type Transport = hvutils.Transport
+
+// OpenKernelTransport opens the hyperv fcopy character device at path,
+// which is usually KernelDevice
+func OpenKernelTransport(path string) (Transport, error) {
+	return hvutils.OpenDevice(path)
+}
+
+// nextMessage waits up to timeout milliseconds for a message and reads it
+// into buf.  It returns 0 if no message arrived in time.
+func nextMessage(t Transport, timeout int, buf []byte) (int, error) {
+	n, ok, err := hvutils.NextMessage(t, timeout, buf)
+	if err != nil || !ok {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, ErrInvalidMessage
+	}
+	return n, nil
+}
+
+// writeCode sends a registration or the result of a message, both are a
+// single 32-bit value
+func writeCode(t Transport, code uint32) error {
+	b := binary.LittleEndian.AppendUint32(nil, code)
+	n, err := t.Write(b)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return ErrInvalidMessage
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+//go:build linux
+
+package hvutils
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// ErrTransportClosed is returned once either side of a simulated
+	// transport was closed
+	ErrTransportClosed = errors.New("transport closed")
+	// ErrNoReply means the guest did not answer a simulated request in time
+	ErrNoReply = errors.New("no reply from guest")
+)
+
+// Simulator plays the kernel side of a character device in process, the
+// service packages build their simulators on it to exercise guest logic
+// without a Hyper-V guest
+type Simulator struct {
+	toGuest chan []byte
+	toHost  chan []byte
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// simTransport is the guest end of a Simulator
+type simTransport struct {
+	sim  *Simulator
+	next []byte
+}
+
+// NewSimulator creates a simulator, the guest side is obtained with
+// Transport()
+func NewSimulator() *Simulator {
+	return &Simulator{
+		toGuest: make(chan []byte, 64),
+		toHost:  make(chan []byte, 64),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Transport returns the guest end of the simulated device
+func (s *Simulator) Transport() Transport {
+	return &simTransport{sim: s}
+}
+
+// Close shuts the simulated device down, the guest sees ErrTransportClosed
+func (s *Simulator) Close() {
+	s.once.Do(func() { close(s.closed) })
+}
+
+func (s *Simulator) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Send queues a message for the guest
+func (s *Simulator) Send(msg []byte) error {
+	if s.isClosed() {
+		return ErrTransportClosed
+	}
+	select {
+	case s.toGuest <- append([]byte(nil), msg...):
+		return nil
+	case <-s.closed:
+		return ErrTransportClosed
+	}
+}
+
+// Recv waits up to timeout for the next message written by the guest
+func (s *Simulator) Recv(timeout time.Duration) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-s.toHost:
+		return msg, nil
+	case <-timer.C:
+		return nil, ErrNoReply
+	case <-s.closed:
+		return nil, ErrTransportClosed
+	}
+}
+
+func (t *simTransport) Poll(timeout int) (bool, error) {
+	if t.next != nil {
+		return true, nil
+	}
+
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case msg := <-t.sim.toGuest:
+		t.next = msg
+		return true, nil
+	case <-expired:
+		return false, nil
+	case <-t.sim.closed:
+		return false, ErrTransportClosed
+	}
+}
+
+func (t *simTransport) Read(p []byte) (int, error) {
+	if t.next == nil {
+		select {
+		case t.next = <-t.sim.toGuest:
+		case <-t.sim.closed:
+			return 0, ErrTransportClosed
+		default:
+			return 0, unix.EAGAIN
+		}
+	}
+	n := copy(p, t.next)
+	t.next = nil
+	return n, nil
+}
+
+func (t *simTransport) Write(p []byte) (int, error) {
+	if t.sim.isClosed() {
+		return 0, ErrTransportClosed
+	}
+	msg := make([]byte, len(p))
+	copy(msg, p)
+	select {
+	case t.sim.toHost <- msg:
+		return len(p), nil
+	case <-t.sim.closed:
+		return 0, ErrTransportClosed
+	}
+}
+
+func (t *simTransport) Close() error {
+	t.sim.Close()
+	return nil
+}
@@ -0,0 +1,93 @@
+//go:build linux
+
+// Package hvutils carries the messages of the Hyper-V guest services that
+// the Linux hv_utils driver exposes as character devices, such as
+// /dev/vmbus/hv_kvp and /dev/vmbus/hv_fcopy.  The message formats belong
+// to the packages implementing each service.
+package hvutils
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Transport carries raw messages between the guest and the kernel.  Every
+// Read and Write moves exactly one message.
+type Transport interface {
+	// Poll waits up to timeout milliseconds for a message, a negative
+	// timeout waits forever.  It reports whether a message can be read.
+	Poll(timeout int) (bool, error)
+	// Read reads the next message into p
+	Read(p []byte) (int, error)
+	// Write sends the message in p
+	Write(p []byte) (int, error)
+	// Close releases the transport
+	Close() error
+}
+
+// deviceTransport wraps the file descriptor of a character device
+type deviceTransport struct {
+	fd int
+}
+
+// OpenDevice opens the character device of a service at path
+func OpenDevice(path string) (Transport, error) {
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &deviceTransport{fd: fd}, nil
+}
+
+// NewTransport wraps an open non-blocking file descriptor that moves one
+// message per read and write, such as a device or a packet socket
+func NewTransport(fd int) Transport {
+	return &deviceTransport{fd: fd}
+}
+
+func (k *deviceTransport) Poll(timeout int) (bool, error) {
+	for {
+		pfd := []unix.PollFd{{Fd: int32(k.fd), Events: unix.POLLIN}}
+		howMany, err := unix.Poll(pfd, timeout)
+		if err != nil {
+			// loop on retryable errors
+			if err == unix.EINTR {
+				continue
+			}
+			return false, err
+		}
+		return howMany > 0, nil
+	}
+}
+
+func (k *deviceTransport) Read(p []byte) (int, error) {
+	return unix.Read(k.fd, p)
+}
+
+func (k *deviceTransport) Write(p []byte) (int, error) {
+	return unix.Write(k.fd, p)
+}
+
+func (k *deviceTransport) Close() error {
+	return unix.Close(k.fd)
+}
+
+// NextMessage waits up to timeout milliseconds for a message and reads it
+// into buf.  It reports false if no message arrived in time.
+func NextMessage(t Transport, timeout int, buf []byte) (int, bool, error) {
+	for {
+		ready, err := t.Poll(timeout)
+		if err != nil || !ready {
+			return 0, false, err
+		}
+
+		n, err := t.Read(buf)
+		if err != nil {
+			// loop on retryable errors
+			if err == unix.EAGAIN || err == unix.EINTR || err == unix.EWOULDBLOCK {
+				continue
+			}
+			return 0, false, err
+		}
+		return n, true, nil
+	}
+}
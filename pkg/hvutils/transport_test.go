@@ -0,0 +1,83 @@
+//go:build linux
+
+package hvutils
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNextMessage(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.SetNonblock(fds[0], true); err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[1])
+	tr := NewTransport(fds[0])
+	defer tr.Close()
+
+	buf := make([]byte, 16)
+	if _, ok, err := NextMessage(tr, 10, buf); ok || err != nil {
+		t.Fatalf("got a message without one sent: %v", err)
+	}
+
+	if _, err := unix.Write(fds[1], []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	n, ok, err := NextMessage(tr, 1000, buf)
+	if err != nil || !ok {
+		t.Fatalf("no message: %v", err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Errorf("got %q", buf[:n])
+	}
+
+	if _, err := tr.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	n, err = unix.Read(fds[1], buf)
+	if err != nil || string(buf[:n]) != "reply" {
+		t.Errorf("kernel read %q, %v", buf[:n], err)
+	}
+}
+
+func TestSimulator(t *testing.T) {
+	sim := NewSimulator()
+	tr := sim.Transport()
+
+	if err := sim.Send([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, ok, err := NextMessage(tr, 1000, buf)
+	if err != nil || !ok || string(buf[:n]) != "request" {
+		t.Fatalf("guest read %q, %v, %v", buf[:n], ok, err)
+	}
+	if _, err := tr.Read(buf); !errors.Is(err, unix.EAGAIN) {
+		t.Errorf("read without a message returned %v", err)
+	}
+
+	if _, err := tr.Write([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := sim.Recv(time.Second); err != nil || string(msg) != "reply" {
+		t.Errorf("host received %q, %v", msg, err)
+	}
+	if _, err := sim.Recv(10 * time.Millisecond); !errors.Is(err, ErrNoReply) {
+		t.Errorf("got %v, want %v", err, ErrNoReply)
+	}
+
+	tr.Close()
+	if _, _, err := NextMessage(tr, -1, buf); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("got %v, want %v", err, ErrTransportClosed)
+	}
+	if err := sim.Send(nil); !errors.Is(err, ErrTransportClosed) {
+		t.Errorf("got %v, want %v", err, ErrTransportClosed)
+	}
+}
@@ -0,0 +1,345 @@
+//go:build windows
+
+package hypervctl
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containers/libhvee/pkg/wmiext"
+)
+
+const (
+	VirtualSystemSnapshotService = "Msvm_VirtualSystemSnapshotService"
+
+	// fullSnapshot is the only SnapshotType CreateSnapshot supports for
+	// checkpoints
+	fullSnapshot = 2
+)
+
+// CheckpointType selects how checkpoints of a machine are taken, it maps to
+// UserSnapshotType of the system settings
+type CheckpointType uint16
+
+const (
+	// CheckpointDisabled turns checkpoints off
+	CheckpointDisabled CheckpointType = 2
+	// CheckpointProduction uses backup technology in the guest and falls
+	// back to a standard checkpoint if that is not possible
+	CheckpointProduction CheckpointType = 3
+	// CheckpointProductionOnly fails if backup technology in the guest
+	// cannot be used
+	CheckpointProductionOnly CheckpointType = 4
+	// CheckpointStandard saves the memory of a running machine with the
+	// checkpoint
+	CheckpointStandard CheckpointType = 5
+)
+
+var (
+	ErrCheckpointNotFound = errors.New("checkpoint not found")
+)
+
+// Checkpoint is a snapshot of a virtual machine
+type Checkpoint struct {
+	Name         string
+	InstanceID   string
+	CreationTime time.Time
+	// ParentID is the InstanceID of the checkpoint this one was taken
+	// from, empty for the first one
+	ParentID string
+
+	path string
+	vm   *VirtualMachine
+}
+
+func (c *Checkpoint) Path() string {
+	return c.path
+}
+
+// CreateCheckpoint takes a checkpoint of the machine.  The checkpoint type
+// of the machine is changed to checkpointType first if needed, and the
+// checkpoint is named name unless it is empty.
+func (vm *VirtualMachine) CreateCheckpoint(name string, checkpointType CheckpointType) (*Checkpoint, error) {
+	if checkpointType == CheckpointDisabled {
+		return nil, errors.New("checkpoints cannot be created with type disabled")
+	}
+
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return nil, err
+	}
+	defer service.Close()
+
+	if err := vm.setCheckpointType(service, checkpointType); err != nil {
+		return nil, err
+	}
+
+	vsss, err := service.GetSingletonInstance(VirtualSystemSnapshotService)
+	if err != nil {
+		return nil, err
+	}
+	defer vsss.Close()
+
+	var (
+		job, snapshot *wmiext.Instance
+		res           int32
+	)
+	err = vsss.BeginInvoke("CreateSnapshot").
+		In("AffectedSystem", vm.Path()).
+		In("SnapshotType", uint16(fullSnapshot)).
+		Execute().
+		Out("Job", &job).
+		Out("ResultingSnapshot", &snapshot).
+		Out("ReturnValue", &res).
+		End()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create checkpoint: %w", err)
+	}
+
+	if snapshot == nil && (res != 4096 || job == nil) {
+		if job != nil {
+			job.Close()
+		}
+		if res != 4096 {
+			if err := waitVMResult(res, service, nil, "failed to create checkpoint", nil); err != nil {
+				return nil, err
+			}
+		}
+		return nil, errors.New("failed to create checkpoint: neither a checkpoint nor a job was returned")
+	}
+
+	if snapshot == nil {
+		// The snapshot is only known once the job is done
+		jobPath, err := job.Path()
+		if err != nil {
+			job.Close()
+			return nil, err
+		}
+		if err := waitVMResult(res, service, job, "failed to create checkpoint", nil); err != nil {
+			return nil, err
+		}
+		snapshot, err = service.FindFirstRelatedInstanceThrough(jobPath, "Msvm_VirtualSystemSettingData", "Msvm_AffectedJobElement")
+		if err != nil {
+			return nil, fmt.Errorf("could not find the new checkpoint: %w", err)
+		}
+	} else if job != nil {
+		job.Close()
+	}
+	defer snapshot.Close()
+
+	checkpoint, err := vm.newCheckpoint(service, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		if err := checkpoint.Rename(name); err != nil {
+			return nil, err
+		}
+	}
+	return checkpoint, nil
+}
+
+// setCheckpointType updates the checkpoint type of the machine
+func (vm *VirtualMachine) setCheckpointType(service *wmiext.Service, checkpointType CheckpointType) error {
+	settings, err := vm.fetchSystemSettingsInstance(service)
+	if err != nil {
+		return err
+	}
+	defer settings.Close()
+
+	current, err := settings.GetAsUint("UserSnapshotType")
+	if err != nil {
+		return err
+	}
+	if CheckpointType(current) == checkpointType {
+		return nil
+	}
+	if err := settings.Put("UserSnapshotType", uint16(checkpointType)); err != nil {
+		return err
+	}
+	return modifySystemSettings(service, settings, "failed to set checkpoint type")
+}
+
+// modifySystemSettings stores changed system settings of a machine or a
+// checkpoint
+func modifySystemSettings(service *wmiext.Service, settings *wmiext.Instance, errorMsg string) error {
+	vsms, err := service.GetSingletonInstance(VirtualSystemManagementService)
+	if err != nil {
+		return err
+	}
+	defer vsms.Close()
+
+	var (
+		job *wmiext.Instance
+		res int32
+	)
+	err = vsms.BeginInvoke("ModifySystemSettings").
+		In("SystemSettings", settings.GetCimText()).
+		Execute().
+		Out("Job", &job).
+		Out("ReturnValue", &res).
+		End()
+	if err != nil {
+		return fmt.Errorf("%s: %w", errorMsg, err)
+	}
+	return waitVMResult(res, service, job, errorMsg, translateModifyError)
+}
+
+// Checkpoints lists the checkpoints of the machine
+func (vm *VirtualMachine) Checkpoints() ([]*Checkpoint, error) {
+	const wql = "ASSOCIATORS OF {%s} WHERE AssocClass = Msvm_SnapshotOfVirtualSystem ResultClass = Msvm_VirtualSystemSettingData"
+
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return nil, err
+	}
+	defer service.Close()
+
+	enum, err := service.ExecQuery(fmt.Sprintf(wql, vm.Path()))
+	if err != nil {
+		return nil, err
+	}
+	defer enum.Close()
+
+	var checkpoints []*Checkpoint
+	for {
+		snapshot, err := enum.Next()
+		if err != nil {
+			return checkpoints, err
+		}
+		if snapshot == nil {
+			break
+		}
+
+		checkpoint, err := vm.newCheckpoint(service, snapshot)
+		snapshot.Close()
+		if err != nil {
+			return checkpoints, err
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	return checkpoints, nil
+}
+
+// GetCheckpoint looks up a checkpoint of the machine by name
+func (vm *VirtualMachine) GetCheckpoint(name string) (*Checkpoint, error) {
+	checkpoints, err := vm.Checkpoints()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range checkpoints {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("%q: %w", name, ErrCheckpointNotFound)
+}
+
+func (vm *VirtualMachine) newCheckpoint(service *wmiext.Service, snapshot *wmiext.Instance) (*Checkpoint, error) {
+	// Only the parent takes the antecedent role of the association
+	const parentWql = "ASSOCIATORS OF {%s} WHERE AssocClass = Msvm_ParentChildSettingData ResultClass = Msvm_VirtualSystemSettingData Role = Dependent"
+
+	var settings SystemSettings
+	if err := snapshot.GetAll(&settings); err != nil {
+		return nil, err
+	}
+
+	checkpoint := &Checkpoint{
+		Name:         settings.ElementName,
+		InstanceID:   settings.InstanceID,
+		CreationTime: settings.CreationTime,
+		path:         settings.Path(),
+		vm:           vm,
+	}
+
+	parent, err := service.FindFirstInstance(fmt.Sprintf(parentWql, checkpoint.path))
+	switch {
+	case errors.Is(err, wmiext.ErrNoResults):
+	case err != nil:
+		return nil, err
+	default:
+		defer parent.Close()
+		if checkpoint.ParentID, err = parent.GetAsString("InstanceID"); err != nil {
+			return nil, err
+		}
+	}
+	return checkpoint, nil
+}
+
+// Apply reverts the machine to the checkpoint.  The machine must be off or
+// saved, its current state is lost.
+func (c *Checkpoint) Apply() error {
+	vm, err := c.vm.vmm.GetMachine(c.vm.ElementName)
+	if err != nil {
+		return err
+	}
+	if s := vm.State(); s != Disabled && s != Saved {
+		return fmt.Errorf("checkpoints can only be applied to a machine that is off or saved: %w", ErrMachineStateInvalid)
+	}
+	return c.invoke("ApplySnapshot", "Snapshot", "failed to apply checkpoint")
+}
+
+// Rename changes the name of the checkpoint
+func (c *Checkpoint) Rename(name string) error {
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	snapshot, err := service.GetObject(c.path)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	if err := snapshot.Put("ElementName", name); err != nil {
+		return err
+	}
+	if err := modifySystemSettings(service, snapshot, "failed to rename checkpoint"); err != nil {
+		return err
+	}
+	c.Name = name
+	return nil
+}
+
+// Delete removes the checkpoint, its changes are merged into its children
+func (c *Checkpoint) Delete() error {
+	return c.invoke("DestroySnapshot", "AffectedSnapshot", "failed to delete checkpoint")
+}
+
+// DeleteSubtree removes the checkpoint and all checkpoints taken from it
+func (c *Checkpoint) DeleteSubtree() error {
+	return c.invoke("DestroySnapshotTree", "SnapshotSettingData", "failed to delete checkpoint subtree")
+}
+
+// invoke runs a method of the snapshot service taking the checkpoint
+func (c *Checkpoint) invoke(method string, param string, errorMsg string) error {
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	vsss, err := service.GetSingletonInstance(VirtualSystemSnapshotService)
+	if err != nil {
+		return err
+	}
+	defer vsss.Close()
+
+	var (
+		job *wmiext.Instance
+		res int32
+	)
+	err = vsss.BeginInvoke(method).
+		In(param, c.path).
+		Execute().
+		Out("Job", &job).
+		Out("ReturnValue", &res).
+		End()
+	if err != nil {
+		return fmt.Errorf("%s: %w", errorMsg, err)
+	}
+	return waitVMResult(res, service, job, errorMsg, nil)
+}
@@ -0,0 +1,263 @@
+//go:build windows
+
+package hypervctl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/libhvee/pkg/wmiext"
+)
+
+// CloneOptions control how VirtualMachineManager.Clone creates the machine
+type CloneOptions struct {
+	// ParentDisk is the base of the clone's disk, the first virtual hard
+	// disk of the source by default.  It is made read-only since changing
+	// it breaks every disk created from it.
+	ParentDisk string
+	// DiskPath is where the differencing disk of the clone is created,
+	// <name>.vhdx next to the parent disk by default
+	DiskPath string
+}
+
+// Clone creates a new machine named name with the generation, secure boot,
+// checkpoint, processor, memory and network settings of source.  Its disk records only the changes made on
+// top of the parent disk, which makes cloning fast no matter how large the
+// disk is.  The clone gets its own BIOS identifier and dynamic MAC
+// addresses.  When the parent is the source's own disk the source must be
+// off, and it cannot be started again while clones use the disk.  Only
+// generation 2 machines can be cloned, the disk of the clone is attached
+// to a SCSI controller.
+//
+// Like NewVirtualMachine, a failed clone is removed again along with its
+// disk, and the parent disk gets its permissions back.  If that cleanup
+// fails too, the error is a *RollbackError.
+func (vmm *VirtualMachineManager) Clone(source *VirtualMachine, name string, opts *CloneOptions) (_ *VirtualMachine, err error) {
+	if opts == nil {
+		opts = &CloneOptions{}
+	}
+
+	exists, err := vmm.Exists(name)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrMachineAlreadyExists
+	}
+
+	// The state of the source may have changed since it was looked up
+	source, err = vmm.GetMachine(source.ElementName)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return nil, err
+	}
+	defer service.Close()
+
+	sourceSettings, err := source.fetchSystemSettingsInstance(service)
+	if err != nil {
+		return nil, err
+	}
+	var system SystemSettings
+	err = sourceSettings.GetAll(&system)
+	sourceSettings.Close()
+	if err != nil {
+		return nil, err
+	}
+	if system.VirtualSystemSubType != DefaultSystemSettings().VirtualSystemSubType {
+		return nil, fmt.Errorf("only generation 2 machines can be cloned, source is %q", system.VirtualSystemSubType)
+	}
+
+	var (
+		processor ProcessorSettings
+		memory    MemorySettings
+	)
+	if err := source.fetchExistingResourceSettings(service, "Msvm_ProcessorSettingData", &processor); err != nil {
+		return nil, err
+	}
+	if err := source.fetchExistingResourceSettings(service, "Msvm_MemorySettingData", &memory); err != nil {
+		return nil, err
+	}
+	switches, err := source.switchNames(service)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := opts.ParentDisk
+	if parent == "" {
+		disks, err := source.storagePaths(service, VirtualHardDiskType)
+		if err != nil {
+			return nil, err
+		}
+		if len(disks) == 0 {
+			return nil, errors.New("source machine has no virtual hard disk to clone")
+		}
+		parent = disks[0]
+		if source.State() != Disabled {
+			return nil, fmt.Errorf("the disk of a machine can only be cloned while it is off: %w", ErrMachineStateInvalid)
+		}
+	}
+	diskPath := opts.DiskPath
+	if diskPath == "" {
+		diskPath = filepath.Join(filepath.Dir(parent), name+".vhdx")
+	}
+
+	var undo rollback
+	defer func() {
+		if err != nil {
+			err = undo.run(err)
+		}
+	}()
+
+	info, err := os.Stat(parent)
+	if err != nil {
+		return nil, err
+	}
+	// On Windows this sets the read-only attribute of the file
+	if err := os.Chmod(parent, 0444); err != nil {
+		return nil, fmt.Errorf("could not make parent disk read-only: %w", err)
+	}
+	undo.add("restore permissions of "+parent, func() error {
+		return os.Chmod(parent, info.Mode().Perm())
+	})
+	if err := vmm.CreateDifferencingVhdxFile(diskPath, parent); err != nil {
+		return nil, err
+	}
+	undo.add("remove disk "+diskPath, func() error {
+		return os.Remove(diskPath)
+	})
+
+	systemSettingsBuilder := NewSystemSettingsBuilder()
+	systemSettingsBuilder.rollback = &undo
+	systemSettings, err := systemSettingsBuilder.
+		PrepareSystemSettings(name, func(ss *SystemSettings) {
+			ss.VirtualSystemSubType = system.VirtualSystemSubType
+			ss.SecureBootEnabled = system.SecureBootEnabled
+			ss.SecureBootTemplateId = system.SecureBootTemplateId
+			ss.UserSnapshotType = system.UserSnapshotType
+		}).
+		PrepareMemorySettings(func(ms *MemorySettings) {
+			ms.DynamicMemoryEnabled = memory.DynamicMemoryEnabled
+			ms.VirtualQuantity = memory.VirtualQuantity
+			ms.Reservation = memory.Reservation
+			ms.Limit = memory.Limit
+			ms.Weight = memory.Weight
+			ms.TargetMemoryBuffer = memory.TargetMemoryBuffer
+		}).
+		PrepareProcessorSettings(func(ps *ProcessorSettings) {
+			ps.VirtualQuantity = processor.VirtualQuantity
+			ps.Reservation = processor.Reservation
+			ps.Limit = processor.Limit
+			ps.Weight = processor.Weight
+			ps.ExposeVirtualizationExtensions = processor.ExposeVirtualizationExtensions
+		}).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := NewDriveSettingsBuilder(systemSettings).
+		AddScsiController().
+		AddSyntheticDiskDrive(0).
+		DefineVirtualHardDisk(diskPath, nil).
+		Finish(). // disk
+		Finish(). // drive
+		Finish(). // controller
+		Complete(); err != nil {
+		return nil, err
+	}
+
+	for _, switchName := range switches {
+		// A new port without a static address gets a fresh dynamic MAC
+		if err := NewNetworkSettingsBuilder(systemSettings).
+			AddSyntheticEthernetPort(nil).
+			AddEthernetPortAllocation(switchName).
+			Finish(). // allocation
+			Finish(). // port
+			Complete(); err != nil {
+			return nil, err
+		}
+	}
+
+	return vmm.GetMachine(name)
+}
+
+// storagePaths lists the files backing the disks of the machine with the
+// given resource subtype, such as VirtualHardDiskType
+func (vm *VirtualMachine) storagePaths(service *wmiext.Service, subType string) ([]string, error) {
+	var paths []string
+	err := vm.forEachResourceSettings(service, "Msvm_StorageAllocationSettingData", func(instance *wmiext.Instance) error {
+		var settings StorageAllocationSettings
+		if err := instance.GetAll(&settings); err != nil {
+			return err
+		}
+		if settings.ResourceSubType == subType && len(settings.HostResource) > 0 {
+			paths = append(paths, settings.HostResource[0])
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// switchNames lists the switch of each network adapter of the machine, the
+// default switch is listed as ""
+func (vm *VirtualMachine) switchNames(service *wmiext.Service) ([]string, error) {
+	var names []string
+	err := vm.forEachResourceSettings(service, "Msvm_EthernetPortAllocationSettingData", func(instance *wmiext.Instance) error {
+		var settings EthernetPortAllocationSettings
+		if err := instance.GetAll(&settings); err != nil {
+			return err
+		}
+		name := settings.LastKnownSwitchName
+		if len(settings.HostResource) > 0 && strings.Contains(strings.ToUpper(settings.HostResource[0]), DefaultSwitchId) {
+			name = ""
+		}
+		names = append(names, name)
+		return nil
+	})
+	return names, err
+}
+
+// forEachResourceSettings calls fn with every resource setting of the given
+// class in the active settings of the machine
+func (vm *VirtualMachine) forEachResourceSettings(service *wmiext.Service, resourceType string, fn func(*wmiext.Instance) error) error {
+	const wql = "ASSOCIATORS OF {%s} WHERE ResultClass = %s"
+
+	settings, err := vm.fetchSystemSettingsInstance(service)
+	if err != nil {
+		return err
+	}
+	defer settings.Close()
+
+	path, err := settings.Path()
+	if err != nil {
+		return err
+	}
+
+	enum, err := service.ExecQuery(fmt.Sprintf(wql, path, resourceType))
+	if err != nil {
+		return err
+	}
+	defer enum.Close()
+
+	for {
+		instance, err := enum.Next()
+		if err != nil {
+			return err
+		}
+		if instance == nil {
+			return nil
+		}
+		err = fn(instance)
+		instance.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,478 @@
+//go:build windows
+
+package hypervctl
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containers/libhvee/pkg/wmiext"
+	"go.podman.io/common/pkg/strongunits"
+)
+
+const ImageManagementService = "Msvm_ImageManagementService"
+
+// DiskType is the allocation type of a virtual hard disk
+type DiskType uint16
+
+const (
+	// DiskTypeFixed allocates the whole disk when it is created
+	DiskTypeFixed DiskType = 2
+	// DiskTypeDynamic grows the disk file as data is written
+	DiskTypeDynamic DiskType = 3
+	// DiskTypeDifferencing records the changes made on top of a parent
+	DiskTypeDifferencing DiskType = 4
+)
+
+// DiskFormat is the file format of a virtual hard disk
+type DiskFormat uint16
+
+const (
+	DiskFormatVHD  DiskFormat = 2
+	DiskFormatVHDX DiskFormat = 3
+)
+
+// CompactMode selects how CompactDisk reclaims unused space
+type CompactMode uint16
+
+const (
+	// CompactFull scans the whole disk for zeroed blocks, the disk must be
+	// detached or attached read-only
+	CompactFull CompactMode = 0
+	// CompactQuick reclaims blocks the file system reported as unused,
+	// which is what Optimize-VHD does by default
+	CompactQuick CompactMode = 1
+	// CompactRetrim sends the trims recorded in the disk to the host file
+	// system without reclaiming space
+	CompactRetrim CompactMode = 2
+	// CompactPretrimmed is like CompactQuick without scanning the file
+	// system of an unattached disk
+	CompactPretrimmed CompactMode = 3
+	// CompactPrezeroed is like CompactQuick without scanning for zeroed
+	// blocks
+	CompactPrezeroed CompactMode = 4
+)
+
+// DiskOptions describe a virtual hard disk to create or convert to
+type DiskOptions struct {
+	// Type defaults to DiskTypeDifferencing when ParentPath is set and to
+	// DiskTypeDynamic otherwise
+	Type DiskType
+	// Format defaults to the format matching the file extension
+	Format DiskFormat
+	// Size is the capacity seen by the guest, differencing disks inherit
+	// it from their parent
+	Size strongunits.B
+	// BlockSize, LogicalSectorSize and PhysicalSectorSize are in bytes,
+	// zero leaves the choice to Hyper-V
+	BlockSize          uint32
+	LogicalSectorSize  uint32
+	PhysicalSectorSize uint32
+	// ParentPath is the parent of a differencing disk
+	ParentPath string
+}
+
+// DiskState is the live state of a virtual hard disk file
+type DiskState struct {
+	// FileSize is the space the disk uses on the host
+	FileSize strongunits.B
+	// InUse is set when the disk is attached to a machine or mounted
+	InUse bool
+	// MinInternalSize is the smallest size the disk can be shrunk to
+	// without losing data, zero if Hyper-V cannot tell
+	MinInternalSize       strongunits.B
+	PhysicalSectorSize    uint32
+	Alignment             uint32
+	FragmentationPercent  uint32
+	FragmentationReported bool
+}
+
+// CreateDisk creates a virtual hard disk at path
+func CreateDisk(path string, opts *DiskOptions) error {
+	settings, err := opts.settings(path)
+	if err != nil {
+		return err
+	}
+	if settings.Type == uint16(DiskTypeDifferencing) {
+		if settings.ParentPath == "" {
+			return errors.New("a differencing disk requires a parent")
+		}
+		settings.MaxInternalSize = 0
+	} else if settings.MaxInternalSize == 0 {
+		return errors.New("a disk size is required")
+	}
+
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+	return createVirtualHardDisk(service, settings)
+}
+
+// MergeDisk merges the changes of the differencing disk child into
+// destination, which is its parent or another disk up its parent chain.
+// The disks in between, and child itself, must not be used afterwards.
+func MergeDisk(child string, destination string) error {
+	return MergeDiskContext(context.Background(), child, destination, nil)
+}
+
+// MergeDiskContext is like MergeDisk, it reports the progress of the merge
+// to progress, if not nil, and terminates it when ctx ends
+func MergeDiskContext(ctx context.Context, child string, destination string, progress func(wmiext.JobProgress)) error {
+	return invokeImageManagementContext(ctx, progress, "MergeVirtualHardDisk", "failed to merge disk", func(inv *wmiext.MethodExecutor) *wmiext.MethodExecutor {
+		return inv.In("SourcePath", child).In("DestinationPath", destination)
+	})
+}
+
+// CompactDisk reduces the size of the disk file by reclaiming unused blocks
+func CompactDisk(path string, mode CompactMode) error {
+	return CompactDiskContext(context.Background(), path, mode, nil)
+}
+
+// CompactDiskContext is like CompactDisk, it reports the progress of the
+// compaction to progress, if not nil, and terminates it when ctx ends
+func CompactDiskContext(ctx context.Context, path string, mode CompactMode, progress func(wmiext.JobProgress)) error {
+	return invokeImageManagementContext(ctx, progress, "CompactVirtualHardDisk", "failed to compact disk", func(inv *wmiext.MethodExecutor) *wmiext.MethodExecutor {
+		return inv.In("Path", path).In("Mode", uint16(mode))
+	})
+}
+
+// ConvertDisk writes a copy of the disk at source to destination using the
+// type and format of opts.  The size and parent of opts are ignored, the
+// copy keeps those of source.
+func ConvertDisk(source string, destination string, opts *DiskOptions) error {
+	return ConvertDiskContext(context.Background(), source, destination, opts, nil)
+}
+
+// ConvertDiskContext is like ConvertDisk, it reports the progress of the
+// conversion to progress, if not nil, and terminates it when ctx ends.  The
+// partial copy is removed once the conversion stopped.
+func ConvertDiskContext(ctx context.Context, source string, destination string, opts *DiskOptions, progress func(wmiext.JobProgress)) error {
+	var o DiskOptions
+	if opts != nil {
+		o = *opts
+	}
+	opts = &o
+	if opts.Type == 0 || opts.Type == DiskTypeDifferencing {
+		current, err := GetDiskSettings(source)
+		if err != nil {
+			return err
+		}
+		if opts.Type == 0 {
+			opts.Type = DiskType(current.Type)
+		}
+		opts.ParentPath = current.ParentPath
+	}
+	settings, err := opts.settings(destination)
+	if err != nil {
+		return err
+	}
+	settings.MaxInternalSize = 0
+
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	instance, err := service.CreateInstance("Msvm_VirtualHardDiskSettingData", settings)
+	if err != nil {
+		return err
+	}
+	defer instance.Close()
+
+	err = invokeImageManagementService(ctx, service, progress, "ConvertVirtualHardDisk", "failed to convert disk", func(inv *wmiext.MethodExecutor) *wmiext.MethodExecutor {
+		return inv.In("SourcePath", source).In("VirtualDiskSettingData", instance.GetCimText())
+	})
+	if errors.Is(err, wmiext.ErrJobTerminated) {
+		// A terminated conversion leaves a partial copy behind
+		_ = os.Remove(destination)
+	}
+	return err
+}
+
+// ValidateDisk checks the disk and its parent chain for corruption and
+// missing or modified parents
+func ValidateDisk(path string) error {
+	return invokeImageManagement("ValidateVirtualHardDisk", "disk failed validation", func(inv *wmiext.MethodExecutor) *wmiext.MethodExecutor {
+		return inv.In("Path", path)
+	})
+}
+
+// GetDiskSettings reads the settings stored in a virtual hard disk file
+func GetDiskSettings(path string) (*VirtualHardDiskSettings, error) {
+	props, err := getDiskProperties("GetVirtualHardDiskSettingData", "SettingData", path)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &VirtualHardDiskSettings{
+		InstanceID:    props["InstanceID"],
+		ElementName:   props["ElementName"],
+		Path:          props["Path"],
+		ParentPath:    props["ParentPath"],
+		VirtualDiskId: props["VirtualDiskId"],
+	}
+	for name, field := range map[string]*uint64{
+		"MaxInternalSize": &settings.MaxInternalSize,
+		"DataAlignment":   &settings.DataAlignment,
+	} {
+		if *field, err = parseDiskProperty(props, name, 64); err != nil {
+			return nil, err
+		}
+	}
+	for name, field := range map[string]*uint32{
+		"BlockSize":          &settings.BlockSize,
+		"LogicalSectorSize":  &settings.LogicalSectorSize,
+		"PhysicalSectorSize": &settings.PhysicalSectorSize,
+	} {
+		v, err := parseDiskProperty(props, name, 32)
+		if err != nil {
+			return nil, err
+		}
+		*field = uint32(v)
+	}
+	for name, field := range map[string]*uint16{
+		"Type":   &settings.Type,
+		"Format": &settings.Format,
+	} {
+		v, err := parseDiskProperty(props, name, 16)
+		if err != nil {
+			return nil, err
+		}
+		*field = uint16(v)
+	}
+	return settings, nil
+}
+
+// GetDiskParentChain lists the parents of a differencing disk, starting with
+// its immediate parent.  The list is empty for other disks.
+func GetDiskParentChain(path string) ([]string, error) {
+	var chain []string
+	start := path
+	seen := map[string]bool{strings.ToLower(filepath.Clean(path)): true}
+	for {
+		settings, err := GetDiskSettings(path)
+		if err != nil {
+			return chain, err
+		}
+		if settings.ParentPath == "" {
+			return chain, nil
+		}
+		path = settings.ParentPath
+		key := strings.ToLower(filepath.Clean(path))
+		if seen[key] {
+			return chain, fmt.Errorf("parent chain of %q loops at %q", start, path)
+		}
+		seen[key] = true
+		chain = append(chain, path)
+	}
+}
+
+// GetDiskState reads the live state of a virtual hard disk file
+func GetDiskState(path string) (*DiskState, error) {
+	props, err := getDiskProperties("GetVirtualHardDiskState", "State", path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &DiskState{InUse: strings.EqualFold(props["InUse"], "true")}
+	for name, field := range map[string]*strongunits.B{
+		"FileSize":        &state.FileSize,
+		"MinInternalSize": &state.MinInternalSize,
+	} {
+		v, err := parseDiskProperty(props, name, 64)
+		if err != nil {
+			return nil, err
+		}
+		*field = strongunits.B(v)
+	}
+	for name, field := range map[string]*uint32{
+		"PhysicalSectorSize": &state.PhysicalSectorSize,
+		"Alignment":          &state.Alignment,
+	} {
+		v, err := parseDiskProperty(props, name, 32)
+		if err != nil {
+			return nil, err
+		}
+		*field = uint32(v)
+	}
+	// Only reported for dynamic and differencing disks on NTFS
+	if _, ok := props["FragmentationPercentage"]; ok {
+		v, err := parseDiskProperty(props, "FragmentationPercentage", 32)
+		if err != nil {
+			return nil, err
+		}
+		state.FragmentationPercent = uint32(v)
+		state.FragmentationReported = true
+	}
+	return state, nil
+}
+
+// checkShrink refuses to shrink a disk below the size its data needs
+func checkShrink(path string, newSize strongunits.B) error {
+	current, err := GetDiskSize(path)
+	if err != nil {
+		return err
+	}
+	if newSize >= current {
+		return nil
+	}
+	state, err := GetDiskState(path)
+	if err != nil {
+		return err
+	}
+	if state.MinInternalSize == 0 || newSize < state.MinInternalSize {
+		return fmt.Errorf("%d bytes is less than the minimum size of %d bytes: %w", newSize, state.MinInternalSize, ErrDiskShrinkUnsafe)
+	}
+	return nil
+}
+
+// settings builds the settings of a disk created at path
+func (opts *DiskOptions) settings(path string) (*VirtualHardDiskSettings, error) {
+	if opts == nil {
+		opts = &DiskOptions{}
+	}
+
+	diskType := opts.Type
+	if diskType == 0 {
+		diskType = DiskTypeDynamic
+		if opts.ParentPath != "" {
+			diskType = DiskTypeDifferencing
+		}
+	}
+	format := opts.Format
+	if format == 0 {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".vhd":
+			format = DiskFormatVHD
+		case ".vhdx":
+			format = DiskFormatVHDX
+		default:
+			return nil, fmt.Errorf("cannot tell the disk format of %q from its extension", path)
+		}
+	}
+
+	return &VirtualHardDiskSettings{
+		Type:               uint16(diskType),
+		Format:             uint16(format),
+		Path:               path,
+		ParentPath:         opts.ParentPath,
+		MaxInternalSize:    uint64(opts.Size),
+		BlockSize:          opts.BlockSize,
+		LogicalSectorSize:  opts.LogicalSectorSize,
+		PhysicalSectorSize: opts.PhysicalSectorSize,
+	}, nil
+}
+
+// getDiskProperties calls a method of the image management service that
+// returns an embedded instance describing the disk at path, and returns the
+// properties of that instance
+func getDiskProperties(method string, param string, path string) (map[string]string, error) {
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return nil, err
+	}
+	defer service.Close()
+
+	imms, err := service.GetSingletonInstance(ImageManagementService)
+	if err != nil {
+		return nil, err
+	}
+	defer imms.Close()
+
+	var (
+		job    *wmiext.Instance
+		ret    int32
+		result string
+	)
+	inv := imms.BeginInvoke(method).
+		In("Path", path).
+		Execute().
+		Out("Job", &job).
+		Out("ReturnValue", &ret)
+	if err := inv.Error(); err != nil {
+		return nil, fmt.Errorf("failed to query disk %s: %w", path, err)
+	}
+	if err := waitVMResult(ret, service, job, "failed to query disk", nil); err != nil {
+		return nil, err
+	}
+	if err := inv.Out(param, &result).End(); err != nil {
+		return nil, fmt.Errorf("failed to query disk %s: %w", path, err)
+	}
+
+	var instance struct {
+		XMLName    xml.Name             `xml:"INSTANCE"`
+		Properties []CimKvpItemProperty `xml:"PROPERTY"`
+	}
+	if err := xml.Unmarshal([]byte(result), &instance); err != nil {
+		return nil, fmt.Errorf("unable to parse disk %s xml: %w", strings.ToLower(param), err)
+	}
+
+	props := make(map[string]string, len(instance.Properties))
+	for _, prop := range instance.Properties {
+		if prop.Value != "" {
+			props[prop.Name] = prop.Value
+		}
+	}
+	return props, nil
+}
+
+// parseDiskProperty parses a numeric property, a missing one is zero
+func parseDiskProperty(props map[string]string, name string, bitSize int) (uint64, error) {
+	value, ok := props[name]
+	if !ok {
+		return 0, nil
+	}
+	v, err := strconv.ParseUint(value, 10, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("unable to parse disk property %s: %w", name, err)
+	}
+	return v, nil
+}
+
+// invokeImageManagement runs a method of the image management service and
+// waits for it to complete
+func invokeImageManagement(method string, errorMsg string, in func(*wmiext.MethodExecutor) *wmiext.MethodExecutor) error {
+	return invokeImageManagementContext(context.Background(), nil, method, errorMsg, in)
+}
+
+// invokeImageManagementContext is like invokeImageManagement, it reports the
+// progress of the job and terminates it when ctx ends
+func invokeImageManagementContext(ctx context.Context, progress func(wmiext.JobProgress), method string, errorMsg string, in func(*wmiext.MethodExecutor) *wmiext.MethodExecutor) error {
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+	return invokeImageManagementService(ctx, service, progress, method, errorMsg, in)
+}
+
+func invokeImageManagementService(ctx context.Context, service *wmiext.Service, progress func(wmiext.JobProgress), method string, errorMsg string, in func(*wmiext.MethodExecutor) *wmiext.MethodExecutor) error {
+	imms, err := service.GetSingletonInstance(ImageManagementService)
+	if err != nil {
+		return err
+	}
+	defer imms.Close()
+
+	var (
+		job *wmiext.Instance
+		ret int32
+	)
+	err = in(imms.BeginInvoke(method)).
+		Execute().
+		Out("Job", &job).
+		Out("ReturnValue", &ret).
+		End()
+	if err != nil {
+		return fmt.Errorf("%s: %w", errorMsg, err)
+	}
+	return waitVMResultContext(ctx, ret, service, job, errorMsg, nil, progress)
+}
@@ -30,7 +30,7 @@ func (d *SyntheticDiskDriveSettings) DefineVirtualHardDisk(vhdxFile string, befo
 		}
 	}
 
-	if err := createDiskResourceInternal(d.systemSettings.Path(), d.Path(), vhdxFile, vhd, VirtualHardDiskType, cb); err != nil {
+	if err := createDiskResourceInternal(d.systemSettings, d.Path(), vhdxFile, vhd, VirtualHardDiskType, cb); err != nil {
 		return nil, err
 	}
 
@@ -39,7 +39,7 @@ func (d *SyntheticDiskDriveSettings) DefineVirtualHardDisk(vhdxFile string, befo
 	return vhd, nil
 }
 
-func createDiskResourceInternal(systemPath string, drivePath string, file string, settings diskAssociation, resourceType string, cb func()) error {
+func createDiskResourceInternal(system *SystemSettings, drivePath string, file string, settings diskAssociation, resourceType string, cb func()) error {
 	var service *wmiext.Service
 	var err error
 	if service, err = NewLocalHyperVService(); err != nil {
@@ -62,7 +62,7 @@ func createDiskResourceInternal(systemPath string, drivePath string, file string
 		return err
 	}
 
-	path, err := addResource(service, systemPath, diskResource)
+	path, err := addResource(service, system, diskResource)
 	if err != nil {
 		return err
 	}
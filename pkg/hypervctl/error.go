@@ -15,6 +15,17 @@ var (
 	ErrMachineNotRunning     = errors.New("machine not running")
 	ErrMachineStateInvalid   = errors.New("machine in invalid state for action")
 	ErrMachineStarting       = errors.New("machine is currently starting")
+	ErrMachineAlreadyPaused  = errors.New("machine already paused")
+	ErrMachineNotPaused      = errors.New("machine not paused or saved")
+	ErrMachineAlreadySaved   = errors.New("machine already saved")
+	ErrMachineStateTimeout   = errors.New("timed out waiting for machine state")
+)
+
+// Guest readiness errors
+var (
+	ErrGuestReadyTimeout          = errors.New("timed out waiting for the guest to be ready")
+	ErrMachineStopped             = errors.New("machine stopped while waiting for the guest")
+	ErrIntegrationServiceDisabled = errors.New("integration service disabled")
 )
 
 // VM Creation errors
@@ -22,6 +33,11 @@ var (
 	ErrMachineAlreadyExists = errors.New("machine already exists")
 )
 
+// Disk errors
+var (
+	ErrDiskShrinkUnsafe = errors.New("disk cannot be shrunk without losing data")
+)
+
 type DestroySystemResult int32
 
 // VM Destroy Exit Codes
@@ -95,7 +95,7 @@ func (p *SyntheticEthernetPortSettings) DefineEthernetPortConnection(switchName
 		return nil, err
 	}
 
-	path, err := addResource(service, p.systemSettings.Path(), resource)
+	path, err := addResource(service, p.systemSettings, resource)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,198 @@
+//go:build windows
+
+package hypervctl
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containers/libhvee/pkg/wmiext"
+	"github.com/sirupsen/logrus"
+)
+
+// stateEventQuery selects state changes of virtual machines.  Caption is
+// only matched in English as the service connects with the en_US locale.
+const stateEventQuery = "SELECT * FROM __InstanceModificationEvent WITHIN 1 " +
+	"WHERE TargetInstance ISA 'Msvm_ComputerSystem' " +
+	"AND TargetInstance.Caption = 'Virtual Machine' " +
+	"AND TargetInstance.EnabledState <> PreviousInstance.EnabledState"
+
+// How long a read of the subscription blocks before the context is checked
+const eventPollTimeout = 250 * time.Millisecond
+
+// StateChange is a change of the state of a machine
+type StateChange struct {
+	// Name is the identifier Hyper-V assigned to the machine
+	Name string
+	// ElementName is the name of the machine
+	ElementName string
+	Previous    EnabledState
+	State       EnabledState
+	Time        time.Time
+}
+
+// computerSystemState holds the properties of the machine in a state event
+type computerSystemState struct {
+	Name         string
+	ElementName  string
+	EnabledState uint16
+}
+
+type stateEvent struct {
+	TargetInstance   computerSystemState
+	PreviousInstance computerSystemState
+	// FILETIME of the event, in 100ns intervals since 1601
+	TIME_CREATED uint64
+}
+
+// Difference between the FILETIME and Unix epochs in 100ns intervals
+const fileTimeUnixEpoch = 116444736000000000
+
+// StateWatcher delivers the state changes of machines
+type StateWatcher struct {
+	changes chan StateChange
+	err     error
+}
+
+// WatchStates sends the state changes of all machines until ctx ends or the
+// subscription fails, then closes the channel.  Events are not dropped, a
+// slow reader delays the following ones.
+func (vmm *VirtualMachineManager) WatchStates(ctx context.Context) (*StateWatcher, error) {
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return nil, err
+	}
+	sub, err := service.Subscribe(stateEventQuery)
+	if err != nil {
+		service.Close()
+		return nil, fmt.Errorf("subscribing to machine states: %w", err)
+	}
+
+	w := &StateWatcher{changes: make(chan StateChange)}
+	go func() {
+		defer close(w.changes)
+		defer service.Close()
+		defer sub.Close()
+		w.err = w.run(ctx, sub)
+	}()
+	return w, nil
+}
+
+// Changes returns the channel state changes are delivered on.  It is closed
+// when the watch ends.
+func (w *StateWatcher) Changes() <-chan StateChange {
+	return w.changes
+}
+
+// Err returns the error that ended the watch.  It is only valid once the
+// changes channel is closed, and is nil if the context was cancelled.
+func (w *StateWatcher) Err() error {
+	return w.err
+}
+
+func (w *StateWatcher) run(ctx context.Context, sub *wmiext.Subscription) error {
+	for ctx.Err() == nil {
+		change, err := nextStateChange(sub, eventPollTimeout)
+		if err != nil {
+			return fmt.Errorf("watching machine states: %w", err)
+		}
+		if change == nil {
+			continue
+		}
+		select {
+		case w.changes <- *change:
+		case <-ctx.Done():
+		}
+	}
+	return nil
+}
+
+// nextStateChange waits up to timeout for the next event of a state
+// subscription, it returns nil when none arrived in time
+func nextStateChange(sub *wmiext.Subscription, timeout time.Duration) (*StateChange, error) {
+	event, err := sub.Next(timeout)
+	if err != nil || event == nil {
+		return nil, err
+	}
+	defer event.Close()
+
+	var e stateEvent
+	if err := event.GetAll(&e); err != nil {
+		return nil, err
+	}
+	created := time.Now()
+	if e.TIME_CREATED > fileTimeUnixEpoch {
+		created = time.Unix(0, int64(e.TIME_CREATED-fileTimeUnixEpoch)*100)
+	}
+	return &StateChange{
+		Name:        e.TargetInstance.Name,
+		ElementName: e.TargetInstance.ElementName,
+		Previous:    EnabledState(e.PreviousInstance.EnabledState),
+		State:       EnabledState(e.TargetInstance.EnabledState),
+		Time:        created,
+	}, nil
+}
+
+// waitForState waits up to timeout for the machine to reach the state, from
+// its state changes rather than by polling, and updates vm with it.  If the
+// state changes cannot be subscribed to, the machine is polled instead.
+func (vm *VirtualMachine) waitForState(target EnabledState, timeout time.Duration) error {
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	sub, err := service.Subscribe(fmt.Sprintf("%s AND TargetInstance.Name = '%s'", stateEventQuery, vm.Name))
+	if err != nil {
+		logrus.Debugf("polling machine state, subscribing to state changes failed: %v", err)
+		return vm.pollForState(target, timeout)
+	}
+	defer sub.Close()
+
+	// The machine may have changed before the subscription started
+	refreshVM, err := vm.vmm.GetMachine(vm.ElementName)
+	if err != nil {
+		return err
+	}
+	vm.EnabledState = refreshVM.EnabledState
+
+	deadline := time.Now().Add(timeout)
+	for vm.State() != target {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("machine is %s, want %s: %w", vm.State(), target, ErrMachineStateTimeout)
+		}
+		change, err := nextStateChange(sub, remaining)
+		if err != nil {
+			return err
+		}
+		if change != nil {
+			vm.EnabledState = uint16(change.State)
+		}
+	}
+	return nil
+}
+
+// pollForState is waitForState for when state changes cannot be subscribed
+// to, it looks up the machine again until it is in the state
+func (vm *VirtualMachine) pollForState(target EnabledState, timeout time.Duration) error {
+	const interval = 50 * time.Millisecond
+
+	deadline := time.Now().Add(timeout)
+	for {
+		refreshVM, err := vm.vmm.GetMachine(vm.ElementName)
+		if err != nil {
+			return err
+		}
+		vm.EnabledState = refreshVM.EnabledState
+		if vm.State() == target {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("machine is %s, want %s: %w", vm.State(), target, ErrMachineStateTimeout)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,467 @@
+//go:build windows
+
+package hypervctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/containers/libhvee/pkg/wmiext"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	exportAllSnapshots = 0
+	exportNoSnapshots  = 1
+
+	virtualDiskResourceType = 31
+)
+
+// ExportOptions control what VirtualMachine.Export writes
+type ExportOptions struct {
+	// IncludeCheckpoints exports all checkpoints instead of only the
+	// current state
+	IncludeCheckpoints bool
+	// ConfigOnly skips copying the virtual disks
+	ConfigOnly bool
+	// Progress is called with the completion percentage of the export
+	Progress func(percent uint16)
+	// Status is called whenever the state or status of the export job
+	// changes
+	Status func(wmiext.JobProgress)
+}
+
+// ImportMode selects where an imported machine keeps its files
+type ImportMode int
+
+const (
+	// ImportRegister uses the exported files where they are
+	ImportRegister ImportMode = iota
+	// ImportCopy copies the disks and the configuration to DestinationDir
+	ImportCopy
+)
+
+// ImportOptions control how VirtualMachineManager.Import creates the
+// machine
+type ImportOptions struct {
+	Mode ImportMode
+	// DestinationDir receives the files of a copied machine
+	DestinationDir string
+	// GenerateNewID gives the machine a new identifier, required to import
+	// a machine next to the one it was exported from
+	GenerateNewID bool
+	// DiskPaths maps disk paths recorded in the export to the paths the
+	// imported machine should use.  Mapped disks are not copied.
+	DiskPaths map[string]string
+	// Progress is called with the completion percentage of each import step
+	Progress func(percent uint16)
+	// Status is called whenever the state or status of an import job
+	// changes
+	Status func(wmiext.JobProgress)
+}
+
+// Export writes the definition of the machine and, unless configured
+// otherwise, its disks to a subdirectory of dir named after the machine
+func (vm *VirtualMachine) Export(dir string, opts *ExportOptions) error {
+	return vm.ExportContext(context.Background(), dir, opts)
+}
+
+// ExportContext is like Export, it terminates the export job when ctx ends
+func (vm *VirtualMachine) ExportContext(ctx context.Context, dir string, opts *ExportOptions) error {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	settings, err := service.SpawnInstance("Msvm_VirtualSystemExportSettingData")
+	if err != nil {
+		return err
+	}
+	defer settings.Close()
+
+	copySnapshots := uint8(exportNoSnapshots)
+	if opts.IncludeCheckpoints {
+		copySnapshots = exportAllSnapshots
+	}
+	if err := settings.Put("CopySnapshotConfiguration", copySnapshots); err != nil {
+		return err
+	}
+	if err := settings.Put("CopyVmStorage", !opts.ConfigOnly); err != nil {
+		return err
+	}
+	if err := settings.Put("CopyVmRuntimeInformation", true); err != nil {
+		return err
+	}
+	if err := settings.Put("CreateVmExportSubdirectory", true); err != nil {
+		return err
+	}
+
+	vsms, err := service.GetSingletonInstance(VirtualSystemManagementService)
+	if err != nil {
+		return err
+	}
+	defer vsms.Close()
+
+	var (
+		job *wmiext.Instance
+		res int32
+	)
+	err = vsms.BeginInvoke("ExportSystemDefinition").
+		In("ComputerSystem", vm.Path()).
+		In("ExportDirectory", dir).
+		In("ExportSettingData", settings.GetCimText()).
+		Execute().
+		Out("Job", &job).
+		Out("ReturnValue", &res).
+		End()
+	if err != nil {
+		return fmt.Errorf("failed to export vm: %w", err)
+	}
+	return waitVMResultContext(ctx, res, service, job, "failed to export vm", nil, jobProgress(opts.Progress, opts.Status))
+}
+
+// Import creates a machine from the definition file (.vmcx) of an export
+func (vmm *VirtualMachineManager) Import(path string, opts *ImportOptions) (*VirtualMachine, error) {
+	return vmm.ImportContext(context.Background(), path, opts)
+}
+
+// ImportContext is like Import, when ctx ends the running job is terminated
+// and the partially imported machine removed
+func (vmm *VirtualMachineManager) ImportContext(ctx context.Context, path string, opts *ImportOptions) (*VirtualMachine, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	if opts.Mode == ImportCopy && opts.DestinationDir == "" {
+		return nil, errors.New("a destination directory is required to copy a machine")
+	}
+	progress := jobProgress(opts.Progress, opts.Status)
+
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return nil, err
+	}
+	defer service.Close()
+
+	vsms, err := service.GetSingletonInstance(VirtualSystemManagementService)
+	if err != nil {
+		return nil, err
+	}
+	defer vsms.Close()
+
+	// An export keeps the definition in "Virtual Machines" next to the
+	// checkpoints in "Snapshots"
+	snapshotDir := filepath.Join(filepath.Dir(filepath.Dir(path)), "Snapshots")
+	if _, err := os.Stat(snapshotDir); err != nil {
+		snapshotDir = ""
+	}
+
+	var (
+		job, planned *wmiext.Instance
+		res          int32
+	)
+	err = vsms.BeginInvoke("ImportSystemDefinition").
+		In("SystemDefinitionFile", path).
+		In("SnapshotFolder", snapshotDir).
+		In("GenerateNewSystemIdentifier", opts.GenerateNewID).
+		Execute().
+		Out("Job", &job).
+		Out("ImportedSystem", &planned).
+		Out("ReturnValue", &res).
+		End()
+	if err != nil {
+		return nil, fmt.Errorf("failed to import vm: %w", err)
+	}
+	if planned == nil && (res != 4096 || job == nil) {
+		if job != nil {
+			job.Close()
+		}
+		if res != 4096 {
+			if err := waitVMResult(res, service, nil, "failed to import vm", nil); err != nil {
+				return nil, err
+			}
+		}
+		return nil, errors.New("failed to import vm: neither a planned vm nor a job was returned")
+	}
+	if planned == nil {
+		jobPath, err := job.Path()
+		if err != nil {
+			job.Close()
+			return nil, err
+		}
+		if err := waitVMResultContext(ctx, res, service, job, "failed to import vm", nil, progress); err != nil {
+			return nil, err
+		}
+		if planned, err = service.FindFirstRelatedInstanceThrough(jobPath, "Msvm_PlannedComputerSystem", "Msvm_AffectedJobElement"); err != nil {
+			return nil, fmt.Errorf("could not find the imported vm: %w", err)
+		}
+	} else if job != nil {
+		job.Close()
+	}
+	defer planned.Close()
+
+	name, err := planned.GetAsString("Name")
+	if err != nil {
+		return nil, err
+	}
+
+	// Disks copied for the planned machine are removed again when it
+	// cannot be realized
+	var undo rollback
+	if err := preparePlannedSystem(ctx, service, planned, opts, &undo); err != nil {
+		destroyPlannedSystem(service, vsms, planned)
+		return nil, undo.run(err)
+	}
+
+	var realizeJob *wmiext.Instance
+	err = vsms.BeginInvoke("RealizePlannedSystem").
+		In("PlannedSystem", planned).
+		Execute().
+		Out("Job", &realizeJob).
+		Out("ReturnValue", &res).
+		End()
+	if err == nil {
+		err = waitVMResultContext(ctx, res, service, realizeJob, "failed to realize imported vm", nil, progress)
+	}
+	if err != nil {
+		destroyPlannedSystem(service, vsms, planned)
+		return nil, undo.run(fmt.Errorf("failed to realize imported vm: %w", err))
+	}
+
+	vm := &VirtualMachine{vmm: vmm}
+	wql := fmt.Sprintf("Select * From %s Where Name = '%s'", MsvmComputerSystem, name)
+	if err := service.FindFirstObject(wql, vm); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// preparePlannedSystem moves the files of a planned machine to where the
+// options want them, every disk it copies is recorded in undo
+func preparePlannedSystem(ctx context.Context, service *wmiext.Service, planned *wmiext.Instance, opts *ImportOptions, undo *rollback) error {
+	plannedPath, err := planned.Path()
+	if err != nil {
+		return err
+	}
+	settings, err := service.FindFirstRelatedInstanceThrough(plannedPath, "Msvm_VirtualSystemSettingData", "Msvm_SettingsDefineState")
+	if err != nil {
+		return err
+	}
+	defer settings.Close()
+
+	if opts.Mode == ImportCopy {
+		if err := os.MkdirAll(opts.DestinationDir, 0755); err != nil {
+			return err
+		}
+		for _, prop := range []string{"ConfigurationDataRoot", "SnapshotDataRoot", "SwapFileDataRoot"} {
+			if err := settings.Put(prop, opts.DestinationDir); err != nil {
+				return err
+			}
+		}
+		if err := modifySystemSettings(service, settings, "failed to relocate imported vm"); err != nil {
+			return err
+		}
+	}
+
+	settingsPath, err := settings.Path()
+	if err != nil {
+		return err
+	}
+	return remapDisks(ctx, service, settingsPath, opts, undo)
+}
+
+// remapDisks points the disks of a planned machine to their new location,
+// copying them first in ImportCopy mode
+func remapDisks(ctx context.Context, service *wmiext.Service, settingsPath string, opts *ImportOptions, undo *rollback) error {
+	const wql = "ASSOCIATORS OF {%s} WHERE ResultClass = Msvm_StorageAllocationSettingData"
+
+	enum, err := service.ExecQuery(fmt.Sprintf(wql, settingsPath))
+	if err != nil {
+		return err
+	}
+	defer enum.Close()
+
+	var changed []string
+	for {
+		disk, err := enum.Next()
+		if err != nil {
+			return err
+		}
+		if disk == nil {
+			break
+		}
+
+		if err := ctx.Err(); err != nil {
+			disk.Close()
+			return err
+		}
+		str, err := remapDisk(ctx, disk, opts, undo)
+		disk.Close()
+		if err != nil {
+			return err
+		}
+		if str != "" {
+			changed = append(changed, str)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	vsms, err := service.GetSingletonInstance(VirtualSystemManagementService)
+	if err != nil {
+		return err
+	}
+	defer vsms.Close()
+
+	var (
+		job *wmiext.Instance
+		res int32
+	)
+	err = vsms.BeginInvoke("ModifyResourceSettings").
+		In("ResourceSettings", changed).
+		Execute().
+		Out("Job", &job).
+		Out("ReturnValue", &res).
+		End()
+	if err != nil {
+		return fmt.Errorf("failed to remap disks: %w", err)
+	}
+	return waitVMResultContext(ctx, res, service, job, "failed to remap disks", translateModifyError, jobProgress(opts.Progress, opts.Status))
+}
+
+// remapDisk returns the updated settings of a disk, or nothing if it stays
+// where it is
+func remapDisk(ctx context.Context, disk *wmiext.Instance, opts *ImportOptions, undo *rollback) (string, error) {
+	var settings StorageAllocationSettings
+	if err := disk.GetAll(&settings); err != nil {
+		return "", err
+	}
+	if settings.ResourceType != virtualDiskResourceType || len(settings.HostResource) == 0 {
+		return "", nil
+	}
+
+	source := settings.HostResource[0]
+	target, mapped := lookupDiskPath(opts.DiskPaths, source)
+	if !mapped {
+		if opts.Mode != ImportCopy {
+			return "", nil
+		}
+		target = filepath.Join(opts.DestinationDir, filepath.Base(source))
+		if err := copyFile(ctx, source, target, opts.Progress); err != nil {
+			return "", fmt.Errorf("failed to copy disk %q: %w", source, err)
+		}
+		undo.add("remove copied disk "+target, func() error {
+			return os.Remove(target)
+		})
+	}
+
+	if err := disk.Put("HostResource", []string{target}); err != nil {
+		return "", err
+	}
+	return disk.GetCimText(), nil
+}
+
+// lookupDiskPath finds a disk in the mapping, paths are case insensitive
+// on Windows
+func lookupDiskPath(paths map[string]string, path string) (string, bool) {
+	for from, to := range paths {
+		if strings.EqualFold(filepath.Clean(from), filepath.Clean(path)) {
+			return to, true
+		}
+	}
+	return "", false
+}
+
+// copyFile copies src to the new file dst, reporting the completion
+// percentage to progress.  A partial copy is removed when it fails or ctx
+// ends.
+func copyFile(ctx context.Context, src, dst string, progress func(percent uint16)) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := copyData(ctx, out, in, info.Size(), progress); err != nil {
+		out.Close()
+		_ = os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// copyData copies size bytes in chunks, checking ctx between them
+func copyData(ctx context.Context, out io.Writer, in io.Reader, size int64, progress func(percent uint16)) error {
+	const chunkSize = 4 << 20
+
+	buf := make([]byte, chunkSize)
+	var copied int64
+	last := -1
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := in.Read(buf)
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+			copied += int64(n)
+			if progress != nil && size > 0 {
+				if percent := int(min(copied, size) * 100 / size); percent != last {
+					last = percent
+					progress(uint16(percent))
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// destroyPlannedSystem drops a planned machine after a failed import
+func destroyPlannedSystem(service *wmiext.Service, vsms *wmiext.Instance, planned *wmiext.Instance) {
+	var (
+		job *wmiext.Instance
+		res int32
+	)
+	err := vsms.BeginInvoke("DestroySystem").
+		In("AffectedSystem", planned).
+		Execute().
+		Out("Job", &job).
+		Out("ReturnValue", &res).
+		End()
+	if err == nil {
+		err = waitVMResult(res, service, job, "failed to remove planned vm", nil)
+	}
+	if err != nil {
+		logrus.Warnf("could not remove the planned vm of a failed import: %v", err)
+	}
+}
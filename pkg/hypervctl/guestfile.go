@@ -0,0 +1,109 @@
+//go:build windows
+
+package hypervctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/containers/libhvee/pkg/wmiext"
+)
+
+// CopyFileOptions changes how CopyFileToGuest writes the file in the guest
+type CopyFileOptions struct {
+	// Overwrite replaces an existing file at the destination
+	Overwrite bool
+	// CreateDirectories creates the missing parent directories of the
+	// destination
+	CreateDirectories bool
+	// Progress is called with the completion percentage of the copy
+	Progress func(percent uint16)
+	// Status is called whenever the state or status of the copy job
+	// changes
+	Status func(wmiext.JobProgress)
+}
+
+// copyFileSettings is a Msvm_CopyFileToGuestSettingData
+type copyFileSettings struct {
+	SourcePath        string
+	DestinationPath   string
+	OverwriteExisting bool
+	CreateFullPath    bool
+}
+
+// CopyFileToGuest copies the host file src to the absolute path dst in the
+// running guest.  It needs the guest services integration service enabled
+// and a daemon serving it in the guest, such as hv_fcopy_daemon or fcopyd
+// on Linux.
+func (vm *VirtualMachine) CopyFileToGuest(src, dst string, opts *CopyFileOptions) error {
+	return vm.CopyFileToGuestContext(context.Background(), src, dst, opts)
+}
+
+// CopyFileToGuestContext is like CopyFileToGuest, it terminates the copy
+// job when ctx ends
+func (vm *VirtualMachine) CopyFileToGuestContext(ctx context.Context, src, dst string, opts *CopyFileOptions) error {
+	if opts == nil {
+		opts = &CopyFileOptions{}
+	}
+	// The source is opened by the host service, not by this process
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+
+	refreshVM, err := vm.vmm.GetMachine(vm.ElementName)
+	if err != nil {
+		return err
+	}
+	vm.EnabledState = refreshVM.EnabledState
+	if !Enabled.equal(vm.EnabledState) {
+		return ErrMachineNotRunning
+	}
+
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	component, err := getIntegrationComponent(service, vm.Path(), IntegrationGuestService)
+	if err != nil {
+		return err
+	}
+	fileService, err := service.FindFirstRelatedInstance(component.S__PATH, "Msvm_GuestFileService")
+	if errors.Is(err, wmiext.ErrNoResults) {
+		return fmt.Errorf("guest file service not found: %w", ErrIntegrationServiceDisabled)
+	}
+	if err != nil {
+		return err
+	}
+	defer fileService.Close()
+
+	settings, err := service.CreateInstance("Msvm_CopyFileToGuestSettingData", &copyFileSettings{
+		SourcePath:        src,
+		DestinationPath:   dst,
+		OverwriteExisting: opts.Overwrite,
+		CreateFullPath:    opts.CreateDirectories,
+	})
+	if err != nil {
+		return err
+	}
+	defer settings.Close()
+
+	var (
+		job *wmiext.Instance
+		res int32
+	)
+	err = fileService.BeginInvoke("CopyFilesToGuest").
+		In("CopyFileToGuestSettings", []string{settings.GetCimText()}).
+		Execute().
+		Out("Job", &job).
+		Out("ReturnValue", &res).
+		End()
+	if err != nil {
+		return fmt.Errorf("failed to copy file to guest: %w", err)
+	}
+	return waitVMResultContext(ctx, res, service, job, "failed to copy file to guest", nil, jobProgress(opts.Progress, opts.Status))
+}
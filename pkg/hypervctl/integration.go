@@ -0,0 +1,280 @@
+//go:build windows
+
+package hypervctl
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/containers/libhvee/pkg/wmiext"
+)
+
+// IntegrationService identifies one of the Hyper-V integration services
+// offered to the guest
+type IntegrationService string
+
+const (
+	// IntegrationHeartbeat reports whether the guest operating system runs
+	IntegrationHeartbeat IntegrationService = "Heartbeat"
+	// IntegrationTimeSync synchronizes the guest clock with the host
+	IntegrationTimeSync IntegrationService = "TimeSync"
+	// IntegrationShutdown lets the host shut the guest down gracefully
+	IntegrationShutdown IntegrationService = "Shutdown"
+	// IntegrationKvpExchange exchanges key-value pairs with the guest
+	IntegrationKvpExchange IntegrationService = "KvpExchange"
+	// IntegrationVss quiesces the guest file systems for backups
+	IntegrationVss IntegrationService = "Vss"
+	// IntegrationGuestService copies files from the host to the guest
+	IntegrationGuestService IntegrationService = "GuestServiceInterface"
+)
+
+// IntegrationServices lists every integration service
+var IntegrationServices = []IntegrationService{
+	IntegrationHeartbeat,
+	IntegrationTimeSync,
+	IntegrationShutdown,
+	IntegrationKvpExchange,
+	IntegrationVss,
+	IntegrationGuestService,
+}
+
+func (s IntegrationService) valid() bool {
+	for _, known := range IntegrationServices {
+		if s == known {
+			return true
+		}
+	}
+	return false
+}
+
+// settingsClass is the class holding whether the service is enabled
+func (s IntegrationService) settingsClass() string {
+	return "Msvm_" + string(s) + "ComponentSettingData"
+}
+
+// componentClass is the class holding what the guest reports for the
+// service
+func (s IntegrationService) componentClass() string {
+	return "Msvm_" + string(s) + "Component"
+}
+
+// IntegrationStatus is the operational status the guest reports for an
+// integration service
+type IntegrationStatus uint16
+
+const (
+	IntegrationStatusUnknown IntegrationStatus = 0
+	// IntegrationStatusOK The guest runs the service.
+	IntegrationStatusOK IntegrationStatus = 2
+	// IntegrationStatusDegraded The guest runs the service but reports a problem.
+	IntegrationStatusDegraded IntegrationStatus = 3
+	// IntegrationStatusError The guest reported an unrecoverable error.
+	IntegrationStatusError IntegrationStatus = 7
+	// IntegrationStatusNoContact The guest never answered, it is booting or
+	// does not run the service.
+	IntegrationStatusNoContact IntegrationStatus = 12
+	// IntegrationStatusLostCommunication The guest answered before but stopped.
+	IntegrationStatusLostCommunication IntegrationStatus = 13
+	// IntegrationStatusPaused The machine is paused.
+	IntegrationStatusPaused IntegrationStatus = 15
+)
+
+func (is IntegrationStatus) String() string {
+	switch is {
+	case IntegrationStatusOK:
+		return "ok"
+	case IntegrationStatusDegraded:
+		return "degraded"
+	case IntegrationStatusError:
+		return "error"
+	case IntegrationStatusNoContact:
+		return "no contact"
+	case IntegrationStatusLostCommunication:
+		return "lost communication"
+	case IntegrationStatusPaused:
+		return "paused"
+	}
+	return "unknown"
+}
+
+// IntegrationServiceState is the configuration and guest status of an
+// integration service
+type IntegrationServiceState struct {
+	Service IntegrationService
+	// Enabled tells whether the host offers the service to the guest
+	Enabled bool
+	// Status is what the guest reports, it is only meaningful while the
+	// machine runs and the service is enabled
+	Status IntegrationStatus
+}
+
+// integrationComponent holds the state of an integration service
+type integrationComponent struct {
+	S__PATH           string
+	EnabledState      uint16
+	OperationalStatus []uint16
+}
+
+func (c *integrationComponent) status() IntegrationStatus {
+	if len(c.OperationalStatus) == 0 {
+		return IntegrationStatusUnknown
+	}
+	return IntegrationStatus(c.OperationalStatus[0])
+}
+
+// SetIntegrationServices enables (true) or disables (false) integration
+// services of the machine, the services not listed are left as they are.
+// Most services can be changed while the machine runs.
+func (vm *VirtualMachine) SetIntegrationServices(services map[IntegrationService]bool) error {
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	settings, err := vm.fetchSystemSettingsInstance(service)
+	if err != nil {
+		return err
+	}
+	defer settings.Close()
+
+	path, err := settings.Path()
+	if err != nil {
+		return err
+	}
+	return setIntegrationServices(service, path, services)
+}
+
+// setIntegrationServices updates the integration service settings of a
+// system, by the path of its virtual system settings
+func setIntegrationServices(service *wmiext.Service, settingsPath string, services map[IntegrationService]bool) error {
+	var changed []string
+	for s := range services {
+		if !s.valid() {
+			return fmt.Errorf("unknown integration service %q", s)
+		}
+	}
+	for _, s := range IntegrationServices {
+		enable, ok := services[s]
+		if !ok {
+			continue
+		}
+		str, err := integrationSettingsText(service, settingsPath, s, enable)
+		if err != nil {
+			return err
+		}
+		changed = append(changed, str)
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+
+	vsms, err := service.GetSingletonInstance(VirtualSystemManagementService)
+	if err != nil {
+		return err
+	}
+	defer vsms.Close()
+
+	var (
+		job *wmiext.Instance
+		res int32
+	)
+	err = vsms.BeginInvoke("ModifyResourceSettings").
+		In("ResourceSettings", changed).
+		Execute().
+		Out("Job", &job).
+		Out("ReturnValue", &res).
+		End()
+	if err != nil {
+		return fmt.Errorf("failed to modify integration services: %w", err)
+	}
+	return waitVMResult(res, service, job, "failed to modify integration services", translateModifyError)
+}
+
+// integrationSettingsText returns the settings of a service with its
+// enabled state changed
+func integrationSettingsText(service *wmiext.Service, settingsPath string, s IntegrationService, enable bool) (string, error) {
+	i, err := service.FindFirstRelatedInstance(settingsPath, s.settingsClass())
+	if err != nil {
+		return "", fmt.Errorf("could not fetch %s integration service settings: %w", s, err)
+	}
+	defer i.Close()
+
+	state := Disabled
+	if enable {
+		state = Enabled
+	}
+	if err := i.Put("EnabledState", uint16(state)); err != nil {
+		return "", err
+	}
+	return i.GetCimText(), nil
+}
+
+// GetIntegrationServices returns whether each integration service is
+// enabled and what the guest reports for it
+func (vm *VirtualMachine) GetIntegrationServices() ([]IntegrationServiceState, error) {
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return nil, err
+	}
+	defer service.Close()
+
+	settings, err := vm.fetchSystemSettingsInstance(service)
+	if err != nil {
+		return nil, err
+	}
+	defer settings.Close()
+
+	path, err := settings.Path()
+	if err != nil {
+		return nil, err
+	}
+
+	var states []IntegrationServiceState
+	for _, s := range IntegrationServices {
+		var c integrationComponent
+		err := service.FindFirstRelatedObject(path, s.settingsClass(), &c)
+		if errors.Is(err, wmiext.ErrNoResults) {
+			// Not offered to this machine at all
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch %s integration service settings: %w", s, err)
+		}
+		state := IntegrationServiceState{Service: s, Enabled: Enabled.equal(c.EnabledState)}
+
+		if state.Enabled {
+			component, err := getIntegrationComponent(service, vm.Path(), s)
+			if err != nil && !errors.Is(err, ErrIntegrationServiceDisabled) {
+				return nil, err
+			}
+			if component != nil {
+				state.Status = component.status()
+			}
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// getIntegrationComponent returns the state of an integration service of a
+// machine, failing with ErrIntegrationServiceDisabled when it is turned off
+func getIntegrationComponent(service *wmiext.Service, vmPath string, s IntegrationService) (*integrationComponent, error) {
+	i, err := service.FindFirstRelatedInstance(vmPath, s.componentClass())
+	if errors.Is(err, wmiext.ErrNoResults) {
+		return nil, fmt.Errorf("%s: %w", s, ErrIntegrationServiceDisabled)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer i.Close()
+
+	var c integrationComponent
+	if err := i.GetAll(&c); err != nil {
+		return nil, err
+	}
+	if Disabled.equal(c.EnabledState) {
+		return nil, fmt.Errorf("%s: %w", s, ErrIntegrationServiceDisabled)
+	}
+	return &c, nil
+}
@@ -6,6 +6,8 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io"
+	"net"
+	"sort"
 	"strings"
 
 	"github.com/containers/libhvee/pkg/wmiext"
@@ -42,6 +44,64 @@ type CimKvpItemProperty struct {
 	Value string `xml:"VALUE"`
 }
 
+// Names of the intrinsic items reported by the guest kvp daemon
+const (
+	KvpFullyQualifiedDomainName   = "FullyQualifiedDomainName"
+	KvpIntegrationServicesVersion = "IntegrationServicesVersion"
+	KvpNetworkAddressIPv4         = "NetworkAddressIPv4"
+	KvpNetworkAddressIPv6         = "NetworkAddressIPv6"
+	KvpOSBuildNumber              = "OSBuildNumber"
+	KvpOSName                     = "OSName"
+	KvpOSMajorVersion             = "OSMajorVersion"
+	KvpOSMinorVersion             = "OSMinorVersion"
+	KvpOSVersion                  = "OSVersion"
+	KvpProcessorArchitecture      = "ProcessorArchitecture"
+)
+
+// GuestIntrinsicInfo describes a guest as reported by its kvp daemon
+type GuestIntrinsicInfo struct {
+	FullyQualifiedDomainName   string
+	IntegrationServicesVersion string
+	IPv4Addresses              []net.IP
+	IPv6Addresses              []net.IP
+	OSName                     string
+	OSVersion                  string
+	OSMajorVersion             string
+	OSMinorVersion             string
+	OSBuildNumber              string
+	ProcessorArchitecture      string
+	// Items holds all intrinsic items, including those without a field
+	Items map[string]string
+}
+
+func newGuestIntrinsicInfo(items map[string]string) *GuestIntrinsicInfo {
+	return &GuestIntrinsicInfo{
+		FullyQualifiedDomainName:   items[KvpFullyQualifiedDomainName],
+		IntegrationServicesVersion: items[KvpIntegrationServicesVersion],
+		IPv4Addresses:              parseKvpAddresses(items[KvpNetworkAddressIPv4]),
+		IPv6Addresses:              parseKvpAddresses(items[KvpNetworkAddressIPv6]),
+		OSName:                     items[KvpOSName],
+		OSVersion:                  items[KvpOSVersion],
+		OSMajorVersion:             items[KvpOSMajorVersion],
+		OSMinorVersion:             items[KvpOSMinorVersion],
+		OSBuildNumber:              items[KvpOSBuildNumber],
+		ProcessorArchitecture:      items[KvpProcessorArchitecture],
+		Items:                      items,
+	}
+}
+
+// parseKvpAddresses parses the semicolon separated address lists of the
+// network intrinsic items, entries that are not addresses are skipped
+func parseKvpAddresses(list string) []net.IP {
+	var ret []net.IP
+	for _, item := range strings.Split(list, ";") {
+		if ip := net.ParseIP(strings.TrimSpace(item)); ip != nil {
+			ret = append(ret, ip)
+		}
+	}
+	return ret
+}
+
 type KvpError struct {
 	ErrorCode int
 	message   string
@@ -51,6 +111,34 @@ func (k *KvpError) Error() string {
 	return fmt.Sprintf("%s (%d)", k.message, k.ErrorCode)
 }
 
+// KvpBatchOptions control how a batch of key-value pairs is applied
+type KvpBatchOptions struct {
+	// PerItem retries the keys a failed batch job did not apply one at a
+	// time, so the keys that still fail are reported in a *KvpBatchError
+	// instead of failing the whole batch
+	PerItem bool
+}
+
+// KvpBatchError lists the keys a batch operation failed for
+type KvpBatchError struct {
+	Operation string
+	Errors    map[string]error
+}
+
+func (k *KvpBatchError) Error() string {
+	keys := make([]string, 0, len(k.Errors))
+	for key := range k.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	msgs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		msgs = append(msgs, fmt.Sprintf("%q: %v", key, k.Errors[key]))
+	}
+	return fmt.Sprintf("%s failed for %d keys: %s", k.Operation, len(keys), strings.Join(msgs, "; "))
+}
+
 func createKvpItem(service *wmiext.Service, key string, value string) (string, error) {
 	item, err := service.SpawnInstance(KvpExchangeDataItemName)
 	if err != nil {
@@ -0,0 +1,133 @@
+//go:build windows
+
+package hypervctl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// HeartbeatStatus returns the Heartbeat of the summary as a typed value
+func (s *SummaryInformation) HeartbeatStatus() IntegrationStatus {
+	return IntegrationStatus(s.Heartbeat)
+}
+
+// How often WaitForReady checks the guest by default
+const defaultReadyInterval = time.Second
+
+// ReadyCriteria lists what WaitForReady waits for besides a heartbeat
+type ReadyCriteria struct {
+	// GuestKey waits until the guest publishes this key in its kvp pool
+	GuestKey string
+	// IPAddress waits until the guest reports a routable address
+	IPAddress bool
+	// Interval is the time between checks, one second by default
+	Interval time.Duration
+}
+
+// WaitForReady waits until the guest operating system is up: the heartbeat
+// integration service reports OK and the optional criteria are met.  It
+// fails with ErrGuestReadyTimeout when ctx ends first, ErrMachineStopped
+// when the machine leaves the running state and ErrIntegrationServiceDisabled
+// when a service the wait depends on is turned off.
+func (vm *VirtualMachine) WaitForReady(ctx context.Context, criteria *ReadyCriteria) error {
+	if criteria == nil {
+		criteria = &ReadyCriteria{}
+	}
+	interval := criteria.Interval
+	if interval <= 0 {
+		interval = defaultReadyInterval
+	}
+
+	waiting := "the machine"
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: waiting for %s: %w", ErrGuestReadyTimeout, waiting, ctx.Err())
+		case <-timer.C:
+		}
+
+		var err error
+		if waiting, err = vm.checkReady(criteria); err != nil {
+			return err
+		}
+		if waiting == "" {
+			return nil
+		}
+		timer.Reset(interval)
+	}
+}
+
+// checkReady checks the guest once and returns what it still waits for, or
+// an empty string when the guest is ready
+func (vm *VirtualMachine) checkReady(criteria *ReadyCriteria) (string, error) {
+	refreshVM, err := vm.vmm.GetMachine(vm.ElementName)
+	if err != nil {
+		return "", err
+	}
+	vm.EnabledState = refreshVM.EnabledState
+	switch vm.State() {
+	case Disabled, ShuttingDown, Saved, Paused:
+		return "", fmt.Errorf("machine is %s: %w", vm.State(), ErrMachineStopped)
+	case Enabled:
+	default:
+		return fmt.Sprintf("machine to run, it is %s", vm.State()), nil
+	}
+
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return "", err
+	}
+	defer service.Close()
+
+	heartbeat, err := getIntegrationComponent(service, vm.Path(), IntegrationHeartbeat)
+	if err != nil {
+		return "", err
+	}
+	if status := heartbeat.status(); status != IntegrationStatusOK {
+		return fmt.Sprintf("heartbeat, it is %s", status), nil
+	}
+
+	if criteria.GuestKey == "" && !criteria.IPAddress {
+		return "", nil
+	}
+	if _, err := getIntegrationComponent(service, vm.Path(), IntegrationKvpExchange); err != nil {
+		return "", err
+	}
+	if criteria.GuestKey != "" {
+		pairs, err := vm.GetGuestKeyValuePairs()
+		if err != nil {
+			return "", err
+		}
+		if _, ok := pairs[criteria.GuestKey]; !ok {
+			return fmt.Sprintf("guest key %q", criteria.GuestKey), nil
+		}
+	}
+	if criteria.IPAddress {
+		info, err := vm.GetGuestIntrinsicInfo()
+		if err != nil {
+			return "", err
+		}
+		if !hasRoutableAddress(info) {
+			return "an IP address", nil
+		}
+	}
+	return "", nil
+}
+
+// hasRoutableAddress tells whether the guest reported an address other than
+// a loopback or link-local one, which it assigns before any network is up
+func hasRoutableAddress(info *GuestIntrinsicInfo) bool {
+	for _, addrs := range [][]net.IP{info.IPv4Addresses, info.IPv6Addresses} {
+		for _, ip := range addrs {
+			if !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified() {
+				return true
+			}
+		}
+	}
+	return false
+}
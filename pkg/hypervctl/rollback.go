@@ -0,0 +1,119 @@
+//go:build windows
+
+package hypervctl
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/containers/libhvee/pkg/wmiext"
+)
+
+// RollbackError reports an operation that failed and could not be fully
+// undone.  Err is the original cause, Cleanup lists what was left behind.
+type RollbackError struct {
+	Err     error
+	Cleanup []error
+}
+
+func (e *RollbackError) Error() string {
+	msgs := make([]string, len(e.Cleanup))
+	for i, err := range e.Cleanup {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%v (cleanup failed: %s)", e.Err, strings.Join(msgs, "; "))
+}
+
+func (e *RollbackError) Unwrap() []error {
+	return append([]error{e.Err}, e.Cleanup...)
+}
+
+// rollback records what a multi-step operation created, so a failure can
+// remove it again in reverse order
+type rollback struct {
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	what string
+	undo func() error
+}
+
+// add records how to undo a step that succeeded
+func (r *rollback) add(what string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{what, undo})
+}
+
+// run undoes every recorded step, latest first, after cause made the
+// operation fail.  It returns cause, or a *RollbackError when a step could
+// not be undone.
+func (r *rollback) run(cause error) error {
+	var cleanup []error
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		if err := r.steps[i].undo(); err != nil {
+			cleanup = append(cleanup, fmt.Errorf("%s: %w", r.steps[i].what, err))
+		}
+	}
+	r.steps = nil
+	if len(cleanup) == 0 {
+		return cause
+	}
+	return &RollbackError{Err: cause, Cleanup: cleanup}
+}
+
+// removeResource removes resource settings added to a system
+func removeResource(resourcePath string) error {
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	vsms, err := service.GetSingletonInstance(VirtualSystemManagementService)
+	if err != nil {
+		return err
+	}
+	defer vsms.Close()
+
+	var (
+		job *wmiext.Instance
+		res int32
+	)
+	if err := vsms.BeginInvoke("RemoveResourceSettings").
+		In("ResourceSettings", []string{resourcePath}).
+		Execute().
+		Out("Job", &job).
+		Out("ReturnValue", &res).End(); err != nil {
+		return fmt.Errorf("RemoveResourceSettings failed: %w", err)
+	}
+	return waitVMResult(res, service, job, "failed to remove resource", nil)
+}
+
+// destroySystem removes a defined system whatever its state, unlike
+// VirtualMachine.Remove it does not require the machine to be off
+func destroySystem(systemPath string) error {
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return err
+	}
+	defer service.Close()
+
+	vsms, err := service.GetSingletonInstance(VirtualSystemManagementService)
+	if err != nil {
+		return err
+	}
+	defer vsms.Close()
+
+	var (
+		job *wmiext.Instance
+		res int32
+	)
+	if err := vsms.BeginInvoke("DestroySystem").
+		In("AffectedSystem", systemPath).
+		Execute().
+		Out("Job", &job).
+		Out("ReturnValue", &res).End(); err != nil {
+		return fmt.Errorf("DestroySystem failed: %w", err)
+	}
+	return waitVMResult(res, service, job, "failed to remove vm", nil)
+}
@@ -58,7 +58,7 @@ func (c *ScsiControllerSettings) createSyntheticDriveInternal(slot uint, setting
 		return err
 	}
 
-	path, err := addResource(service, c.systemSettings.Path(), driveResource)
+	path, err := addResource(service, c.systemSettings, driveResource)
 	if err != nil {
 		return err
 	}
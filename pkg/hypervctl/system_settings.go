@@ -71,6 +71,9 @@ type SystemSettings struct {
 	LowMmioGapSize                       uint64
 	HighMmioGapSize                      uint64
 	EnhancedSessionTransportType         uint16
+
+	// Records the resources added while the system is being created
+	rollback *rollback
 }
 
 func DefaultSystemSettings() *SystemSettings {
@@ -123,7 +126,7 @@ func (s *SystemSettings) createSystemResourceInternal(settings interface{}, reso
 		return err
 	}
 
-	path, err := addResource(service, s.Path(), resourceStr)
+	path, err := addResource(service, s, resourceStr)
 	if err != nil {
 		return err
 	}
@@ -151,7 +154,9 @@ func (s *SystemSettings) AddSyntheticEthernetPort(beforeAdd func(*SyntheticEther
 	return port, nil
 }
 
-func addResource(service *wmiext.Service, systemSettingPath string, resourceSettings string) (string, error) {
+// addResource adds resource settings to a system, when the system is being
+// created the resource is recorded for its rollback
+func addResource(service *wmiext.Service, system *SystemSettings, resourceSettings string) (string, error) {
 	vsms, err := service.GetSingletonInstance(VirtualSystemManagementService)
 	if err != nil {
 		return "", err
@@ -162,7 +167,7 @@ func addResource(service *wmiext.Service, systemSettingPath string, resourceSett
 	var resultingSettings []string
 	var job *wmiext.Instance
 	err = vsms.BeginInvoke("AddResourceSettings").
-		In("AffectedConfiguration", systemSettingPath).
+		In("AffectedConfiguration", system.Path()).
 		In("ResourceSettings", []string{resourceSettings}).
 		Execute().
 		Out("Job", &job).
@@ -176,6 +181,12 @@ func addResource(service *wmiext.Service, systemSettingPath string, resourceSett
 	err = waitVMResult(res, service, job, "failed to add resource", nil)
 
 	if len(resultingSettings) > 0 {
+		if system.rollback != nil {
+			path := resultingSettings[0]
+			system.rollback.add("remove resource "+path, func() error {
+				return removeResource(path)
+			})
+		}
 		return resultingSettings[0], err
 	}
 
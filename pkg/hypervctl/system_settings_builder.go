@@ -12,7 +12,10 @@ type SystemSettingsBuilder struct {
 	systemSettings    *SystemSettings
 	processorSettings *ProcessorSettings
 	memorySettings    *MemorySettings
-	err               error
+	// When set, the defined system and every resource later added to it
+	// are recorded so a failed creation can remove them
+	rollback *rollback
+	err      error
 }
 
 func NewSystemSettingsBuilder() *SystemSettingsBuilder {
@@ -86,7 +89,7 @@ func (builder *SystemSettingsBuilder) Build() (*SystemSettings, error) {
 	if builder.PrepareSystemSettings("unnamed-vm", nil).
 		PrepareProcessorSettings(nil).
 		PrepareMemorySettings(nil).err != nil {
-		return nil, err
+		return nil, builder.err
 	}
 
 	if service, err = NewLocalHyperVService(); err != nil {
@@ -142,6 +145,12 @@ func (builder *SystemSettingsBuilder) Build() (*SystemSettings, error) {
 	if err != nil {
 		return nil, err
 	}
+	if builder.rollback != nil {
+		builder.rollback.add("remove vm "+builder.systemSettings.ElementName, func() error {
+			return destroySystem(resultingSystem)
+		})
+		builder.systemSettings.rollback = builder.rollback
+	}
 
 	newSettings, err := service.FindFirstRelatedInstance(resultingSystem, "Msvm_VirtualSystemSettingData")
 	if err != nil {
@@ -10,9 +10,9 @@ import (
 	"go.podman.io/common/pkg/strongunits"
 )
 
-// ResizeDisk takes a diskPath and strongly typed new size and uses powershell
-// to change its size.  There is no error protection for trying to size a disk
-// smaller than the current size.
+// ResizeDisk takes a diskPath and strongly typed new size and changes the
+// size of the disk.  Shrinking is refused with ErrDiskShrinkUnsafe when the
+// new size is less than the minimum size reported by GetDiskState.
 func ResizeDisk(diskPath string, newSize strongunits.GiB) error {
 	var (
 		service *wmiext.Service
@@ -21,6 +21,10 @@ func ResizeDisk(diskPath string, newSize strongunits.GiB) error {
 		ret     int32
 	)
 
+	if err := checkShrink(diskPath, newSize.ToBytes()); err != nil {
+		return err
+	}
+
 	if service, err = NewLocalHyperVService(); err != nil {
 		return err
 	}
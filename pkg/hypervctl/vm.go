@@ -4,9 +4,15 @@ package hypervctl
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/containers/libhvee/pkg/kvp/ginsu"
@@ -72,18 +78,130 @@ type VirtualMachine struct {
 func (vm *VirtualMachine) Path() string {
 	return vm.S__PATH
 }
+
+// IgnitionOptions control how an Ignition config is stored in the
+// key-value pairs of the machine
+type IgnitionOptions struct {
+	// Codec stores the config with ginsu.Split, compressed with the codec
+	// and described by a header key.  It needs a guest that reads the
+	// header, such as pkg/kvp/ignition.  Empty keeps the raw parts and
+	// manifest that every guest reads.
+	Codec ginsu.Codec
+}
+
 func (vm *VirtualMachine) SplitAndAddIgnition(keyPrefix string, ignRdr *bytes.Reader) error {
-	parts, err := ginsu.Dice(ignRdr)
+	return vm.SplitAndAddIgnitionWithOptions(keyPrefix, ignRdr, nil)
+}
+
+// SplitAndAddIgnitionWithOptions is like SplitAndAddIgnition, storing the
+// config as opts ask
+func (vm *VirtualMachine) SplitAndAddIgnitionWithOptions(keyPrefix string, ignRdr io.Reader, opts *IgnitionOptions) error {
+	ign, err := splitIgnition(keyPrefix, ignRdr, opts)
 	if err != nil {
 		return err
 	}
-	for idx, val := range parts {
-		key := fmt.Sprintf("%s%d", keyPrefix, idx)
-		if err := vm.AddKeyValuePair(key, val); err != nil {
+	pairs := splitKeyValuePairs(keyPrefix, ign.parts)
+	pairs[ign.metaKey] = ign.metaValue
+	return vm.AddKeyValuePairs(pairs)
+}
+
+// ReplaceIgnition stores a new Ignition config in place of an existing one.
+// The manifest is updated first so a guest reading in the middle of the
+// replacement rejects the mixed parts, and leftover parts of a longer
+// previous config are removed.  A header of a previous config stored with
+// ginsu.Split is removed before, since guests prefer it to the manifest.
+func (vm *VirtualMachine) ReplaceIgnition(keyPrefix string, ignRdr *bytes.Reader) error {
+	return vm.ReplaceIgnitionWithOptions(keyPrefix, ignRdr, nil)
+}
+
+// ReplaceIgnitionWithOptions is like ReplaceIgnition, storing the config as
+// opts ask.  With a codec the header takes the place of the manifest, its
+// digest makes the guest reject mixed parts.
+func (vm *VirtualMachine) ReplaceIgnitionWithOptions(keyPrefix string, ignRdr io.Reader, opts *IgnitionOptions) error {
+	ign, err := splitIgnition(keyPrefix, ignRdr, opts)
+	if err != nil {
+		return err
+	}
+	current, err := vm.GetKeyValuePairs()
+	if err != nil {
+		return err
+	}
+
+	if _, exists := current[ign.staleKey]; exists {
+		if err := vm.RemoveKeyValuePair(ign.staleKey); err != nil {
 			return err
 		}
 	}
-	return nil
+	if err := vm.PutKeyValuePair(ign.metaKey, ign.metaValue); err != nil {
+		return err
+	}
+
+	added := make(map[string]string)
+	modified := make(map[string]string)
+	for key, val := range splitKeyValuePairs(keyPrefix, ign.parts) {
+		old, exists := current[key]
+		switch {
+		case !exists:
+			added[key] = val
+		case old != val:
+			modified[key] = val
+		}
+	}
+	if err := vm.ModifyKeyValuePairs(modified); err != nil {
+		return err
+	}
+	if err := vm.AddKeyValuePairs(added); err != nil {
+		return err
+	}
+
+	var stale []string
+	for key := range current {
+		idx, err := strconv.Atoi(strings.TrimPrefix(key, keyPrefix))
+		if strings.HasPrefix(key, keyPrefix) && err == nil && idx >= len(ign.parts) {
+			stale = append(stale, key)
+		}
+	}
+	return vm.RemoveKeyValuePairs(stale)
+}
+
+// splitIgnitionResult holds the parts of a config and the key describing
+// them, staleKey is the key of the other format
+type splitIgnitionResult struct {
+	parts     []string
+	metaKey   string
+	metaValue string
+	staleKey  string
+}
+
+func splitIgnition(keyPrefix string, ignRdr io.Reader, opts *IgnitionOptions) (*splitIgnitionResult, error) {
+	manifestKey := keyPrefix + ginsu.ManifestSuffix
+	headerKey := keyPrefix + ginsu.HeaderSuffix
+
+	if opts == nil || opts.Codec == "" {
+		b, err := io.ReadAll(ignRdr)
+		if err != nil {
+			return nil, err
+		}
+		parts, err := ginsu.Dice(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return &splitIgnitionResult{parts, manifestKey, ginsu.NewManifest(parts).String(), headerKey}, nil
+	}
+
+	header, parts, err := ginsu.SplitToParts(ignRdr, ginsu.Options{Codec: opts.Codec})
+	if err != nil {
+		return nil, err
+	}
+	return &splitIgnitionResult{parts, headerKey, header.String(), manifestKey}, nil
+}
+
+func splitKeyValuePairs(keyPrefix string, parts []string) map[string]string {
+	pairs := make(map[string]string, len(parts)+1)
+	for idx, val := range parts {
+		pairs[fmt.Sprintf("%s%d", keyPrefix, idx)] = val
+	}
+	return pairs
 }
 
 func (vm *VirtualMachine) AddKeyValuePair(key string, value string) error {
@@ -112,6 +230,57 @@ func (vm *VirtualMachine) RemoveKeyValuePairNoWait(key string) error {
 	return vm.kvpOperation("RemoveKvpItems", key, "", true, "key invalid?")
 }
 
+// AddKeyValuePairs creates all keys with a single AddKvpItems job, the job
+// error is returned if it fails
+func (vm *VirtualMachine) AddKeyValuePairs(pairs map[string]string) error {
+	return vm.AddKeyValuePairsWithOptions(pairs, nil)
+}
+
+// AddKeyValuePairsWithOptions is like AddKeyValuePairs, with opts.PerItem
+// the keys the job did not create are reported in a *KvpBatchError
+func (vm *VirtualMachine) AddKeyValuePairsWithOptions(pairs map[string]string, opts *KvpBatchOptions) error {
+	return vm.kvpBatchOperation("AddKvpItems", pairs, "key already exists?", opts, func(current map[string]string, key, value string) bool {
+		v, ok := current[key]
+		return ok && v == value
+	})
+}
+
+// ModifyKeyValuePairs changes all keys with a single ModifyKvpItems job, the
+// job error is returned if it fails
+func (vm *VirtualMachine) ModifyKeyValuePairs(pairs map[string]string) error {
+	return vm.ModifyKeyValuePairsWithOptions(pairs, nil)
+}
+
+// ModifyKeyValuePairsWithOptions is like ModifyKeyValuePairs, with
+// opts.PerItem the keys the job did not change are reported in a
+// *KvpBatchError
+func (vm *VirtualMachine) ModifyKeyValuePairsWithOptions(pairs map[string]string, opts *KvpBatchOptions) error {
+	return vm.kvpBatchOperation("ModifyKvpItems", pairs, "key invalid?", opts, func(current map[string]string, key, value string) bool {
+		v, ok := current[key]
+		return ok && v == value
+	})
+}
+
+// RemoveKeyValuePairs deletes all keys with a single RemoveKvpItems job, the
+// job error is returned if it fails
+func (vm *VirtualMachine) RemoveKeyValuePairs(keys []string) error {
+	return vm.RemoveKeyValuePairsWithOptions(keys, nil)
+}
+
+// RemoveKeyValuePairsWithOptions is like RemoveKeyValuePairs, with
+// opts.PerItem the keys the job did not remove are reported in a
+// *KvpBatchError
+func (vm *VirtualMachine) RemoveKeyValuePairsWithOptions(keys []string, opts *KvpBatchOptions) error {
+	pairs := make(map[string]string, len(keys))
+	for _, key := range keys {
+		pairs[key] = ""
+	}
+	return vm.kvpBatchOperation("RemoveKvpItems", pairs, "key invalid?", opts, func(current map[string]string, key, _ string) bool {
+		_, ok := current[key]
+		return !ok
+	})
+}
+
 func (vm *VirtualMachine) GetKeyValuePairs() (map[string]string, error) {
 	var service *wmiext.Service
 	var err error
@@ -150,10 +319,55 @@ func (vm *VirtualMachine) GetKeyValuePairs() (map[string]string, error) {
 	return parseKvpMapXml(s)
 }
 
+// GetGuestKeyValuePairs returns the items the guest published in its pool
+// for the host.  They are only available while the guest runs a kvp daemon.
+func (vm *VirtualMachine) GetGuestKeyValuePairs() (map[string]string, error) {
+	return vm.getGuestExchangeItems("GuestExchangeItems")
+}
+
+// GetGuestIntrinsicKeyValuePairs returns the items the guest kvp daemon
+// generates itself, such as the OS name and the network addresses
+func (vm *VirtualMachine) GetGuestIntrinsicKeyValuePairs() (map[string]string, error) {
+	return vm.getGuestExchangeItems("GuestIntrinsicExchangeItems")
+}
+
+// GetGuestIntrinsicInfo returns the intrinsic items of the guest as typed
+// values
+func (vm *VirtualMachine) GetGuestIntrinsicInfo() (*GuestIntrinsicInfo, error) {
+	items, err := vm.GetGuestIntrinsicKeyValuePairs()
+	if err != nil {
+		return nil, err
+	}
+	return newGuestIntrinsicInfo(items), nil
+}
+
+func (vm *VirtualMachine) getGuestExchangeItems(property string) (map[string]string, error) {
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return nil, err
+	}
+	defer service.Close()
+
+	i, err := service.FindFirstRelatedInstance(vm.Path(), "Msvm_KvpExchangeComponent")
+	if err != nil {
+		return nil, err
+	}
+	defer i.Close()
+
+	s, err := i.GetAsString(property)
+	if err != nil {
+		return nil, err
+	}
+	if s == "" || s == "<nil>" {
+		// Nothing is reported while the guest is off or has no daemon
+		return map[string]string{}, nil
+	}
+
+	return parseKvpMapXml(s)
+}
+
 func (vm *VirtualMachine) kvpOperation(op string, key string, value string, nowait bool, illegalSuggestion string) error {
 	var service *wmiext.Service
-	var vsms, job *wmiext.Instance
-	var ret int32
 	var err error
 
 	if service, err = NewLocalHyperVService(); err != nil {
@@ -161,20 +375,84 @@ func (vm *VirtualMachine) kvpOperation(op string, key string, value string, nowa
 	}
 	defer service.Close()
 
-	vsms, err = service.GetSingletonInstance(VirtualSystemManagementService)
+	itemStr, err := createKvpItem(service, key, value)
 	if err != nil {
 		return err
 	}
-	defer vsms.Close()
 
-	itemStr, err := createKvpItem(service, key, value)
+	return vm.invokeKvpOperation(service, op, []string{itemStr}, nowait, illegalSuggestion)
+}
+
+// kvpBatchOperation runs op for all pairs in one job and returns its error.
+// The host does not tell which item made the job fail, and earlier items may
+// already be applied, so with opts.PerItem the current items are compared
+// using applied and the remaining keys are retried one at a time to find
+// the failing ones.
+func (vm *VirtualMachine) kvpBatchOperation(op string, pairs map[string]string, illegalSuggestion string, opts *KvpBatchOptions, applied func(current map[string]string, key, value string) bool) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	service, err := NewLocalHyperVService()
 	if err != nil {
 		return err
 	}
+	defer service.Close()
+
+	items := make([]string, 0, len(keys))
+	for _, key := range keys {
+		itemStr, err := createKvpItem(service, key, pairs[key])
+		if err != nil {
+			return err
+		}
+		items = append(items, itemStr)
+	}
+
+	batchErr := vm.invokeKvpOperation(service, op, items, false, illegalSuggestion)
+	if batchErr == nil || opts == nil || !opts.PerItem || len(keys) == 1 {
+		return batchErr
+	}
+
+	current, err := vm.GetKeyValuePairs()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w", op, batchErr)
+	}
+
+	failed := make(map[string]error)
+	for _, key := range keys {
+		if applied(current, key, pairs[key]) {
+			continue
+		}
+		if err := vm.kvpOperation(op, key, pairs[key], false, illegalSuggestion); err != nil {
+			failed[key] = err
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return &KvpBatchError{Operation: op, Errors: failed}
+}
+
+func (vm *VirtualMachine) invokeKvpOperation(service *wmiext.Service, op string, items []string, nowait bool, illegalSuggestion string) error {
+	var vsms, job *wmiext.Instance
+	var ret int32
+	var err error
+
+	vsms, err = service.GetSingletonInstance(VirtualSystemManagementService)
+	if err != nil {
+		return err
+	}
+	defer vsms.Close()
 
 	execution := vsms.BeginInvoke(op).
 		In("TargetSystem", vm.Path()).
-		In("DataItems", []string{itemStr}).
+		In("DataItems", items).
 		Execute().
 		Out("ReturnValue", &ret).
 		Out("Job", &job)
@@ -201,13 +479,19 @@ func (vm *VirtualMachine) kvpOperation(op string, key string, value string, nowa
 }
 
 func waitVMResult(res int32, service *wmiext.Service, job *wmiext.Instance, errorMsg string, translate func(int) error) error {
+	return waitVMResultContext(context.Background(), res, service, job, errorMsg, translate, nil)
+}
+
+// waitVMResultContext is like waitVMResult, it reports the progress of the
+// job, if there is one, to progress and gives up on the job when ctx ends
+func waitVMResultContext(ctx context.Context, res int32, service *wmiext.Service, job *wmiext.Instance, errorMsg string, translate func(int) error, progress func(wmiext.JobProgress)) error {
 	var err error
 
 	switch res {
 	case 0:
 		return nil
 	case 4096:
-		err = wmiext.WaitJob(service, job)
+		err = wmiext.WaitJobContext(ctx, service, job, progress)
 		defer job.Close()
 	default:
 		if translate != nil {
@@ -226,6 +510,24 @@ func waitVMResult(res int32, service *wmiext.Service, job *wmiext.Instance, erro
 	return err
 }
 
+// jobProgress adapts the progress callbacks of an operation's options,
+// percent is only called when the percentage changes
+func jobProgress(percent func(uint16), status func(wmiext.JobProgress)) func(wmiext.JobProgress) {
+	if percent == nil && status == nil {
+		return nil
+	}
+	last := -1
+	return func(p wmiext.JobProgress) {
+		if percent != nil && int(p.PercentComplete) != last {
+			last = int(p.PercentComplete)
+			percent(p.PercentComplete)
+		}
+		if status != nil {
+			status(p)
+		}
+	}
+}
+
 func (vm *VirtualMachine) StopWithForce() error {
 	return vm.stop(true)
 }
@@ -264,16 +566,10 @@ func (vm *VirtualMachine) stop(force bool) error {
 		return translateShutdownError(int(res))
 	}
 
-	// Wait for vm to actually *be* down
-	for i := 0; i < 200; i++ {
-		refreshVM, err := vm.vmm.GetMachine(vm.ElementName)
-		if err != nil {
-			return err
-		}
-		if refreshVM.State() == Disabled {
-			break
-		}
-		time.Sleep(50 * time.Millisecond)
+	// Wait for vm to actually *be* down, a guest taking longer still
+	// shuts down on its own
+	if err := vm.waitForState(Disabled, 10*time.Second); err != nil && !errors.Is(err, ErrMachineStateTimeout) {
+		return err
 	}
 	return nil
 }
@@ -318,6 +614,113 @@ func (vm *VirtualMachine) Start() error {
 	return waitVMResult(res, srv, job, "failed to start vm", nil)
 }
 
+// Pause freezes a running machine in memory
+func (vm *VirtualMachine) Pause() error {
+	switch vm.State() {
+	case Enabled:
+	case Paused:
+		return ErrMachineAlreadyPaused
+	case Disabled, Saved:
+		return ErrMachineNotRunning
+	case Starting:
+		return ErrMachineStarting
+	default:
+		return ErrMachineStateInvalid
+	}
+	return vm.changeState(pause, Paused, "failed to pause vm")
+}
+
+// Resume continues a paused machine or restores a saved one
+func (vm *VirtualMachine) Resume() error {
+	switch vm.State() {
+	case Paused, Saved:
+	case Enabled:
+		return ErrMachineAlreadyRunning
+	case Starting:
+		return ErrMachineStarting
+	default:
+		return ErrMachineNotPaused
+	}
+	return vm.changeState(start, Enabled, "failed to resume vm")
+}
+
+// Save writes the memory of a running or paused machine to disk and stops
+// it, Resume or Start restore it
+func (vm *VirtualMachine) Save() error {
+	switch vm.State() {
+	case Enabled, Paused:
+	case Saved:
+		return ErrMachineAlreadySaved
+	case Disabled:
+		return ErrMachineNotRunning
+	case Starting:
+		return ErrMachineStarting
+	default:
+		return ErrMachineStateInvalid
+	}
+	return vm.changeState(save, Saved, "failed to save vm")
+}
+
+// Reset restarts a running machine without shutting the guest down
+func (vm *VirtualMachine) Reset() error {
+	switch vm.State() {
+	case Enabled:
+	case Disabled, Saved:
+		return ErrMachineNotRunning
+	case Starting:
+		return ErrMachineStarting
+	default:
+		return ErrMachineStateInvalid
+	}
+	return vm.changeState(reset, Enabled, "failed to reset vm")
+}
+
+// TurnOff powers the machine off immediately, like pulling the plug.  A
+// saved machine loses its saved state.
+func (vm *VirtualMachine) TurnOff() error {
+	if vm.State() == Disabled {
+		return ErrMachineNotRunning
+	}
+	return vm.changeState(turnOff, Disabled, "failed to turn off vm")
+}
+
+// changeState requests a state change and waits until the machine reports
+// the target state
+func (vm *VirtualMachine) changeState(state vmState, target EnabledState, errorMsg string) error {
+	var (
+		job *wmiext.Instance
+		res int32
+	)
+
+	srv, err := NewLocalHyperVService()
+	if err != nil {
+		return err
+	}
+	defer srv.Close()
+
+	instance, err := srv.GetObject(vm.Path())
+	if err != nil {
+		return err
+	}
+	defer instance.Close()
+
+	if err := instance.BeginInvoke("RequestStateChange").
+		In("RequestedState", uint16(state)).
+		In("TimeoutPeriod", &time.Time{}).
+		Execute().
+		Out("Job", &job).
+		Out("ReturnValue", &res).End(); err != nil {
+		return err
+	}
+	if err := waitVMResult(res, srv, job, errorMsg, nil); err != nil {
+		return err
+	}
+	return vm.waitForState(target, stateChangeTimeout)
+}
+
+// stateChangeTimeout bounds how long a requested state change may take
+const stateChangeTimeout = time.Minute
+
 func getService(_ *wmiext.Service) (*wmiext.Service, error) {
 	// any reason why when we instantiate a vm, we should NOT just embed a service?
 	return NewLocalHyperVService()
@@ -399,7 +802,11 @@ func (vm *VirtualMachine) GetSummaryInformation(requestedFields SummaryRequestSe
 // NewVirtualMachine creates a new vm in hyperv
 // decided to not return a *VirtualMachine here because of how Podman is
 // likely to use this.  this could be easily added if desirable
-func (vmm *VirtualMachineManager) NewVirtualMachine(name string, config *HardwareConfig) error {
+//
+// Creation is all or nothing: when a step fails, the resources and the
+// system created so far are removed again.  If that cleanup fails too, the
+// error is a *RollbackError.
+func (vmm *VirtualMachineManager) NewVirtualMachine(name string, config *HardwareConfig) (err error) {
 	exists, err := vmm.Exists(name)
 	if err != nil {
 		return err
@@ -409,9 +816,33 @@ func (vmm *VirtualMachineManager) NewVirtualMachine(name string, config *Hardwar
 	}
 
 	// TODO I gotta believe there are naming restrictions for vms in hyperv?
-	// TODO If something fails during creation, do we rip things down or follow precedent from other machines?  user deletes things
 
-	systemSettings, err := NewSystemSettingsBuilder().
+	var undo rollback
+	defer func() {
+		if err != nil {
+			err = undo.run(err)
+		}
+	}()
+
+	dvdDiskPath := config.DVDDiskPath
+	if config.CloudInit != nil {
+		if dvdDiskPath != "" {
+			return errors.New("a cloud-init image cannot be combined with a DVD disk")
+		}
+		dvdDiskPath = CloudInitISOPath(name, config.DiskPath)
+		// The image is created exclusively, so the rollback only ever
+		// removes a file this call wrote
+		if err := config.CloudInit.CreateISO(dvdDiskPath); err != nil {
+			return err
+		}
+		undo.add("remove cloud-init image", func() error {
+			return os.Remove(dvdDiskPath)
+		})
+	}
+
+	systemSettingsBuilder := NewSystemSettingsBuilder()
+	systemSettingsBuilder.rollback = &undo
+	systemSettings, err := systemSettingsBuilder.
 		PrepareSystemSettings(name, nil).
 		PrepareMemorySettings(func(ms *MemorySettings) {
 			//ms.DynamicMemoryEnabled = false
@@ -431,6 +862,18 @@ func (vmm *VirtualMachineManager) NewVirtualMachine(name string, config *Hardwar
 		return err
 	}
 
+	if len(config.IntegrationServices) > 0 {
+		service, err := NewLocalHyperVService()
+		if err != nil {
+			return err
+		}
+		err = setIntegrationServices(service, systemSettings.Path(), config.IntegrationServices)
+		service.Close()
+		if err != nil {
+			return err
+		}
+	}
+
 	builder := NewDriveSettingsBuilder(systemSettings).
 		AddScsiController().
 		AddSyntheticDiskDrive(0).
@@ -441,12 +884,12 @@ func (vmm *VirtualMachineManager) NewVirtualMachine(name string, config *Hardwar
 		Finish(). // disk
 		Finish()  // drive
 
-	if config.DVDDiskPath != "" {
+	if dvdDiskPath != "" {
 		// Add a DVD drive if the DVDDiskPath is set
 		// This is useful for cloud-init or other bootable media
 		builder = builder.
 			AddSyntheticDvdDrive(1).
-			DefineVirtualDvdDisk(config.DVDDiskPath).
+			DefineVirtualDvdDisk(dvdDiskPath).
 			Finish(). // disk
 			Finish()  // drive
 	}
@@ -471,6 +914,12 @@ func (vmm *VirtualMachineManager) NewVirtualMachine(name string, config *Hardwar
 	return nil
 }
 
+// CloudInitISOPath returns where NewVirtualMachine creates the cloud-init
+// image of a machine with the given disk
+func CloudInitISOPath(name, diskPath string) string {
+	return filepath.Join(filepath.Dir(diskPath), name+"-cidata.iso")
+}
+
 func (vm *VirtualMachine) fetchSystemSettingsInstance(service *wmiext.Service) (*wmiext.Instance, error) {
 	// When a settings snapshot is taken there are multiple associations, use only the realized/active version
 	return service.FindFirstRelatedInstanceThrough(vm.Path(), "Msvm_VirtualSystemSettingData", "Msvm_SettingsDefineState")
@@ -617,6 +1066,14 @@ func (vm *VirtualMachine) remove() (int32, error) {
 }
 
 func (vm *VirtualMachine) Remove(diskPath string) error {
+	var cloudInitISO string
+	if len(diskPath) > 0 {
+		var err error
+		if cloudInitISO, err = vm.cloudInitISO(diskPath); err != nil {
+			return err
+		}
+	}
+
 	if _, err := vm.remove(); err != nil {
 		return err
 	}
@@ -626,10 +1083,38 @@ func (vm *VirtualMachine) Remove(diskPath string) error {
 		if err := os.Remove(diskPath); err != nil {
 			return err
 		}
+		// Along with a cloud-init image NewVirtualMachine generated
+		if cloudInitISO != "" {
+			if err := os.Remove(cloudInitISO); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
+// cloudInitISO returns the cloud-init image NewVirtualMachine generated for
+// the machine, or "" when no DVD drive of the machine holds it
+func (vm *VirtualMachine) cloudInitISO(diskPath string) (string, error) {
+	service, err := NewLocalHyperVService()
+	if err != nil {
+		return "", err
+	}
+	defer service.Close()
+
+	images, err := vm.storagePaths(service, VirtualDvdDiskType)
+	if err != nil {
+		return "", err
+	}
+	generated := CloudInitISOPath(vm.ElementName, diskPath)
+	for _, image := range images {
+		if strings.EqualFold(filepath.Clean(image), filepath.Clean(generated)) {
+			return image, nil
+		}
+	}
+	return "", nil
+}
+
 func (vm *VirtualMachine) State() EnabledState {
 	return EnabledState(vm.EnabledState)
 }
@@ -4,21 +4,24 @@ package hypervctl
 
 import (
 	"time"
+
+	"github.com/containers/libhvee/pkg/nocloud"
 )
 
+// vmState is a state requested with Msvm_ComputerSystem.RequestStateChange
 type vmState uint16
 
 const (
 	// Changes the state to 'Running'.
 	start vmState = 2
-	// Stops the job temporarily. The intention is to subsequently restart the job with 'Start'. It might be possible to
-	// enter the 'Service' state while suspended. (This is job-specific.)
-	suspend vmState = 3 //nolint: unused
-	// Stops the job cleanly, saves data, preserves the state, and shuts down all underlying processes'
-	// in an orderly manner.
-	terminate vmState = 4 //nolint: unused
-	//Terminates the job immediately with no requirement to save data or preserve the state.
-	kill vmState = 5 //nolint: unused
+	// Turns the machine off without notifying the guest.
+	turnOff vmState = 3
+	// Saves the memory of the machine to disk and stops it, 'Running' restores it.
+	save vmState = 6
+	// Freezes the machine in memory, 'Running' resumes it.
+	pause vmState = 9
+	// Resets the machine like pressing the reset button.
+	reset vmState = 11
 )
 
 type EnabledState uint16
@@ -49,6 +52,13 @@ const (
 	Starting EnabledState = 10
 )
 
+// Hyper-V reports a paused machine as quiesced and a saved one as enabled
+// but offline
+const (
+	Paused = Quiesce
+	Saved  = EnabledButOffline
+)
+
 func (es EnabledState) String() string {
 	switch es {
 	case Unknown:
@@ -103,6 +113,13 @@ type HardwareConfig struct {
 	// DVDDiskPath is the path to the disk image
 	// that will be used as a DVD drive in the VM (e.g. for cloud-init)
 	DVDDiskPath string
+	// CloudInit generates a NoCloud seed image named <name>-cidata.iso
+	// next to DiskPath and attaches it as the DVD drive, it cannot be
+	// combined with DVDDiskPath.  Creation fails if that file exists.
+	CloudInit *nocloud.Config
+	// IntegrationServices enables (true) or disables (false) integration
+	// services, those not listed keep the Hyper-V defaults
+	IntegrationServices map[IntegrationService]bool
 }
 
 type Statuses struct {
@@ -162,6 +162,29 @@ func (*VirtualMachineManager) CreateVhdxFile(path string, maxSize uint64) error
 	settings.Type = 3
 	settings.Path = path
 
+	return createVirtualHardDisk(service, settings)
+}
+
+// CreateDifferencingVhdxFile creates a vhdx at path recording only the
+// changes made on top of parentPath, which must not be modified afterwards
+func (*VirtualMachineManager) CreateDifferencingVhdxFile(path string, parentPath string) error {
+	var service *wmiext.Service
+	var err error
+	if service, err = NewLocalHyperVService(); err != nil {
+		return err
+	}
+	defer service.Close()
+
+	settings := &VirtualHardDiskSettings{}
+	settings.Format = 3
+	settings.Type = 4
+	settings.Path = path
+	settings.ParentPath = parentPath
+
+	return createVirtualHardDisk(service, settings)
+}
+
+func createVirtualHardDisk(service *wmiext.Service, settings *VirtualHardDiskSettings) error {
 	instance, err := service.CreateInstance("Msvm_VirtualHardDiskSettingData", settings)
 	if err != nil {
 		return err
@@ -169,7 +192,7 @@ func (*VirtualMachineManager) CreateVhdxFile(path string, maxSize uint64) error
 	defer instance.Close()
 	settingsStr := instance.GetCimText()
 
-	imms, err := service.GetSingletonInstance("Msvm_ImageManagementService")
+	imms, err := service.GetSingletonInstance(ImageManagementService)
 	if err != nil {
 		return err
 	}
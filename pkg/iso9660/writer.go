@@ -0,0 +1,660 @@
+// Package iso9660 writes ISO 9660 images with Joliet and Rock Ridge names,
+// so files keep their names on both Windows and Linux.
+package iso9660
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+const (
+	SectorSize = 2048
+
+	// MaxNameLength is the longest name Joliet can record
+	MaxNameLength = 64
+
+	systemAreaSectors = 16
+	// isoNameLength is the longest primary name, with room for ";1"
+	isoNameLength = 30
+	dirRecordSize = 33
+	// maxRecordSize is the longest directory record, its length is a
+	// byte and has to be even
+	maxRecordSize = 254
+
+	// Rock Ridge NM entries, ceEntrySize is the size of a CE entry
+	nmHeaderSize = 5
+	nmContinue   = 1
+	ceEntrySize  = 28
+
+	// Rock Ridge file modes
+	modeDir  = 0o40555
+	modeFile = 0o100444
+)
+
+const (
+	descriptorPrimary       = 1
+	descriptorSupplementary = 2
+	descriptorTerminator    = 255
+
+	flagDirectory = 1 << 1
+)
+
+var (
+	// ErrInvalidPath means a file path is empty, absolute, escapes the
+	// image or has a component longer than MaxNameLength
+	ErrInvalidPath = errors.New("invalid iso9660 path")
+	// ErrExists means a path was added twice, or a file was added where
+	// a directory is needed
+	ErrExists = errors.New("path already in image")
+)
+
+// Options describe the volume
+type Options struct {
+	// VolumeID is the label of the volume, up to 16 characters
+	VolumeID string
+	// ModTime is recorded for the volume and every file, the time of
+	// WriteTo by default
+	ModTime time.Time
+}
+
+// Writer collects files and writes them as an ISO 9660 image
+type Writer struct {
+	opts Options
+	root *node
+}
+
+type node struct {
+	name     string
+	parent   *node
+	children []*node
+	dir      bool
+	data     []byte
+
+	// Set by layout
+	isoName    string
+	jolietName string
+	extent     uint32
+	size       uint32
+	jolietExt  uint32
+	jolietSize uint32
+	number     uint16
+	jolietNum  uint16
+
+	// Rock Ridge name entries of the primary record, and those continued
+	// in the continuation area when the name does not fit in the record
+	rrName     []byte
+	rrContinue []byte
+	ceSector   uint32
+	ceOffset   uint32
+}
+
+// NewWriter returns a writer for an empty volume
+func NewWriter(opts Options) *Writer {
+	return &Writer{opts: opts, root: &node{dir: true}}
+}
+
+// AddFile adds a file, p uses / as separator and missing directories are
+// created
+func (w *Writer) AddFile(p string, data []byte) error {
+	clean := path.Clean(p)
+	if p == "" || path.IsAbs(p) || clean == "." || strings.HasPrefix(clean, "../") || clean == ".." {
+		return fmt.Errorf("%q: %w", p, ErrInvalidPath)
+	}
+	parts := strings.Split(clean, "/")
+	for _, part := range parts {
+		if len(utf16.Encode([]rune(part))) > MaxNameLength {
+			return fmt.Errorf("%q: name longer than %d: %w", p, MaxNameLength, ErrInvalidPath)
+		}
+	}
+
+	dir := w.root
+	for _, part := range parts[:len(parts)-1] {
+		child := dir.child(part)
+		if child == nil {
+			child = &node{name: part, parent: dir, dir: true}
+			dir.children = append(dir.children, child)
+		} else if !child.dir {
+			return fmt.Errorf("%q: %w", p, ErrExists)
+		}
+		dir = child
+	}
+	name := parts[len(parts)-1]
+	if dir.child(name) != nil {
+		return fmt.Errorf("%q: %w", p, ErrExists)
+	}
+	dir.children = append(dir.children, &node{name: name, parent: dir, data: data})
+	return nil
+}
+
+func (n *node) child(name string) *node {
+	for _, c := range n.children {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// WriteTo writes the image
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	opts := w.opts
+	if opts.ModTime.IsZero() {
+		opts.ModTime = time.Now()
+	}
+	opts.ModTime = opts.ModTime.UTC()
+
+	l := newLayout(w.root, opts)
+	img := l.build()
+	n, err := out.Write(img)
+	return int64(n), err
+}
+
+// layout places every structure of the image
+type layout struct {
+	opts        Options
+	root        *node
+	dirs        []*node
+	jolietDirs  []*node
+	pathTable   [2][]byte
+	jolietTable [2][]byte
+	// Sectors of the path tables, L then M, primary then Joliet
+	tableSectors [4]uint32
+	ceSector     uint32
+	sectors      uint32
+}
+
+func newLayout(root *node, opts Options) *layout {
+	l := &layout{opts: opts, root: root}
+	assignNames(root)
+	walk(root, func(n *node) {
+		if n != root {
+			splitName(n)
+		}
+	})
+	l.dirs = directories(root, func(n *node) string { return n.isoName })
+	l.jolietDirs = directories(root, func(n *node) string { return n.jolietName })
+	for i, d := range l.dirs {
+		d.number = uint16(i + 1)
+	}
+	for i, d := range l.jolietDirs {
+		d.jolietNum = uint16(i + 1)
+	}
+
+	// Path tables need the directory extents, but only their length
+	// matters for the placement
+	tableSize := uint32(len(l.pathTableFor(false, binary.LittleEndian)))
+	jolietTableSize := uint32(len(l.pathTableFor(true, binary.LittleEndian)))
+	next := uint32(systemAreaSectors + 3)
+	for i := range l.tableSectors {
+		l.tableSectors[i] = next
+		size := tableSize
+		if i >= 2 {
+			size = jolietTableSize
+		}
+		next += sectors(size)
+	}
+	for _, d := range l.dirs {
+		d.extent = next
+		d.size = l.dirSize(d, false)
+		next += sectors(d.size)
+	}
+	// Streaming readers such as libarchive only follow continuations
+	// forward, so the extension reference and the continued names come
+	// after the directories.  A continuation area does not cross sectors.
+	l.ceSector = next
+	pos := uint32(len(extensionReference()))
+	walk(root, func(n *node) {
+		size := uint32(len(n.rrContinue))
+		if size == 0 {
+			return
+		}
+		if pos%SectorSize+size > SectorSize {
+			pos = sectors(pos) * SectorSize
+		}
+		n.ceSector, n.ceOffset = l.ceSector+pos/SectorSize, pos%SectorSize
+		pos += size
+	})
+	next += sectors(pos)
+	for _, d := range l.jolietDirs {
+		d.jolietExt = next
+		d.jolietSize = l.dirSize(d, true)
+		next += sectors(d.jolietSize)
+	}
+	walk(root, func(n *node) {
+		if n.dir {
+			return
+		}
+		n.size = uint32(len(n.data))
+		if n.size > 0 {
+			n.extent = next
+			next += sectors(n.size)
+		}
+	})
+	l.sectors = next
+
+	l.pathTable = [2][]byte{l.pathTableFor(false, binary.LittleEndian), l.pathTableFor(false, binary.BigEndian)}
+	l.jolietTable = [2][]byte{l.pathTableFor(true, binary.LittleEndian), l.pathTableFor(true, binary.BigEndian)}
+	return l
+}
+
+func (l *layout) build() []byte {
+	img := make([]byte, int(l.sectors)*SectorSize)
+	sector := func(s uint32) []byte { return img[int(s)*SectorSize:] }
+
+	l.volumeDescriptor(sector(systemAreaSectors), false)
+	l.volumeDescriptor(sector(systemAreaSectors+1), true)
+	term := sector(systemAreaSectors + 2)
+	term[0] = descriptorTerminator
+	copy(term[1:], "CD001")
+	term[6] = 1
+
+	copy(sector(l.tableSectors[0]), l.pathTable[0])
+	copy(sector(l.tableSectors[1]), l.pathTable[1])
+	copy(sector(l.tableSectors[2]), l.jolietTable[0])
+	copy(sector(l.tableSectors[3]), l.jolietTable[1])
+	copy(sector(l.ceSector), extensionReference())
+	walk(l.root, func(n *node) {
+		if n.rrContinue != nil {
+			copy(sector(n.ceSector)[n.ceOffset:], n.rrContinue)
+		}
+	})
+
+	for _, d := range l.dirs {
+		copy(sector(d.extent), l.dirContent(d, false))
+	}
+	for _, d := range l.jolietDirs {
+		copy(sector(d.jolietExt), l.dirContent(d, true))
+	}
+	walk(l.root, func(n *node) {
+		if !n.dir && n.size > 0 {
+			copy(sector(n.extent), n.data)
+		}
+	})
+	return img
+}
+
+func (l *layout) volumeDescriptor(b []byte, joliet bool) {
+	b[0] = descriptorPrimary
+	if joliet {
+		b[0] = descriptorSupplementary
+	}
+	copy(b[1:], "CD001")
+	b[6] = 1
+
+	putString(b[8:40], "", joliet)
+	putString(b[40:72], l.opts.VolumeID, joliet)
+	putBoth32(b[80:], l.sectors)
+	if joliet {
+		// UCS-2 level 3
+		copy(b[88:], "%/E")
+	}
+	putBoth16(b[120:], 1)
+	putBoth16(b[124:], 1)
+	putBoth16(b[128:], SectorSize)
+
+	tables, first, root := l.pathTable, l.tableSectors[0:2], l.dirRecord(l.root, "\x00", false, nil)
+	if joliet {
+		tables, first, root = l.jolietTable, l.tableSectors[2:4], l.dirRecord(l.root, "\x00", true, nil)
+	}
+	putBoth32(b[132:], uint32(len(tables[0])))
+	binary.LittleEndian.PutUint32(b[140:], first[0])
+	binary.BigEndian.PutUint32(b[148:], first[1])
+	copy(b[156:190], root)
+
+	for _, f := range [][]byte{b[190:318], b[318:446], b[446:574], b[574:702], b[702:739], b[739:776], b[776:813]} {
+		putString(f, "", joliet)
+	}
+	putString(b[574:702], "LIBHVEE", joliet)
+	stamp := volumeTime(l.opts.ModTime)
+	copy(b[813:], stamp)
+	copy(b[830:], stamp)
+	copy(b[847:], volumeTime(time.Time{}))
+	copy(b[864:], stamp)
+	b[881] = 1
+}
+
+// dirSize is the length of the extent of a directory
+func (l *layout) dirSize(d *node, joliet bool) uint32 {
+	return uint32(len(l.dirContent(d, joliet)))
+}
+
+// dirContent returns the records of a directory, a record never crosses a
+// sector
+func (l *layout) dirContent(d *node, joliet bool) []byte {
+	var records [][]byte
+	dotUse := rockRidgeAttrs(d)
+	if d == l.root {
+		ce := continuation(l.ceSector, 0, uint32(len(extensionReference())))
+		dotUse = append(append(sharingProtocol(), ce...), dotUse...)
+	}
+	parent := d.parent
+	if parent == nil {
+		parent = d
+	}
+	records = append(records,
+		l.dirRecord(d, "\x00", joliet, dotUse),
+		l.dirRecord(parent, "\x01", joliet, rockRidgeAttrs(parent)))
+	for _, c := range sortedChildren(d, joliet) {
+		var use []byte
+		if !joliet {
+			use = append(rockRidgeAttrs(c), c.rrName...)
+			if c.rrContinue != nil {
+				use = append(use, continuation(c.ceSector, c.ceOffset, uint32(len(c.rrContinue)))...)
+			}
+		}
+		records = append(records, l.dirRecord(c, "", joliet, use))
+	}
+
+	var buf []byte
+	for _, r := range records {
+		if used := len(buf) % SectorSize; used+len(r) > SectorSize {
+			buf = append(buf, make([]byte, SectorSize-used)...)
+		}
+		buf = append(buf, r...)
+	}
+	if rest := len(buf) % SectorSize; rest != 0 {
+		buf = append(buf, make([]byte, SectorSize-rest)...)
+	}
+	return buf
+}
+
+// dirRecord encodes the record of n, id overrides the name for the "."
+// and ".." records.  Without Rock Ridge the system use area stays empty.
+func (l *layout) dirRecord(n *node, id string, joliet bool, systemUse []byte) []byte {
+	var ident []byte
+	switch {
+	case id != "":
+		ident = []byte(id)
+	case joliet:
+		ident = encodeUCS2(n.jolietName)
+	default:
+		ident = []byte(n.isoName)
+	}
+	if joliet {
+		systemUse = nil
+	}
+
+	length := recordLength(len(ident))
+	if len(systemUse)%2 != 0 {
+		systemUse = append(systemUse, 0)
+	}
+	r := make([]byte, length, length+len(systemUse))
+	r[0] = byte(length + len(systemUse))
+
+	extent, size := n.extent, n.size
+	if joliet && n.dir {
+		extent, size = n.jolietExt, n.jolietSize
+	}
+	putBoth32(r[2:], extent)
+	putBoth32(r[10:], size)
+	copy(r[18:25], recordTime(l.opts.ModTime))
+	if n.dir {
+		r[25] = flagDirectory
+	}
+	putBoth16(r[28:], 1)
+	r[32] = byte(len(ident))
+	copy(r[33:], ident)
+	return append(r, systemUse...)
+}
+
+// pathTableFor encodes the path table of one tree
+func (l *layout) pathTableFor(joliet bool, order binary.ByteOrder) []byte {
+	dirs := l.dirs
+	if joliet {
+		dirs = l.jolietDirs
+	}
+	var buf []byte
+	for _, d := range dirs {
+		ident := []byte{0}
+		extent, parent := d.extent, uint16(1)
+		switch {
+		case d == l.root:
+		case joliet:
+			ident, parent = encodeUCS2(d.jolietName), d.parent.jolietNum
+		default:
+			ident, parent = []byte(d.isoName), d.parent.number
+		}
+		if joliet {
+			extent = d.jolietExt
+		}
+		e := make([]byte, 8, 9+len(ident))
+		e[0] = byte(len(ident))
+		order.PutUint32(e[2:], extent)
+		order.PutUint16(e[6:], parent)
+		e = append(e, ident...)
+		if len(ident)%2 != 0 {
+			e = append(e, 0)
+		}
+		buf = append(buf, e...)
+	}
+	return buf
+}
+
+// recordLength is the length of a directory record without its system use
+// area, the identifier is padded to an even length
+func recordLength(identLen int) int {
+	length := dirRecordSize + identLen
+	if identLen%2 == 0 {
+		length++
+	}
+	return length
+}
+
+// continuation points a record to system use entries that do not fit in it
+func continuation(sector, offset, length uint32) []byte {
+	ce := []byte{'C', 'E', ceEntrySize, 1}
+	ce = append(ce, make([]byte, ceEntrySize-4)...)
+	putBoth32(ce[4:], sector)
+	putBoth32(ce[12:], offset)
+	putBoth32(ce[20:], length)
+	return ce
+}
+
+// sharingProtocol marks the image as using SUSP
+func sharingProtocol() []byte {
+	return []byte{'S', 'P', 7, 1, 0xbe, 0xef, 0}
+}
+
+// extensionReference identifies the Rock Ridge extension
+func extensionReference() []byte {
+	const (
+		id     = "RRIP_1991A"
+		desc   = "THE ROCK RIDGE INTERCHANGE PROTOCOL PROVIDES SUPPORT FOR POSIX FILE SYSTEM SEMANTICS"
+		source = "PLEASE CONTACT DISC PUBLISHER FOR SPECIFICATION SOURCE.  SEE PUBLISHER IDENTIFIER IN PRIMARY VOLUME DESCRIPTOR FOR CONTACT INFORMATION."
+	)
+	er := []byte{'E', 'R', byte(8 + len(id) + len(desc) + len(source)), 1, byte(len(id)), byte(len(desc)), byte(len(source)), 1}
+	er = append(er, id...)
+	er = append(er, desc...)
+	return append(er, source...)
+}
+
+func rockRidgeAttrs(n *node) []byte {
+	mode, links := uint32(modeFile), uint32(1)
+	if n.dir {
+		mode, links = modeDir, 2
+		for _, c := range n.children {
+			if c.dir {
+				links++
+			}
+		}
+	}
+	px := []byte{'P', 'X', 36, 1}
+	px = append(px, make([]byte, 32)...)
+	putBoth32(px[4:], mode)
+	putBoth32(px[12:], links)
+	return px
+}
+
+func rockRidgeName(name string, flags byte) []byte {
+	return append([]byte{'N', 'M', byte(nmHeaderSize + len(name)), 1, flags}, name...)
+}
+
+// splitName sets the Rock Ridge name entries of n.  A long UTF-8 name
+// does not fit in the record next to the other entries, the rest of it
+// continues in the continuation area.
+func splitName(n *node) {
+	avail := maxRecordSize - recordLength(len(n.isoName)) - len(rockRidgeAttrs(n))
+	if nm := rockRidgeName(n.name, 0); len(nm) <= avail {
+		n.rrName = nm
+		return
+	}
+	cut := avail - ceEntrySize - nmHeaderSize
+	for cut > 0 && !utf8.RuneStart(n.name[cut]) {
+		cut--
+	}
+	n.rrName = rockRidgeName(n.name[:cut], nmContinue)
+	n.rrContinue = rockRidgeName(n.name[cut:], 0)
+}
+
+// assignNames gives every child a unique primary and Joliet name
+func assignNames(dir *node) {
+	used := make(map[string]bool)
+	for _, c := range dir.children {
+		c.jolietName = c.name
+		if !c.dir {
+			c.jolietName += ";1"
+		}
+
+		base := isoName(c.name, c.dir)
+		name := base
+		for i := 1; used[name]; i++ {
+			suffix := fmt.Sprintf("_%d", i)
+			stem, ext, _ := strings.Cut(base, ".")
+			name = stem[:min(len(stem), isoNameLength-len(suffix)-len(ext)-1)] + suffix
+			if ext != "" || !c.dir {
+				name += "." + ext
+			}
+		}
+		used[name] = true
+		c.isoName = name
+		if !c.dir {
+			c.isoName += ";1"
+		}
+		if c.dir {
+			assignNames(c)
+		}
+	}
+}
+
+// isoName maps a name to the d-characters of ISO 9660, files keep one dot
+// before their extension
+func isoName(name string, dir bool) string {
+	mapChars := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z':
+				return r - 'a' + 'A'
+			case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+				return r
+			}
+			return '_'
+		}, s)
+	}
+	if dir {
+		mapped := mapChars(name)
+		return mapped[:min(len(mapped), isoNameLength)]
+	}
+	stem, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		stem, ext = name[:i], name[i+1:]
+	}
+	stem, ext = mapChars(stem), mapChars(ext)
+	ext = ext[:min(len(ext), 3)]
+	stem = stem[:min(len(stem), isoNameLength-len(ext)-1)]
+	return stem + "." + ext
+}
+
+// directories lists the directories in path table order: by level, then
+// by parent, then by name
+func directories(root *node, name func(*node) string) []*node {
+	dirs := []*node{root}
+	for i := 0; i < len(dirs); i++ {
+		var sub []*node
+		for _, c := range dirs[i].children {
+			if c.dir {
+				sub = append(sub, c)
+			}
+		}
+		sort.Slice(sub, func(a, b int) bool { return name(sub[a]) < name(sub[b]) })
+		dirs = append(dirs, sub...)
+	}
+	return dirs
+}
+
+func sortedChildren(d *node, joliet bool) []*node {
+	children := append([]*node(nil), d.children...)
+	sort.Slice(children, func(a, b int) bool {
+		if joliet {
+			return children[a].jolietName < children[b].jolietName
+		}
+		return children[a].isoName < children[b].isoName
+	})
+	return children
+}
+
+func walk(n *node, fn func(*node)) {
+	fn(n)
+	for _, c := range n.children {
+		walk(c, fn)
+	}
+}
+
+func sectors(size uint32) uint32 {
+	return (size + SectorSize - 1) / SectorSize
+}
+
+func putBoth16(b []byte, v uint16) {
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+}
+
+func putBoth32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+}
+
+// putString fills a descriptor field padded with spaces, in UCS-2 for
+// Joliet
+func putString(b []byte, s string, joliet bool) {
+	if joliet {
+		for i := 0; i+1 < len(b); i += 2 {
+			b[i], b[i+1] = 0, ' '
+		}
+		copy(b, encodeUCS2(s))
+		return
+	}
+	for i := range b {
+		b[i] = ' '
+	}
+	copy(b, s)
+}
+
+func encodeUCS2(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = binary.BigEndian.AppendUint16(b, c)
+	}
+	return b
+}
+
+// recordTime encodes the 7 byte time of directory records
+func recordTime(t time.Time) []byte {
+	return []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0}
+}
+
+// volumeTime encodes the 17 byte time of volume descriptors, the zero
+// time means not specified
+func volumeTime(t time.Time) []byte {
+	if t.IsZero() {
+		return append([]byte("0000000000000000"), 0)
+	}
+	return append([]byte(t.Format("20060102150405")+fmt.Sprintf("%02d", t.Nanosecond()/1e7)), 0)
+}
@@ -0,0 +1,412 @@
+package iso9660
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// entry is a file or directory read back from an image
+type entry struct {
+	name   string
+	dir    bool
+	extent uint32
+	size   uint32
+	// Rock Ridge fields, primary tree only
+	rrName string
+	mode   uint32
+}
+
+// image reads back what the writer produced
+type image struct {
+	t    *testing.T
+	data []byte
+}
+
+func (img *image) sector(s uint32) []byte {
+	return img.data[int(s)*SectorSize:]
+}
+
+// descriptor returns the volume descriptor of the given type
+func (img *image) descriptor(typ byte) []byte {
+	img.t.Helper()
+	for s := uint32(systemAreaSectors); int(s+1)*SectorSize <= len(img.data); s++ {
+		d := img.sector(s)[:SectorSize]
+		if string(d[1:6]) != "CD001" {
+			img.t.Fatalf("sector %d is not a volume descriptor", s)
+		}
+		if d[0] == typ {
+			return d
+		}
+		if d[0] == descriptorTerminator {
+			break
+		}
+	}
+	img.t.Fatalf("no volume descriptor of type %d", typ)
+	return nil
+}
+
+// readDir lists a directory extent, without "." and ".."
+func (img *image) readDir(extent, size uint32, joliet bool) []entry {
+	img.t.Helper()
+	var entries []entry
+	data := img.sector(extent)[:size]
+	for off := 0; off < len(data); {
+		length := int(data[off])
+		if length == 0 {
+			// Records do not cross sectors
+			off = (off/SectorSize + 1) * SectorSize
+			continue
+		}
+		r := data[off : off+length]
+		off += length
+
+		idLen := int(r[32])
+		id := r[33 : 33+idLen]
+		if idLen == 1 && (id[0] == 0 || id[0] == 1) {
+			continue
+		}
+		e := entry{
+			dir:    r[25]&flagDirectory != 0,
+			extent: checkBoth32(img.t, r[2:]),
+			size:   checkBoth32(img.t, r[10:]),
+		}
+		if joliet {
+			e.name = decodeUCS2(id)
+		} else {
+			e.name = string(id)
+			use := r[33+idLen+(idLen+1)%2:]
+			e.rrName, e.mode = img.rockRidge(use)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// rockRidge extracts the name and mode of a system use area, following
+// continuation entries
+func (img *image) rockRidge(use []byte) (string, uint32) {
+	img.t.Helper()
+	var name string
+	var mode uint32
+	for len(use) >= 4 {
+		l := int(use[2])
+		if l < 4 || l > len(use) {
+			img.t.Fatalf("system use entry of %d bytes", l)
+		}
+		switch string(use[:2]) {
+		case "NM":
+			name += string(use[5:l])
+		case "PX":
+			mode = checkBoth32(img.t, use[4:])
+		case "CE":
+			ce := img.sector(checkBoth32(img.t, use[4:]))[checkBoth32(img.t, use[12:]):][:checkBoth32(img.t, use[20:])]
+			// The root continues to the extension reference
+			if string(ce[:2]) != "ER" {
+				more, _ := img.rockRidge(ce)
+				name += more
+			}
+		}
+		use = use[l:]
+	}
+	return name, mode
+}
+
+// files walks a tree and returns the content of every file by path
+func (img *image) files(root []byte, joliet bool) map[string]string {
+	img.t.Helper()
+	files := make(map[string]string)
+	var walk func(prefix string, extent, size uint32)
+	walk = func(prefix string, extent, size uint32) {
+		for _, e := range img.readDir(extent, size, joliet) {
+			name := e.name
+			switch {
+			case !joliet:
+				if e.rrName == "" {
+					img.t.Errorf("%s%s has no Rock Ridge name", prefix, e.name)
+				}
+				name = e.rrName
+				want := uint32(modeFile)
+				if e.dir {
+					want = modeDir
+				}
+				if e.mode != want {
+					img.t.Errorf("%s%s has mode %o", prefix, name, e.mode)
+				}
+			case !e.dir:
+				name = strings.TrimSuffix(name, ";1")
+			}
+			if e.dir {
+				walk(prefix+name+"/", e.extent, e.size)
+				continue
+			}
+			files[prefix+name] = string(img.sector(e.extent)[:e.size])
+		}
+	}
+	walk("", checkBoth32(img.t, root[2:]), checkBoth32(img.t, root[10:]))
+	return files
+}
+
+func checkBoth32(t *testing.T, b []byte) uint32 {
+	t.Helper()
+	le, be := binary.LittleEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+	if le != be {
+		t.Errorf("both-endian value %d/%d", le, be)
+	}
+	return le
+}
+
+func decodeUCS2(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+func writeImage(t *testing.T, w *Writer) *image {
+	t.Helper()
+	var buf bytes.Buffer
+	n, err := w.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) || n%SectorSize != 0 {
+		t.Fatalf("wrote %d of %d bytes", n, buf.Len())
+	}
+	return &image{t: t, data: buf.Bytes()}
+}
+
+func TestWriter(t *testing.T) {
+	files := map[string]string{
+		"user-data":                         "#cloud-config\n",
+		"meta-data":                         "instance-id: test\n",
+		"empty":                             "",
+		"scripts/first-boot.sh":             strings.Repeat("echo hello\n", 400),
+		"scripts/nested/deeper/x.txt":       "x",
+		"A file with a very long name.json": "{}",
+		// Same primary name as user-data
+		"user_data": "[]",
+		"ünïcödé":   "utf-8",
+	}
+	mtime := time.Date(2024, 2, 3, 4, 5, 6, 0, time.UTC)
+	w := NewWriter(Options{VolumeID: "cidata", ModTime: mtime})
+	for p, data := range files {
+		if err := w.AddFile(p, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	img := writeImage(t, w)
+
+	pvd := img.descriptor(descriptorPrimary)
+	if got := strings.TrimRight(string(pvd[40:72]), " "); got != "cidata" {
+		t.Errorf("volume id %q", got)
+	}
+	if got := checkBoth32(t, pvd[80:]); int(got)*SectorSize != len(img.data) {
+		t.Errorf("volume of %d sectors in %d bytes", got, len(img.data))
+	}
+	if got := string(pvd[813:827]); got != "20240203040506" {
+		t.Errorf("creation time %q", got)
+	}
+	svd := img.descriptor(descriptorSupplementary)
+	if string(svd[88:91]) != "%/E" {
+		t.Errorf("escape sequence %q", svd[88:91])
+	}
+	if got := strings.TrimRight(decodeUCS2(svd[40:72]), " "); got != "cidata" {
+		t.Errorf("joliet volume id %q", got)
+	}
+
+	// The root of the primary tree announces Rock Ridge
+	pvdRoot := pvd[156:190]
+	dot := img.sector(checkBoth32(t, pvdRoot[2:]))
+	use := dot[34:dot[0]]
+	if !bytes.HasPrefix(use, sharingProtocol()) {
+		t.Errorf("root does not start with SP: %q", use)
+	}
+	if i := bytes.Index(use, []byte("CE")); i < 0 {
+		t.Error("root has no continuation")
+	} else {
+		ce := use[i:]
+		er := img.sector(checkBoth32(t, ce[4:]))[checkBoth32(t, ce[12:]):][:checkBoth32(t, ce[20:])]
+		if string(er[:2]) != "ER" || string(er[8:8+er[4]]) != "RRIP_1991A" {
+			t.Errorf("extension reference %q", er)
+		}
+	}
+
+	for _, tree := range []struct {
+		name   string
+		root   []byte
+		joliet bool
+	}{
+		{"rock ridge", pvdRoot, false},
+		{"joliet", svd[156:190], true},
+	} {
+		t.Run(tree.name, func(t *testing.T) {
+			img.t = t
+			got := img.files(tree.root, tree.joliet)
+			if len(got) != len(files) {
+				t.Errorf("got %d files, want %d", len(got), len(files))
+			}
+			for p, want := range files {
+				if got[p] != want {
+					t.Errorf("%s: got %q, want %q", p, got[p], want)
+				}
+			}
+		})
+	}
+	img.t = t
+
+	// Primary names are unique d-characters
+	seen := make(map[string]bool)
+	for _, e := range img.readDir(checkBoth32(t, pvdRoot[2:]), checkBoth32(t, pvdRoot[10:]), false) {
+		if seen[e.name] {
+			t.Errorf("duplicate name %q", e.name)
+		}
+		seen[e.name] = true
+		if strings.TrimFunc(e.name, func(r rune) bool {
+			return r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '.' || r == ';'
+		}) != "" || len(e.name) > isoNameLength+2 {
+			t.Errorf("invalid primary name %q", e.name)
+		}
+	}
+
+	// Path tables list the root then the directories by level
+	for _, d := range []struct {
+		desc   []byte
+		joliet bool
+	}{{pvd, false}, {svd, true}} {
+		size := checkBoth32(t, d.desc[132:])
+		lTable := img.sector(binary.LittleEndian.Uint32(d.desc[140:]))[:size]
+		mTable := img.sector(binary.BigEndian.Uint32(d.desc[148:]))[:size]
+		var names []string
+		for off := 0; off < len(lTable); {
+			idLen := int(lTable[off])
+			if binary.LittleEndian.Uint32(lTable[off+2:]) != binary.BigEndian.Uint32(mTable[off+2:]) {
+				t.Errorf("path tables differ at %d", off)
+			}
+			id := lTable[off+8 : off+8+idLen]
+			if d.joliet && idLen > 1 {
+				names = append(names, decodeUCS2(id))
+			} else {
+				names = append(names, string(id))
+			}
+			off += 8 + idLen + idLen%2
+		}
+		want := []string{"\x00", "SCRIPTS", "NESTED", "DEEPER"}
+		if d.joliet {
+			want = []string{"\x00", "scripts", "nested", "deeper"}
+		}
+		if strings.Join(names, "/") != strings.Join(want, "/") {
+			t.Errorf("path table %q, want %q", names, want)
+		}
+	}
+}
+
+func TestManyFiles(t *testing.T) {
+	// Enough records to fill several directory sectors
+	w := NewWriter(Options{VolumeID: "many"})
+	want := make(map[string]string)
+	for i := range 200 {
+		p := strings.Repeat("f", i%40+1) + "-" + string(rune('a'+i%26)) + "-" + strings.Repeat("x", i/26)
+		want[p] = p
+		if err := w.AddFile(p, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	img := writeImage(t, w)
+	for _, typ := range []byte{descriptorPrimary, descriptorSupplementary} {
+		d := img.descriptor(typ)
+		if size := checkBoth32(t, d[156+10:]); size <= SectorSize {
+			t.Errorf("root of %d bytes", size)
+		}
+		got := img.files(d[156:190], typ == descriptorSupplementary)
+		if len(got) != len(want) {
+			t.Errorf("got %d files, want %d", len(got), len(want))
+		}
+		for p := range want {
+			if got[p] != want[p] {
+				t.Errorf("%s: got %q", p, got[p])
+			}
+		}
+	}
+}
+
+func TestLongName(t *testing.T) {
+	// 180 bytes of UTF-8 do not fit in a record next to the other entries
+	long := strings.Repeat("漢", 60)
+	files := map[string]string{
+		long:                             "long",
+		"dir/" + long + "/" + long:       "nested",
+		strings.Repeat("é", 64):          "accents",
+		strings.Repeat("a", 64):          "ascii",
+		"dir/" + strings.Repeat("字", 50): "short enough",
+	}
+	w := NewWriter(Options{VolumeID: "long"})
+	for p, data := range files {
+		if err := w.AddFile(p, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	img := writeImage(t, w)
+	pvd := img.descriptor(descriptorPrimary)
+
+	var check func(extent, size uint32)
+	check = func(extent, size uint32) {
+		data := img.sector(extent)[:size]
+		for off := 0; off < len(data); {
+			length := int(data[off])
+			if length == 0 {
+				off = (off/SectorSize + 1) * SectorSize
+				continue
+			}
+			if length%2 != 0 || off%SectorSize+length > SectorSize {
+				t.Errorf("record of %d bytes at %d", length, off)
+			}
+			off += length
+		}
+		for _, e := range img.readDir(extent, size, false) {
+			if e.dir {
+				check(e.extent, e.size)
+			}
+		}
+	}
+	check(checkBoth32(t, pvd[156+2:]), checkBoth32(t, pvd[156+10:]))
+
+	got := img.files(pvd[156:190], false)
+	if len(got) != len(files) {
+		t.Errorf("got %d files, want %d", len(got), len(files))
+	}
+	for p, want := range files {
+		if got[p] != want {
+			t.Errorf("%s: got %q, want %q", p, got[p], want)
+		}
+	}
+}
+
+func TestAddFileErrors(t *testing.T) {
+	w := NewWriter(Options{})
+	if err := w.AddFile("dir/file", nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want error
+	}{
+		{"", ErrInvalidPath},
+		{"/abs", ErrInvalidPath},
+		{"../escape", ErrInvalidPath},
+		{".", ErrInvalidPath},
+		{strings.Repeat("n", MaxNameLength+1), ErrInvalidPath},
+		{"dir/file", ErrExists},
+		{"dir/file/below", ErrExists},
+	}
+	for _, tt := range tests {
+		if err := w.AddFile(tt.path, nil); !errors.Is(err, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.path, err, tt.want)
+		}
+	}
+}
@@ -21,8 +21,35 @@ var (
 	ErrNoKeyValuePairsFound = errors.New("unable to find kvp keys")
 	// ErrKeyNotFound means we could not find the key in information read
 	ErrKeyNotFound = errors.New("unable to find key")
+	// ErrSplitValueMismatch means the parts of a split value do not match
+	// the manifest the host stored with them
+	ErrSplitValueMismatch = errors.New("split kvp value does not match its manifest")
+	// ErrTruncatedPoolFile means a pool file ends in the middle of a record
+	ErrTruncatedPoolFile = errors.New("truncated kvp pool file")
+	// ErrCorruptRecord means a pool file record has no valid key or value
+	ErrCorruptRecord = errors.New("corrupt kvp pool record")
 )
 
+// PoolFileError is returned when a pool file cannot be decoded
+type PoolFileError struct {
+	// Path is empty when decoding data that did not come from a file
+	Path string
+	// Record is the index of the offending record
+	Record int
+	Err    error
+}
+
+func (e *PoolFileError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("kvp pool record %d: %v", e.Record, e.Err)
+	}
+	return fmt.Sprintf("%s: record %d: %v", e.Path, e.Record, e.Err)
+}
+
+func (e *PoolFileError) Unwrap() error {
+	return e.Err
+}
+
 const (
 	// Timeout amount of time in ms to poll the hyperv kernel device
 	Timeout                   = 1000
@@ -31,7 +58,20 @@ const (
 	HvEFail                   = 0x80004005
 	HvKvpExchangeMaxValueSize = 2048
 	HvKvpExchangeMaxKeySize   = 512
+	OpGet                     = 0
 	OpSet                     = 1
+	OpDelete                  = 2
+	OpEnumerate               = 3
+	OpGetIPInfo               = 4
+	OpSetIPInfo               = 5
+	// HvSCont tells the host there is nothing more to read, it is also
+	// used to report a missing key
+	HvSCont = 0x80070103
+	// HvErrorNotSupported is returned for requests the guest cannot honor
+	HvErrorNotSupported = 0x80070032
+	MaxAdapterIDSize    = 128
+	MaxIPAddrSize       = 1024
+	MaxGatewaySize      = 512
 	// KernelDevice is the hyperv kernel device used for communicating key-value pairs
 	// on hyperv between the host and guest
 	KernelDevice = "/dev/vmbus/hv_kvp"
@@ -42,6 +82,28 @@ const (
 	DefaultKVPFileWritePermissions = 0644
 )
 
+const (
+	// PoolExternal holds the items written by the host
+	PoolExternal PoolID = 0
+	// PoolGuest holds the items written by the guest for the host
+	PoolGuest PoolID = 1
+	// PoolAuto holds the intrinsic items the daemon generates on demand
+	PoolAuto PoolID = 2
+	// PoolAutoExternal holds the items pushed by the host itself
+	PoolAutoExternal PoolID = 3
+	// PoolAutoInternal holds items generated inside the guest
+	PoolAutoInternal PoolID = 4
+	// PoolCount is the number of pools handled by the kernel
+	PoolCount = 5
+)
+
+// Address families reported in ip info requests
+const (
+	AddrFamilyNone = 0x00
+	AddrFamilyIPv4 = 0x01
+	AddrFamilyIPv6 = 0x02
+)
+
 type hvKvpExchgMsgValue struct {
 	valueType uint32
 	keySize   uint32
@@ -54,6 +116,36 @@ type hvKvpMsgSet struct {
 	data hvKvpExchgMsgValue
 }
 
+type hvKvpMsgGet struct {
+	data hvKvpExchgMsgValue
+}
+
+type hvKvpMsgDelete struct {
+	keySize uint32
+	key     [HvKvpExchangeMaxKeySize]uint8
+}
+
+type hvKvpMsgEnumerate struct {
+	index uint32
+	data  hvKvpExchgMsgValue
+}
+
+type hvKvpRegister struct {
+	version [HvKvpExchangeMaxKeySize]uint8
+}
+
+// hvKvpIPAddrValue mirrors the packed hv_kvp_ipaddr_value struct, strings
+// are NUL terminated UTF-16.
+type hvKvpIPAddrValue struct {
+	adapterID   [MaxAdapterIDSize]uint16
+	addrFamily  uint8
+	dhcpEnabled uint8
+	ipAddr      [MaxIPAddrSize]uint16
+	subNet      [MaxIPAddrSize]uint16
+	gateWay     [MaxGatewaySize]uint16
+	dnsAddr     [MaxIPAddrSize]uint16
+}
+
 type hvKvpHdr struct {
 	operation uint8
 	pool      uint8
@@ -98,20 +190,7 @@ func (vp ValuePairs) GetValueByKey(key string) (ValuePair, error) {
 type KeyValuePair map[PoolID]ValuePairs
 
 func (kv KeyValuePair) EncodePoolFile(poolID PoolID) (poolFile []byte) {
-	poolEntries, exists := kv[poolID]
-	if !exists {
-		return
-	}
-	for _, entry := range poolEntries {
-		// These have to be padded with nulls
-		emptyKey := make([]byte, HvKvpExchangeMaxKeySize)
-		emptyVal := make([]byte, HvKvpExchangeMaxValueSize)
-		_ = copy(emptyKey, entry.Key)
-		_ = copy(emptyVal, entry.Value)
-		poolFile = append(poolFile, emptyKey...)
-		poolFile = append(poolFile, emptyVal...)
-	}
-	return
+	return kv[poolID].encode()
 }
 
 func (kv KeyValuePair) append(poolID PoolID, key, value string) {
@@ -0,0 +1,236 @@
+//go:build linux
+
+package kvp
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Daemon is a replacement for hv_kvp_daemon.  It serves the kernel
+// key-value pair channel, persists the pools in .kvp_pool_N files the same
+// way the C daemon does, and answers the host's requests for guest data.
+type Daemon struct {
+	// DevicePath is the kernel device to serve, KernelDevice by default
+	DevicePath string
+	// PoolPath is the directory the pool files are kept in,
+	// DefaultKVPFilePath by default
+	PoolPath string
+	// GetIPInfo looks up the configuration of the adapter the host asks
+	// about, LookupIPInfo by default
+	GetIPInfo func(adapterID string) (*IPConfig, error)
+	// SetIPInfo applies a configuration pushed by the host.  If nil, such
+	// requests are answered as not supported.
+	SetIPInfo func(config *IPConfig) error
+
+	// Transport is the channel to the kernel.  If nil, DevicePath is opened.
+	Transport Transport
+
+	pools   [PoolCount]*poolFile
+	version string
+	osInfo  osInfo
+}
+
+// NewDaemon creates a daemon with the default settings
+func NewDaemon() *Daemon {
+	return &Daemon{
+		DevicePath: KernelDevice,
+		PoolPath:   DefaultKVPFilePath,
+		GetIPInfo:  LookupIPInfo,
+	}
+}
+
+func (d *Daemon) init() error {
+	if err := os.MkdirAll(d.PoolPath, 0755); err != nil {
+		return err
+	}
+	for i := range d.pools {
+		d.pools[i] = newPoolFile(d.PoolPath, PoolID(i))
+		if err := d.pools[i].load(); err != nil {
+			return err
+		}
+	}
+	d.osInfo = getOSInfo()
+	return nil
+}
+
+// Run registers with the kernel and serves requests until ctx is cancelled,
+// in which case it returns nil.
+func (d *Daemon) Run(ctx context.Context) error {
+	if err := d.init(); err != nil {
+		return err
+	}
+
+	if d.Transport == nil {
+		t, err := OpenKernelTransport(d.DevicePath)
+		if err != nil {
+			return err
+		}
+		d.Transport = t
+	}
+	defer func() {
+		_ = d.Transport.Close()
+		d.Transport = nil
+	}()
+
+	if err := register(d.Transport); err != nil {
+		return err
+	}
+
+	var msg hvKvpMsg
+	handshake := true
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		ok, err := nextMessage(d.Transport, Timeout, &msg)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if msg.kvpHdr.operation == OpRegister1 {
+			if handshake {
+				reg := msg.register()
+				d.version = cString(reg.version[:], HvKvpExchangeMaxKeySize)
+				handshake = false
+				logrus.Debugf("registered with hv_kvp, version %q", d.version)
+			}
+			continue
+		}
+
+		d.handle(&msg)
+		if err := writeMessage(d.Transport, &msg); err != nil {
+			return err
+		}
+	}
+}
+
+// handle processes a request and turns msg into the reply for it
+func (d *Daemon) handle(msg *hvKvpMsg) {
+	op := msg.kvpHdr.operation
+	poolID := PoolID(msg.kvpHdr.pool)
+	if int(poolID) >= PoolCount && (op == OpGet || op == OpSet || op == OpDelete || op == OpEnumerate) {
+		msg.setError(HvEFail)
+		return
+	}
+
+	var code uint32
+	switch op {
+	case OpSet:
+		code = d.set(poolID, &msg.kvpSet.data)
+	case OpGet:
+		code = d.get(poolID, &msg.get().data)
+	case OpDelete:
+		code = d.delete(poolID, msg.delete())
+	case OpEnumerate:
+		code = d.enumerate(poolID, msg.enumerate())
+	case OpGetIPInfo:
+		code = d.getIPInfo(msg.ipAddrValue())
+	case OpSetIPInfo:
+		code = d.setIPInfo(msg.ipAddrValue())
+	default:
+		logrus.Debugf("unsupported hv_kvp operation %d", op)
+		code = HvErrorNotSupported
+	}
+	msg.setError(code)
+}
+
+func (d *Daemon) set(poolID PoolID, data *hvKvpExchgMsgValue) uint32 {
+	if data.keySize > HvKvpExchangeMaxKeySize || data.valueSize > HvKvpExchangeMaxValueSize {
+		return HvSCont
+	}
+	key := cString(data.key[:], data.keySize)
+	value := cString(data.value[:], data.valueSize)
+	if err := d.pools[poolID].set(key, value); err != nil {
+		logrus.Errorf("failed to set key %q in pool %d: %v", key, poolID, err)
+		return HvSCont
+	}
+	return HvSOk
+}
+
+func (d *Daemon) get(poolID PoolID, data *hvKvpExchgMsgValue) uint32 {
+	pool := d.pools[poolID]
+	if err := pool.load(); err != nil {
+		logrus.Errorf("failed to read pool %d: %v", poolID, err)
+	}
+	key := cString(data.key[:], data.keySize)
+	vp, err := pool.get(key)
+	if err != nil {
+		return HvSCont
+	}
+	data.valueSize = putCString(data.value[:], vp.Value)
+	return HvSOk
+}
+
+func (d *Daemon) delete(poolID PoolID, del *hvKvpMsgDelete) uint32 {
+	key := cString(del.key[:], del.keySize)
+	if err := d.pools[poolID].delete(key); err != nil {
+		if !errors.Is(err, ErrKeyNotFound) {
+			logrus.Errorf("failed to delete key %q from pool %d: %v", key, poolID, err)
+		}
+		return HvSCont
+	}
+	return HvSOk
+}
+
+func (d *Daemon) enumerate(poolID PoolID, enum *hvKvpMsgEnumerate) uint32 {
+	var key, value string
+	if poolID == PoolAuto {
+		var ok bool
+		if key, value, ok = d.intrinsicItem(enum.index); !ok {
+			return HvSCont
+		}
+	} else {
+		pool := d.pools[poolID]
+		if err := pool.load(); err != nil {
+			logrus.Errorf("failed to read pool %d: %v", poolID, err)
+		}
+		if int(enum.index) >= len(pool.records) {
+			return HvSCont
+		}
+		key = pool.records[enum.index].Key
+		value = pool.records[enum.index].Value
+	}
+	enum.data.keySize = putCString(enum.data.key[:], key)
+	enum.data.valueSize = putCString(enum.data.value[:], value)
+	return HvSOk
+}
+
+func (d *Daemon) getIPInfo(v *hvKvpIPAddrValue) uint32 {
+	if d.GetIPInfo == nil {
+		return HvErrorNotSupported
+	}
+	adapterID := utf16String(v.adapterID[:])
+	config, err := d.GetIPInfo(adapterID)
+	if err == nil && config == nil {
+		// A hook without a configuration does not know the adapter
+		err = ErrAdapterNotFound
+	}
+	if err != nil {
+		logrus.Errorf("failed to get ip info for adapter %q: %v", adapterID, err)
+		return HvEFail
+	}
+	config.AdapterID = adapterID
+	config.encode(v)
+	return HvSOk
+}
+
+func (d *Daemon) setIPInfo(v *hvKvpIPAddrValue) uint32 {
+	if d.SetIPInfo == nil {
+		return HvErrorNotSupported
+	}
+	var config IPConfig
+	config.decode(v)
+	if err := d.SetIPInfo(&config); err != nil {
+		logrus.Errorf("failed to set ip info for adapter %q: %v", config.AdapterID, err)
+		return HvEFail
+	}
+	return HvSOk
+}
@@ -0,0 +1,230 @@
+//go:build linux
+
+package kvp
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/libhvee/pkg/hvutils"
+	"golang.org/x/sys/unix"
+)
+
+// fakeKernel plays the kernel side of a socket pair standing in for the
+// hv_kvp character device
+type fakeKernel struct {
+	t  *testing.T
+	fd int
+}
+
+func newFakeKernel(t *testing.T) (*fakeKernel, Transport) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.SetNonblock(fds[0], true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = unix.Close(fds[1]) })
+	return &fakeKernel{t: t, fd: fds[1]}, hvutils.NewTransport(fds[0])
+}
+
+func (k *fakeKernel) send(msg *hvKvpMsg) {
+	k.t.Helper()
+	if _, err := unix.Write(k.fd, msg.bytes()); err != nil {
+		k.t.Fatal(err)
+	}
+}
+
+func (k *fakeKernel) recv() *hvKvpMsg {
+	k.t.Helper()
+	var msg hvKvpMsg
+	l, err := unix.Read(k.fd, msg.bytes())
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	if l != hvKvpMsgSize {
+		k.t.Fatalf("short message: %d bytes", l)
+	}
+	return &msg
+}
+
+func (k *fakeKernel) request(msg *hvKvpMsg) (*hvKvpMsg, uint32) {
+	k.t.Helper()
+	k.send(msg)
+	reply := k.recv()
+	return reply, reply.errorCode()
+}
+
+func runDaemon(t *testing.T, setup func(d *Daemon)) (*fakeKernel, *Daemon) {
+	kernel, dev := newFakeKernel(t)
+	d := NewDaemon()
+	d.PoolPath = t.TempDir()
+	d.Transport = dev
+	if setup != nil {
+		setup(d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+
+	if op := kernel.recv().kvpHdr.operation; op != OpRegister1 {
+		t.Fatalf("expected registration, got operation %d", op)
+	}
+	reg := newRequest(OpRegister1, 0)
+	putCString(reg.register().version[:], "3.1")
+	kernel.send(reg)
+	return kernel, d
+}
+
+func TestDaemon(t *testing.T) {
+	kernel, d := runDaemon(t, nil)
+
+	set := newRequest(OpSet, PoolExternal)
+	set.kvpSet.data.keySize = putCString(set.kvpSet.data.key[:], "ignition.config.0")
+	set.kvpSet.data.valueSize = putCString(set.kvpSet.data.value[:], "{}")
+	if _, code := kernel.request(set); code != HvSOk {
+		t.Fatalf("set failed: %#x", code)
+	}
+
+	get := newRequest(OpGet, PoolExternal)
+	get.get().data.keySize = putCString(get.get().data.key[:], "ignition.config.0")
+	reply, code := kernel.request(get)
+	if code != HvSOk {
+		t.Fatalf("get failed: %#x", code)
+	}
+	if v := cString(reply.get().data.value[:], reply.get().data.valueSize); v != "{}" {
+		t.Errorf("get returned %q", v)
+	}
+
+	get.get().data.keySize = putCString(get.get().data.key[:], "missing")
+	if _, code := kernel.request(get); code != HvSCont {
+		t.Errorf("get of a missing key returned %#x", code)
+	}
+
+	enum := newRequest(OpEnumerate, PoolExternal)
+	reply, code = kernel.request(enum)
+	if code != HvSOk {
+		t.Fatalf("enumerate failed: %#x", code)
+	}
+	if k := cString(reply.enumerate().data.key[:], reply.enumerate().data.keySize); k != "ignition.config.0" {
+		t.Errorf("enumerate returned key %q", k)
+	}
+	enum.enumerate().index = 1
+	if _, code := kernel.request(enum); code != HvSCont {
+		t.Errorf("enumerate past the end returned %#x", code)
+	}
+
+	data, err := os.ReadFile(filepath.Join(d.PoolPath, ".kvp_pool_0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != poolRecordSize {
+		t.Errorf("pool file has %d bytes, want %d", len(data), poolRecordSize)
+	}
+
+	del := newRequest(OpDelete, PoolExternal)
+	del.delete().keySize = putCString(del.delete().key[:], "ignition.config.0")
+	if _, code := kernel.request(del); code != HvSOk {
+		t.Fatalf("delete failed: %#x", code)
+	}
+	if _, code := kernel.request(del); code != HvSCont {
+		t.Errorf("second delete returned %#x", code)
+	}
+
+	auto := newRequest(OpEnumerate, PoolAuto)
+	auto.enumerate().index = IntegrationServicesVersion
+	reply, code = kernel.request(auto)
+	if code != HvSOk {
+		t.Fatalf("enumerate of the auto pool failed: %#x", code)
+	}
+	if v := cString(reply.enumerate().data.value[:], reply.enumerate().data.valueSize); v != "3.1" {
+		t.Errorf("integration services version is %q", v)
+	}
+}
+
+func TestDaemonIPInfo(t *testing.T) {
+	kernel, _ := runDaemon(t, func(d *Daemon) {
+		d.GetIPInfo = func(adapterID string) (*IPConfig, error) {
+			return &IPConfig{
+				AddressFamily: AddrFamilyIPv4,
+				IPAddresses:   []string{"192.168.1.10"},
+				Subnets:       []string{"255.255.255.0"},
+				Gateways:      []string{"192.168.1.1"},
+			}, nil
+		}
+	})
+
+	msg := newRequest(OpGetIPInfo, 0)
+	putUTF16String(msg.ipAddrValue().adapterID[:], "00:15:5D:01:02:03")
+	reply, code := kernel.request(msg)
+	if code != HvSOk {
+		t.Fatalf("get ip info failed: %#x", code)
+	}
+	var config IPConfig
+	config.decode(reply.ipAddrValue())
+	if config.AdapterID != "00:15:5D:01:02:03" || len(config.IPAddresses) != 1 || config.IPAddresses[0] != "192.168.1.10" {
+		t.Errorf("unexpected ip info %+v", config)
+	}
+
+	msg = newRequest(OpSetIPInfo, 0)
+	if _, code := kernel.request(msg); code != HvErrorNotSupported {
+		t.Errorf("set ip info without a handler returned %#x", code)
+	}
+}
+
+func TestDaemonIPInfoUnknownAdapter(t *testing.T) {
+	kernel, _ := runDaemon(t, func(d *Daemon) {
+		d.GetIPInfo = func(string) (*IPConfig, error) { return nil, nil }
+	})
+
+	msg := newRequest(OpGetIPInfo, 0)
+	putUTF16String(msg.ipAddrValue().adapterID[:], "00:15:5D:01:02:03")
+	if _, code := kernel.request(msg); code != HvEFail {
+		t.Errorf("get ip info without a config returned %#x", code)
+	}
+}
+
+func TestDaemonExternalChange(t *testing.T) {
+	kernel, d := runDaemon(t, nil)
+
+	set := newRequest(OpSet, PoolGuest)
+	set.kvpSet.data.keySize = putCString(set.kvpSet.data.key[:], "state")
+	set.kvpSet.data.valueSize = putCString(set.kvpSet.data.value[:], "old")
+	if _, code := kernel.request(set); code != HvSOk {
+		t.Fatalf("set failed: %#x", code)
+	}
+
+	// Another writer replaces the value without changing the size or the
+	// modification time of the file
+	path := filepath.Join(d.PoolPath, ".kvp_pool_1")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, ValuePairs{{Key: "state", Value: "new"}}.encode(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	get := newRequest(OpGet, PoolGuest)
+	get.get().data.keySize = putCString(get.get().data.key[:], "state")
+	reply, code := kernel.request(get)
+	if code != HvSOk {
+		t.Fatalf("get failed: %#x", code)
+	}
+	if v := cString(reply.get().data.value[:], reply.get().data.valueSize); v != "new" {
+		t.Errorf("get returned %q", v)
+	}
+}
@@ -0,0 +1,70 @@
+package ginsu
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ManifestSuffix is appended to the key prefix of split values to name
+// the key holding their manifest, e.g. ignition.config.manifest
+const ManifestSuffix = "manifest"
+
+var (
+	// ErrInvalidManifest means the manifest value cannot be parsed
+	ErrInvalidManifest = errors.New("invalid split value manifest")
+	// ErrChunkCountMismatch means some parts are missing or left over
+	ErrChunkCountMismatch = errors.New("number of parts does not match the manifest")
+	// ErrDigestMismatch means the reassembled value is not the one the
+	// manifest was written for
+	ErrDigestMismatch = errors.New("digest of parts does not match the manifest")
+)
+
+// Manifest describes a value split with Dice, so the reader can tell a
+// complete value from a partial or mixed one
+type Manifest struct {
+	Chunks int
+	// SHA256 is the hex encoded digest of the joined parts
+	SHA256 string
+}
+
+// NewManifest creates the manifest for parts
+func NewManifest(parts []string) Manifest {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+	}
+	return Manifest{Chunks: len(parts), SHA256: hex.EncodeToString(h.Sum(nil))}
+}
+
+// String encodes the manifest to be stored as a key-value pair
+func (m Manifest) String() string {
+	return fmt.Sprintf("chunks=%d;sha256=%s", m.Chunks, m.SHA256)
+}
+
+// ParseManifest decodes a manifest created with Manifest.String
+func ParseManifest(s string) (Manifest, error) {
+	var m Manifest
+	var digest string
+	if _, err := fmt.Sscanf(s, "chunks=%d;sha256=%s", &m.Chunks, &digest); err != nil {
+		return m, fmt.Errorf("%q: %w", s, ErrInvalidManifest)
+	}
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != sha256.Size*2 || m.Chunks < 0 {
+		return m, fmt.Errorf("%q: %w", s, ErrInvalidManifest)
+	}
+	m.SHA256 = strings.ToLower(digest)
+	return m, nil
+}
+
+// Verify checks that parts are exactly the ones the manifest was created for
+func (m Manifest) Verify(parts []string) error {
+	if len(parts) != m.Chunks {
+		return fmt.Errorf("got %d parts, want %d: %w", len(parts), m.Chunks, ErrChunkCountMismatch)
+	}
+	if got := NewManifest(parts).SHA256; got != m.SHA256 {
+		return fmt.Errorf("got %s, want %s: %w", got, m.SHA256, ErrDigestMismatch)
+	}
+	return nil
+}
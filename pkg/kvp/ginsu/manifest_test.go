@@ -0,0 +1,41 @@
+package ginsu
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	parts := []string{`{"ignition":`, `{"version":"3.4.0"}}`}
+	m := NewManifest(parts)
+	parsed, err := ParseManifest(m.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != m {
+		t.Errorf("parsed %+v, want %+v", parsed, m)
+	}
+
+	tests := []struct {
+		name  string
+		parts []string
+		want  error
+	}{
+		{name: "complete", parts: parts},
+		{name: "partial", parts: parts[:1], want: ErrChunkCountMismatch},
+		{name: "stale", parts: append([]string{`{"old":`}, parts[1:]...), want: ErrDigestMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := parsed.Verify(tt.parts); !errors.Is(err, tt.want) {
+				t.Errorf("Verify() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	for _, s := range []string{"", "chunks=2", "chunks=x;sha256=00", "chunks=1;sha256=abc"} {
+		if _, err := ParseManifest(s); !errors.Is(err, ErrInvalidManifest) {
+			t.Errorf("ParseManifest(%q) = %v", s, err)
+		}
+	}
+}
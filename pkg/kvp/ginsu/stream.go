@@ -0,0 +1,285 @@
+package ginsu
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is the compression applied to a value before it is split
+type Codec string
+
+const (
+	CodecNone Codec = "none"
+	CodecGzip Codec = "gzip"
+	CodecZstd Codec = "zstd"
+)
+
+const (
+	// HeaderSuffix is appended to the key prefix of parts created with Split
+	// to name the key holding their header, e.g. ignition.config.header
+	HeaderSuffix = "header"
+	// headerVersion identifies the format written by Split
+	headerVersion = "v2"
+)
+
+var (
+	// ErrUnknownCodec means the header names a codec this version does not
+	// support
+	ErrUnknownCodec = errors.New("unknown ginsu codec")
+	// ErrInvalidHeader means the header value cannot be parsed
+	ErrInvalidHeader = errors.New("invalid ginsu header")
+)
+
+// Options control how Split encodes a value
+type Options struct {
+	// Codec defaults to CodecNone
+	Codec Codec
+	// PartSize is the length of each part, KvpValueMaxLen by default
+	PartSize int
+}
+
+// Header describes the parts written by Split, it is stored next to them
+// so Join knows how to decode and verify the value
+type Header struct {
+	Codec Codec
+	Parts int
+	// Size is the length of the original value
+	Size int64
+	// SHA256 is the hex encoded digest of the original value
+	SHA256 string
+}
+
+// String encodes the header to be stored as a key-value pair
+func (h *Header) String() string {
+	return fmt.Sprintf("%s;codec=%s;parts=%d;size=%d;sha256=%s", headerVersion, h.Codec, h.Parts, h.Size, h.SHA256)
+}
+
+// ParseHeader decodes a header created with Header.String
+func ParseHeader(s string) (*Header, error) {
+	fields := strings.Split(s, ";")
+	if len(fields) != 5 || fields[0] != headerVersion {
+		return nil, fmt.Errorf("%q: %w", s, ErrInvalidHeader)
+	}
+	values := make(map[string]string)
+	for _, f := range fields[1:] {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: %w", s, ErrInvalidHeader)
+		}
+		values[k] = v
+	}
+
+	h := &Header{Codec: Codec(values["codec"]), SHA256: values["sha256"]}
+	parts, err := strconv.Atoi(values["parts"])
+	if err != nil || parts < 0 {
+		return nil, fmt.Errorf("%q: parts: %w", s, ErrInvalidHeader)
+	}
+	h.Parts = parts
+	if h.Size, err = strconv.ParseInt(values["size"], 10, 64); err != nil || h.Size < 0 {
+		return nil, fmt.Errorf("%q: size: %w", s, ErrInvalidHeader)
+	}
+	if b, err := hex.DecodeString(h.SHA256); err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("%q: sha256: %w", s, ErrInvalidHeader)
+	}
+	if err := h.Codec.check(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (c Codec) check() error {
+	switch c {
+	case CodecNone, CodecGzip, CodecZstd:
+		return nil
+	}
+	return fmt.Errorf("%q: %w", string(c), ErrUnknownCodec)
+}
+
+func (c Codec) compressor(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CodecNone:
+		return nopWriteCloser{w}, nil
+	case CodecGzip:
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case CodecZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	}
+	return nil, c.check()
+}
+
+func (c Codec) decompressor(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case CodecNone:
+		return io.NopCloser(r), nil
+	case CodecGzip:
+		return gzip.NewReader(r)
+	case CodecZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, c.check()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// partWriter cuts its input into parts of a fixed size
+type partWriter struct {
+	size  int
+	buf   []byte
+	count int
+	emit  func(index int, part string) error
+}
+
+func (p *partWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		l := min(p.size-len(p.buf), len(b))
+		p.buf = append(p.buf, b[:l]...)
+		b = b[l:]
+		if len(p.buf) == p.size {
+			if err := p.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (p *partWriter) flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	if err := p.emit(p.count, string(p.buf)); err != nil {
+		return err
+	}
+	p.count++
+	p.buf = p.buf[:0]
+	return nil
+}
+
+// countingHash hashes and counts everything written to it
+type countingHash struct {
+	hash.Hash
+	size int64
+}
+
+func (c *countingHash) Write(b []byte) (int, error) {
+	c.size += int64(len(b))
+	return c.Hash.Write(b)
+}
+
+// Split streams r through the codec and a base64 encoding, which keeps the
+// parts safe to store as KVP values, and passes every part to emit as soon
+// as it is complete.  The header describing the parts is returned once r is
+// exhausted.
+func Split(r io.Reader, opts Options, emit func(index int, part string) error) (*Header, error) {
+	if opts.Codec == "" {
+		opts.Codec = CodecNone
+	}
+	if opts.PartSize <= 0 {
+		opts.PartSize = KvpValueMaxLen
+	}
+
+	parts := &partWriter{size: opts.PartSize, emit: emit}
+	enc := base64.NewEncoder(base64.StdEncoding, parts)
+	comp, err := opts.Codec.compressor(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := &countingHash{Hash: sha256.New()}
+	if _, err := io.Copy(comp, io.TeeReader(r, sum)); err != nil {
+		return nil, err
+	}
+	if err := comp.Close(); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	if err := parts.flush(); err != nil {
+		return nil, err
+	}
+
+	return &Header{
+		Codec:  opts.Codec,
+		Parts:  parts.count,
+		Size:   sum.size,
+		SHA256: hex.EncodeToString(sum.Sum(nil)),
+	}, nil
+}
+
+// SplitToParts is like Split but collects the parts in memory
+func SplitToParts(r io.Reader, opts Options) (*Header, []string, error) {
+	var parts []string
+	h, err := Split(r, opts, func(_ int, part string) error {
+		parts = append(parts, part)
+		return nil
+	})
+	return h, parts, err
+}
+
+// Join decodes parts written by Split into w and verifies the result
+// against the header.  The data is streamed, so w has already received it
+// when a mismatch is detected; callers that cannot use a partial value
+// should write to a temporary destination.  No more than the size in the
+// header and one byte is written, however much the parts decompress to.
+func Join(w io.Writer, h *Header, parts []string) error {
+	if len(parts) != h.Parts {
+		return fmt.Errorf("got %d parts, want %d: %w", len(parts), h.Parts, ErrChunkCountMismatch)
+	}
+
+	readers := make([]io.Reader, 0, len(parts))
+	for _, p := range parts {
+		readers = append(readers, strings.NewReader(p))
+	}
+	dec, err := h.Codec.decompressor(base64.NewDecoder(base64.StdEncoding, io.MultiReader(readers...)))
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	sum := &countingHash{Hash: sha256.New()}
+	// One byte past the size is enough to tell the value is too large
+	if _, err := io.Copy(io.MultiWriter(w, sum), io.LimitReader(dec, h.Size+1)); err != nil {
+		return err
+	}
+	if sum.size > h.Size {
+		return fmt.Errorf("value larger than %d bytes: %w", h.Size, ErrDigestMismatch)
+	}
+	if sum.size != h.Size {
+		return fmt.Errorf("got %d bytes, want %d: %w", sum.size, h.Size, ErrDigestMismatch)
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != h.SHA256 {
+		return fmt.Errorf("got %s, want %s: %w", got, h.SHA256, ErrDigestMismatch)
+	}
+	return nil
+}
+
+// JoinToBytes is like Join but returns the value, nothing is returned if it
+// does not match the header
+func JoinToBytes(h *Header, parts []string) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := Join(&buf, h, parts); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,120 @@
+package ginsu
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSplitJoin(t *testing.T) {
+	large := strings.Repeat(`{"path":"/etc/motd","contents":{"source":"data:,hello"}},`, 500)
+	tests := []struct {
+		name  string
+		input string
+		opts  Options
+	}{
+		{name: "empty", input: ""},
+		{name: "none", input: large},
+		{name: "gzip", input: large, opts: Options{Codec: CodecGzip}},
+		{name: "zstd", input: large, opts: Options{Codec: CodecZstd}},
+		{name: "small parts", input: large, opts: Options{Codec: CodecGzip, PartSize: 16}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, parts, err := SplitToParts(strings.NewReader(tt.input), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size := tt.opts.PartSize
+			if size == 0 {
+				size = KvpValueMaxLen
+			}
+			for i, p := range parts {
+				if len(p) > size {
+					t.Errorf("part %d has %d bytes", i, len(p))
+				}
+			}
+
+			parsed, err := ParseHeader(h.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *parsed != *h {
+				t.Errorf("parsed %+v, want %+v", parsed, h)
+			}
+
+			var out bytes.Buffer
+			if err := Join(&out, parsed, parts); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.input {
+				t.Errorf("joined %d bytes, want %d", out.Len(), len(tt.input))
+			}
+		})
+	}
+}
+
+func TestSplitCompresses(t *testing.T) {
+	input := strings.Repeat("a", 100*KvpValueMaxLen)
+	for _, codec := range []Codec{CodecGzip, CodecZstd} {
+		h, _, err := SplitToParts(strings.NewReader(input), Options{Codec: codec})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Parts > 2 {
+			t.Errorf("%s used %d parts", codec, h.Parts)
+		}
+	}
+}
+
+func TestJoinMismatch(t *testing.T) {
+	h, parts, err := SplitToParts(strings.NewReader(strings.Repeat("data", 1000)), Options{PartSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := JoinToBytes(h, parts[:len(parts)-1]); !errors.Is(err, ErrChunkCountMismatch) {
+		t.Errorf("missing part: %v", err)
+	}
+
+	other, otherParts, err := SplitToParts(strings.NewReader(strings.Repeat("atad", 1000)), Options{PartSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Parts != h.Parts {
+		t.Fatalf("inputs should have the same number of parts")
+	}
+	mixed := append([]string{otherParts[0]}, parts[1:]...)
+	if _, err := JoinToBytes(h, mixed); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("mixed parts: %v", err)
+	}
+
+	bad := *h
+	bad.Codec = "lz4"
+	if _, err := ParseHeader(bad.String()); !errors.Is(err, ErrUnknownCodec) {
+		t.Errorf("unknown codec: %v", err)
+	}
+	for _, s := range []string{"", "v1;codec=none", "v2;codec=none;parts=x;size=1;sha256=00"} {
+		if _, err := ParseHeader(s); !errors.Is(err, ErrInvalidHeader) {
+			t.Errorf("ParseHeader(%q) = %v", s, err)
+		}
+	}
+}
+
+func TestJoinLimit(t *testing.T) {
+	// Parts that decompress to far more than the header claims
+	h, parts, err := SplitToParts(strings.NewReader(strings.Repeat("a", 1<<20)), Options{Codec: CodecGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Size = 100
+
+	var out bytes.Buffer
+	if err := Join(&out, h, parts); !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("got %v, want %v", err, ErrDigestMismatch)
+	}
+	if out.Len() > 101 {
+		t.Errorf("wrote %d bytes", out.Len())
+	}
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+// Package ignition fetches an Ignition config the host passed to the guest
+// through the Hyper-V key-value pair exchange.
+package ignition
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/containers/libhvee/pkg/kvp"
+	"github.com/containers/libhvee/pkg/kvp/ginsu"
+)
+
+// KeyPrefix is the prefix of the keys the config is split into
+const KeyPrefix = "ignition.config."
+
+var (
+	// ErrNotFound means the host did not pass a config
+	ErrNotFound = errors.New("ignition config not found in kvp")
+	// ErrIncomplete means some parts of the config are missing or belong
+	// to another config
+	ErrIncomplete = errors.New("ignition config in kvp is incomplete")
+	// ErrInvalidConfig means the reassembled config is not valid JSON
+	ErrInvalidConfig = errors.New("ignition config in kvp is not valid JSON")
+)
+
+// ChunkError reports a part of the config that is missing or cannot be
+// decoded
+type ChunkError struct {
+	Key string
+	Err error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("ignition config part %q: %v", e.Key, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// Provider fetches the config, retrying until the host has stored all of
+// it or the context ends
+type Provider struct {
+	// Read returns the current key-value pairs, kvp.GetKeyValuePairs by
+	// default.  Use kvp.ReadFromFS when a kvp daemon owns the kernel device.
+	Read func() (kvp.KeyValuePair, error)
+	// Pool is the pool the host writes to, kvp.DefaultKVPPoolID by default
+	Pool kvp.PoolID
+	// KeyPrefix defaults to KeyPrefix
+	KeyPrefix string
+	// Interval is the delay between attempts
+	Interval time.Duration
+}
+
+// NewProvider creates a provider with the default settings
+func NewProvider() *Provider {
+	return &Provider{
+		Read:      kvp.GetKeyValuePairs,
+		Pool:      kvp.DefaultKVPPoolID,
+		KeyPrefix: KeyPrefix,
+		Interval:  time.Second,
+	}
+}
+
+// Fetch returns the config using the default provider
+func Fetch(ctx context.Context) ([]byte, error) {
+	return NewProvider().Fetch(ctx)
+}
+
+// Fetch waits for a complete and valid config and returns it unparsed.  If
+// ctx ends first, the error describes the last attempt and wraps the
+// context's error.  Errors reading the pairs are returned right away.
+func (p *Provider) Fetch(ctx context.Context) ([]byte, error) {
+	for {
+		config, err := p.fetch()
+		if err == nil {
+			return config, nil
+		}
+		if !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrIncomplete) && !errors.Is(err, ErrInvalidConfig) {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %w", err, ctx.Err())
+		case <-time.After(p.Interval):
+		}
+	}
+}
+
+func (p *Provider) fetch() ([]byte, error) {
+	kv, err := p.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	var config []byte
+	if header, err := kv[p.Pool].GetValueByKey(p.KeyPrefix + ginsu.HeaderSuffix); err == nil {
+		config, err = p.join(kv[p.Pool], header.Value)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s, err := kv.GetSplitKeyValues(p.KeyPrefix, p.Pool)
+		switch {
+		case errors.Is(err, kvp.ErrNoKeyValuePairsFound):
+			return nil, ErrNotFound
+		case errors.Is(err, kvp.ErrSplitValueMismatch):
+			return nil, fmt.Errorf("%w: %w", ErrIncomplete, err)
+		case err != nil:
+			return nil, err
+		}
+		config = []byte(s)
+	}
+
+	var js json.RawMessage
+	if err := json.Unmarshal(config, &js); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+	return config, nil
+}
+
+// join decodes parts written with ginsu.Split
+func (p *Provider) join(vps kvp.ValuePairs, headerValue string) ([]byte, error) {
+	header, err := ginsu.ParseHeader(headerValue)
+	if err != nil {
+		return nil, &ChunkError{Key: p.KeyPrefix + ginsu.HeaderSuffix, Err: fmt.Errorf("%w: %w", ErrIncomplete, err)}
+	}
+
+	// The parts are keys of the pool, a header claiming more cannot be
+	// complete and must not size the allocation
+	if header.Parts > len(vps) {
+		return nil, &ChunkError{Key: p.KeyPrefix + ginsu.HeaderSuffix, Err: fmt.Errorf("%d parts in a pool of %d keys: %w", header.Parts, len(vps), ErrIncomplete)}
+	}
+	parts := make([]string, 0, header.Parts)
+	for i := range header.Parts {
+		key := p.KeyPrefix + strconv.Itoa(i)
+		vp, err := vps.GetValueByKey(key)
+		if err != nil {
+			return nil, &ChunkError{Key: key, Err: ErrIncomplete}
+		}
+		parts = append(parts, vp.Value)
+	}
+
+	config, err := ginsu.JoinToBytes(header, parts)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrIncomplete, err)
+	}
+	return config, nil
+}
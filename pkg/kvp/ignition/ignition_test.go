@@ -0,0 +1,127 @@
+//go:build linux
+
+package ignition
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containers/libhvee/pkg/kvp"
+	"github.com/containers/libhvee/pkg/kvp/ginsu"
+)
+
+const config = `{"ignition":{"version":"3.4.0"}}`
+
+// host hands out a different pool on every read, the last one forever
+type host struct {
+	mu    sync.Mutex
+	pools []kvp.ValuePairs
+}
+
+func (h *host) read() (kvp.KeyValuePair, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	vps := h.pools[0]
+	if len(h.pools) > 1 {
+		h.pools = h.pools[1:]
+	}
+	return kvp.KeyValuePair{kvp.DefaultKVPPoolID: vps}, nil
+}
+
+func provider(pools ...kvp.ValuePairs) *Provider {
+	p := NewProvider()
+	p.Read = (&host{pools: pools}).read
+	p.Interval = time.Millisecond
+	return p
+}
+
+func manifestPairs(parts ...string) kvp.ValuePairs {
+	vps := kvp.ValuePairs{{Key: KeyPrefix + ginsu.ManifestSuffix, Value: ginsu.NewManifest(parts).String()}}
+	for i, part := range parts {
+		vps = append(vps, kvp.ValuePair{Key: KeyPrefix + strconv.Itoa(i), Value: part})
+	}
+	return vps
+}
+
+func headerPairs(t *testing.T, value string) kvp.ValuePairs {
+	var vps kvp.ValuePairs
+	h, err := ginsu.Split(strings.NewReader(value), ginsu.Options{Codec: ginsu.CodecGzip, PartSize: 8}, func(i int, part string) error {
+		vps = append(vps, kvp.ValuePair{Key: KeyPrefix + strconv.Itoa(i), Value: part})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(vps, kvp.ValuePair{Key: KeyPrefix + ginsu.HeaderSuffix, Value: h.String()})
+}
+
+func TestFetch(t *testing.T) {
+	partial := manifestPairs(config[:10], config[10:])[:2]
+	tests := []struct {
+		name  string
+		pools []kvp.ValuePairs
+	}{
+		{name: "plain", pools: []kvp.ValuePairs{{{Key: KeyPrefix + "0", Value: config}}}},
+		{name: "manifest", pools: []kvp.ValuePairs{manifestPairs(config[:10], config[10:])}},
+		{name: "header", pools: []kvp.ValuePairs{headerPairs(t, config)}},
+		{name: "wait for host", pools: []kvp.ValuePairs{nil, partial, manifestPairs(config[:10], config[10:])}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			got, err := provider(tt.pools...).Fetch(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != config {
+				t.Errorf("got %q", got)
+			}
+		})
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	header := headerPairs(t, config)
+	tests := []struct {
+		name string
+		vps  kvp.ValuePairs
+		want error
+	}{
+		{name: "missing", want: ErrNotFound},
+		{name: "partial", vps: manifestPairs(config[:10], config[10:])[:2], want: ErrIncomplete},
+		{name: "invalid", vps: kvp.ValuePairs{{Key: KeyPrefix + "0", Value: "{"}}, want: ErrInvalidConfig},
+		{name: "missing chunk", vps: header[1:], want: ErrIncomplete},
+		{name: "not json", vps: headerPairs(t, "ignition"), want: ErrInvalidConfig},
+		{name: "too many parts", vps: kvp.ValuePairs{{Key: KeyPrefix + ginsu.HeaderSuffix, Value: strings.Replace(header[len(header)-1].Value, "parts=", "parts=1000000000", 1)}}, want: ErrIncomplete},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			_, err := provider(tt.vps).Fetch(ctx)
+			if !errors.Is(err, tt.want) || !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	var chunkErr *ChunkError
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := provider(header[1:]).Fetch(ctx); !errors.As(err, &chunkErr) || chunkErr.Key != KeyPrefix+"0" {
+		t.Errorf("got %v, want a chunk error for part 0", err)
+	}
+
+	readErr := errors.New("device busy")
+	p := NewProvider()
+	p.Read = func() (kvp.KeyValuePair, error) { return nil, readErr }
+	if _, err := p.Fetch(context.Background()); !errors.Is(err, readErr) {
+		t.Errorf("got %v, want the read error", err)
+	}
+}
@@ -0,0 +1,177 @@
+//go:build linux
+
+package kvp
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ErrAdapterNotFound means no network interface matches the adapter the host
+// asked about
+var ErrAdapterNotFound = errors.New("unable to find network adapter")
+
+// IPConfig is the network configuration of a guest adapter as exchanged
+// with the host through the ip info operations
+type IPConfig struct {
+	// AdapterID is the MAC address the host uses to identify the adapter
+	AdapterID string
+	// AddressFamily is a combination of the AddrFamily flags
+	AddressFamily uint8
+	DHCPEnabled   bool
+	IPAddresses   []string
+	// Subnets holds one netmask (IPv4) or prefix length (IPv6) per address
+	Subnets    []string
+	Gateways   []string
+	DNSServers []string
+}
+
+func (c *IPConfig) decode(v *hvKvpIPAddrValue) {
+	c.AdapterID = utf16String(v.adapterID[:])
+	c.AddressFamily = v.addrFamily
+	c.DHCPEnabled = v.dhcpEnabled != 0
+	c.IPAddresses = splitList(utf16String(v.ipAddr[:]))
+	c.Subnets = splitList(utf16String(v.subNet[:]))
+	c.Gateways = splitList(utf16String(v.gateWay[:]))
+	c.DNSServers = splitList(utf16String(v.dnsAddr[:]))
+}
+
+func (c *IPConfig) encode(v *hvKvpIPAddrValue) {
+	putUTF16String(v.adapterID[:], c.AdapterID)
+	v.addrFamily = c.AddressFamily
+	v.dhcpEnabled = 0
+	if c.DHCPEnabled {
+		v.dhcpEnabled = 1
+	}
+	putUTF16String(v.ipAddr[:], strings.Join(c.IPAddresses, ";"))
+	putUTF16String(v.subNet[:], strings.Join(c.Subnets, ";"))
+	putUTF16String(v.gateWay[:], strings.Join(c.Gateways, ";"))
+	putUTF16String(v.dnsAddr[:], strings.Join(c.DNSServers, ";"))
+}
+
+// normalizeMAC allows comparing the MAC format of the host with the one of
+// the kernel
+func normalizeMAC(mac string) string {
+	return strings.ToLower(strings.ReplaceAll(mac, "-", ":"))
+}
+
+// LookupIPInfo reports the configuration of the interface matching the
+// adapter ID (a MAC address) sent by the host.  DHCP state cannot be
+// determined in a distribution independent way and is reported as disabled.
+func LookupIPInfo(adapterID string) (*IPConfig, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	want := normalizeMAC(adapterID)
+	for _, iface := range ifaces {
+		if normalizeMAC(iface.HardwareAddr.String()) != want {
+			continue
+		}
+
+		config := &IPConfig{AdapterID: adapterID}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipNet.IP.To4() != nil {
+				config.AddressFamily |= AddrFamilyIPv4
+				config.IPAddresses = append(config.IPAddresses, ipNet.IP.String())
+				config.Subnets = append(config.Subnets, net.IP(ipNet.Mask).String())
+			} else {
+				ones, _ := ipNet.Mask.Size()
+				config.AddressFamily |= AddrFamilyIPv6
+				config.IPAddresses = append(config.IPAddresses, ipNet.IP.String())
+				config.Subnets = append(config.Subnets, fmt.Sprintf("%d", ones))
+			}
+		}
+		config.Gateways = defaultGateways(iface.Name)
+		config.DNSServers = nameServers()
+		return config, nil
+	}
+	return nil, ErrAdapterNotFound
+}
+
+// guestAddresses lists the addresses of all non-loopback interfaces of the
+// given family, it backs the NetworkAddress intrinsic items
+func guestAddresses(ipv6 bool) string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	var ret []string
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() {
+			continue
+		}
+		if (ipNet.IP.To4() == nil) == ipv6 {
+			ret = append(ret, ipNet.IP.String())
+		}
+	}
+	return strings.Join(ret, ";")
+}
+
+// defaultGateways reads the default routes of an interface from procfs
+func defaultGateways(ifName string) []string {
+	var ret []string
+
+	// Iface Destination Gateway Flags ... (little endian hex)
+	forEachLine("/proc/net/route", func(fields []string) {
+		if len(fields) < 3 || fields[0] != ifName || fields[1] != "00000000" {
+			return
+		}
+		gw, err := hex.DecodeString(fields[2])
+		if err != nil || len(gw) != 4 {
+			return
+		}
+		ret = append(ret, net.IPv4(gw[3], gw[2], gw[1], gw[0]).String())
+	})
+
+	// Destination DestLen Source SourceLen NextHop Metric RefCnt Use Flags Iface
+	forEachLine("/proc/net/ipv6_route", func(fields []string) {
+		if len(fields) < 10 || fields[9] != ifName || fields[1] != "00" {
+			return
+		}
+		gw, err := hex.DecodeString(fields[4])
+		if err != nil || len(gw) != net.IPv6len || net.IP(gw).IsUnspecified() {
+			return
+		}
+		ret = append(ret, net.IP(gw).String())
+	})
+	return ret
+}
+
+// nameServers reads the name servers the guest resolver is configured with
+func nameServers() []string {
+	var ret []string
+	forEachLine("/etc/resolv.conf", func(fields []string) {
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			ret = append(ret, fields[1])
+		}
+	})
+	return ret
+}
+
+func forEachLine(path string, fn func(fields []string)) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fn(strings.Fields(scanner.Text()))
+	}
+}
@@ -6,103 +6,52 @@ import (
 	"errors"
 	"fmt"
 	"strings"
-	"unsafe"
 
-	"golang.org/x/sys/unix"
+	"github.com/containers/libhvee/pkg/kvp/ginsu"
 )
 
-// readKvpData reads all key-value pairs from the hyperv kernel device and creates
+// readKvpData reads all key-value pairs from the transport and creates
 // a map representation of them
-func readKvpData() (KeyValuePair, error) {
+func readKvpData(t Transport) (KeyValuePair, error) {
 	ret := make(KeyValuePair)
-	for i := 0; i < 5; i++ {
+	for i := 0; i < PoolCount; i++ {
 		// We need to seed the poolids
 		ret[PoolID(i)] = ValuePairs{}
 	}
-	kvp, err := unix.Open(KernelDevice, unix.O_RDWR|unix.O_CLOEXEC|unix.O_NONBLOCK, 0)
-	if err != nil {
-		return nil, err
-	}
-	defer unix.Close(kvp)
 
-	var (
-		hvMsg    hvKvpMsg
-		hvMsgRet hvKvpMsgRet
-	)
-
-	const sizeOf = int(unsafe.Sizeof(hvMsg))
-
-	var (
-		asByteSlice    = (*(*[sizeOf]byte)(unsafe.Pointer(&hvMsg)))[:]
-		retAsByteSlice = (*(*[sizeOf]byte)(unsafe.Pointer(&hvMsgRet)))[:]
-	)
-
-	hvMsg.kvpHdr.operation = OpRegister1
-
-	l, err := unix.Write(kvp, asByteSlice)
-	if err != nil {
+	if err := register(t); err != nil {
 		return nil, err
 	}
-	if l != sizeOf {
-		return nil, ErrUnableToWriteToKVP
-	}
 
-next:
+	var hvMsg hvKvpMsg
 	for {
-		var pfd unix.PollFd
-		pfd.Fd = int32(kvp)
-		pfd.Events = unix.POLLIN
-		pfd.Revents = 0
-
-		howMany, err := unix.Poll([]unix.PollFd{pfd}, Timeout)
+		ok, err := nextMessage(t, Timeout, &hvMsg)
 		if err != nil {
-			// loop on retryable errors
-			if err == unix.EINTR {
-				continue
-			}
 			return nil, err
 		}
-
-		if howMany == 0 {
+		if !ok {
 			return ret, nil
 		}
 
-		l, err := unix.Read(kvp, asByteSlice)
-		if err != nil {
-			// loop on retryable errors
-			if err == unix.EAGAIN || err == unix.EINTR || err == unix.EWOULDBLOCK {
-				continue
-			}
-			return nil, err
-		}
-		if l != sizeOf {
-			return nil, ErrUnableToReadFromKVP
-		}
-
 		switch hvMsg.kvpHdr.operation {
 		case OpRegister1:
-			continue next
+			continue
 		case OpSet:
-			// on the next two variables, we are cutting the last byte because otherwise
-			// it is padded and key lookups fail
-			key := hvMsg.kvpSet.data.key[:hvMsg.kvpSet.data.keySize-1]
-			value := hvMsg.kvpSet.data.value[:hvMsg.kvpSet.data.valueSize-1]
+			data := &hvMsg.kvpSet.data
+			key := cString(data.key[:], data.keySize)
+			value := cString(data.value[:], data.valueSize)
 
 			poolID := PoolID(hvMsg.kvpHdr.pool)
-			ret.append(poolID, string(key), string(value))
+			ret.append(poolID, key, value)
 
-			hvMsgRet.error = HvSOk
+			hvMsg.setError(HvSOk)
 		default:
-			hvMsgRet.error = HvEFail
+			hvMsg.setError(HvEFail)
 		}
 
-		l, err = unix.Write(kvp, retAsByteSlice)
-		if err != nil {
+		if err := writeMessage(t, &hvMsg); err != nil {
 			return nil, err
 		}
-		if l != sizeOf {
-			return nil, ErrUnableToWriteToKVP
-		}
 	}
 }
 
@@ -110,11 +59,24 @@ next:
 // and returns them in map form.  the map value is a ValuePair which contains
 // the value string and the poolid
 func GetKeyValuePairs() (KeyValuePair, error) {
-	return readKvpData()
+	t, err := OpenKernelTransport(KernelDevice)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+	return readKvpData(t)
+}
+
+// ReadKeyValuePairs is like GetKeyValuePairs but reads from the given
+// transport, e.g. a Simulator
+func ReadKeyValuePairs(t Transport) (KeyValuePair, error) {
+	return readKvpData(t)
 }
 
 // GetSplitKeyValues reassembles split KVPs from a key prefix and pool_id and
-// returns the assembled split value.
+// returns the assembled split value.  If the host stored a manifest next to
+// the parts, a partial or mismatched value is rejected with an error
+// wrapping ErrSplitValueMismatch.
 func (kv KeyValuePair) GetSplitKeyValues(key string, pool PoolID) (string, error) {
 	var (
 		parts   []string
@@ -142,5 +104,14 @@ func (kv KeyValuePair) GetSplitKeyValues(key string, pool PoolID) (string, error
 	if len(parts) < 1 {
 		return "", ErrNoKeyValuePairsFound
 	}
+	if entry, err := kv[pool].GetValueByKey(key + ginsu.ManifestSuffix); err == nil {
+		manifest, err := ginsu.ParseManifest(entry.Value)
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", ErrSplitValueMismatch, err)
+		}
+		if err := manifest.Verify(parts); err != nil {
+			return "", fmt.Errorf("%w: %w", ErrSplitValueMismatch, err)
+		}
+	}
 	return strings.Join(parts, ""), nil
 }
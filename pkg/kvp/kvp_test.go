@@ -0,0 +1,66 @@
+//go:build linux
+
+package kvp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/containers/libhvee/pkg/kvp/ginsu"
+)
+
+func TestGetSplitKeyValues(t *testing.T) {
+	const prefix = "ignition.config."
+	parts := []string{`{"ignition":`, `{"version":"3.4.0"}}`}
+	manifest := ValuePair{Key: prefix + ginsu.ManifestSuffix, Value: ginsu.NewManifest(parts).String()}
+
+	tests := []struct {
+		name string
+		vps  ValuePairs
+		want string
+		err  error
+	}{
+		{
+			name: "no manifest",
+			vps:  ValuePairs{{prefix + "0", parts[0]}, {prefix + "1", parts[1]}},
+			want: parts[0] + parts[1],
+		},
+		{
+			name: "manifest",
+			vps:  ValuePairs{manifest, {prefix + "1", parts[1]}, {prefix + "0", parts[0]}},
+			want: parts[0] + parts[1],
+		},
+		{
+			name: "partial",
+			vps:  ValuePairs{manifest, {prefix + "0", parts[0]}},
+			err:  ErrSplitValueMismatch,
+		},
+		{
+			name: "stale chunk",
+			vps:  ValuePairs{manifest, {prefix + "0", parts[0]}, {prefix + "1", parts[1]}, {prefix + "2", "}"}},
+			err:  ErrSplitValueMismatch,
+		},
+		{
+			name: "mismatch",
+			vps:  ValuePairs{manifest, {prefix + "0", parts[0]}, {prefix + "1", `{}}`}},
+			err:  ErrSplitValueMismatch,
+		},
+		{
+			name: "missing",
+			vps:  ValuePairs{manifest},
+			err:  ErrNoKeyValuePairsFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := KeyValuePair{DefaultKVPPoolID: tt.vps}
+			got, err := kv.GetSplitKeyValues(prefix, DefaultKVPPoolID)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+//go:build linux
+
+package kvp
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf16"
+	"unsafe"
+)
+
+// hvKvpMsgSize is the size of a single message exchanged with the kernel
+const hvKvpMsgSize = int(unsafe.Sizeof(hvKvpMsg{}))
+
+// bytes returns the raw wire representation of the message
+func (m *hvKvpMsg) bytes() []byte {
+	return (*(*[hvKvpMsgSize]byte)(unsafe.Pointer(m)))[:]
+}
+
+// The body of a message is a union in the kernel, so each operation gets a
+// typed view over the same memory
+
+func (m *hvKvpMsg) get() *hvKvpMsgGet {
+	return (*hvKvpMsgGet)(unsafe.Pointer(&m.kvpSet))
+}
+
+func (m *hvKvpMsg) delete() *hvKvpMsgDelete {
+	return (*hvKvpMsgDelete)(unsafe.Pointer(&m.kvpSet))
+}
+
+func (m *hvKvpMsg) enumerate() *hvKvpMsgEnumerate {
+	return (*hvKvpMsgEnumerate)(unsafe.Pointer(&m.kvpSet))
+}
+
+func (m *hvKvpMsg) register() *hvKvpRegister {
+	return (*hvKvpRegister)(unsafe.Pointer(&m.kvpSet))
+}
+
+func (m *hvKvpMsg) ipAddrValue() *hvKvpIPAddrValue {
+	return (*hvKvpIPAddrValue)(unsafe.Pointer(&m.kvpSet))
+}
+
+// setError turns the message into a reply; the header and the error code
+// share the same memory
+func (m *hvKvpMsg) setError(code uint32) {
+	(*hvKvpMsgRet)(unsafe.Pointer(m)).error = code
+}
+
+// errorCode returns the result of a reply
+func (m *hvKvpMsg) errorCode() uint32 {
+	return (*hvKvpMsgRet)(unsafe.Pointer(m)).error
+}
+
+// cString reads a NUL terminated string limited to size bytes
+func cString(b []byte, size uint32) string {
+	if int(size) < len(b) {
+		b = b[:size]
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// putCString writes s as a NUL terminated string, truncating it if needed,
+// and returns the number of bytes used including the terminator
+func putCString(dst []byte, s string) uint32 {
+	n := copy(dst[:len(dst)-1], s)
+	clear(dst[n:])
+	return uint32(n + 1)
+}
+
+// utf16String reads a NUL terminated UTF-16 string
+func utf16String(u []uint16) string {
+	for i, c := range u {
+		if c == 0 {
+			u = u[:i]
+			break
+		}
+	}
+	return string(utf16.Decode(u))
+}
+
+// putUTF16String writes s as a NUL terminated UTF-16 string, truncating it
+// if needed
+func putUTF16String(dst []uint16, s string) {
+	n := copy(dst[:len(dst)-1], utf16.Encode([]rune(s)))
+	clear(dst[n:])
+}
+
+// splitList splits the semicolon separated lists used by ip info messages
+func splitList(s string) []string {
+	var ret []string
+	for _, item := range strings.Split(s, ";") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,111 @@
+//go:build linux
+
+package kvp
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Indexes of the intrinsic items the host enumerates from PoolAuto
+const (
+	FullyQualifiedDomainName = iota
+	IntegrationServicesVersion
+	NetworkAddressIPv4
+	NetworkAddressIPv6
+	OSBuildNumber
+	OSName
+	OSMajorVersion
+	OSMinorVersion
+	OSVersion
+	ProcessorArchitecture
+)
+
+// osInfo holds the operating system details reported to the host, they are
+// gathered once when the daemon starts, the same way hv_kvp_daemon does
+type osInfo struct {
+	domainName   string
+	name         string
+	majorVersion string
+	minorVersion string
+	version      string
+	build        string
+	architecture string
+}
+
+func getOSInfo() osInfo {
+	info := osInfo{domainName: domainName()}
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err == nil {
+		info.name = unix.ByteSliceToString(uts.Sysname[:])
+		info.build = unix.ByteSliceToString(uts.Release[:])
+		info.architecture = unix.ByteSliceToString(uts.Machine[:])
+		// The host expects the version to be of the form x.y.z
+		info.version, _, _ = strings.Cut(info.build, "-")
+	}
+
+	forEachLine("/etc/os-release", func(fields []string) {
+		if len(fields) == 0 {
+			return
+		}
+		key, value, ok := strings.Cut(strings.Join(fields, " "), "=")
+		if !ok {
+			return
+		}
+		value = strings.Trim(value, `"'`)
+		switch key {
+		case "NAME":
+			info.name = value
+		case "VERSION_ID":
+			info.majorVersion, info.minorVersion, _ = strings.Cut(value, ".")
+		}
+	})
+	return info
+}
+
+// domainName returns the canonical name of the guest, it can wait on a DNS
+// lookup
+func domainName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	if strings.Contains(hostname, ".") {
+		return hostname
+	}
+	if cname, err := net.LookupCNAME(hostname); err == nil {
+		return strings.TrimSuffix(cname, ".")
+	}
+	return hostname
+}
+
+// intrinsicItem generates the key and value of an item of PoolAuto, it
+// reports false once the index is past the last item
+func (d *Daemon) intrinsicItem(index uint32) (string, string, bool) {
+	switch index {
+	case FullyQualifiedDomainName:
+		return "FullyQualifiedDomainName", d.osInfo.domainName, true
+	case IntegrationServicesVersion:
+		return "IntegrationServicesVersion", d.version, true
+	case NetworkAddressIPv4:
+		return "NetworkAddressIPv4", guestAddresses(false), true
+	case NetworkAddressIPv6:
+		return "NetworkAddressIPv6", guestAddresses(true), true
+	case OSBuildNumber:
+		return "OSBuildNumber", d.osInfo.build, true
+	case OSName:
+		return "OSName", d.osInfo.name, true
+	case OSMajorVersion:
+		return "OSMajorVersion", d.osInfo.majorVersion, true
+	case OSMinorVersion:
+		return "OSMinorVersion", d.osInfo.minorVersion, true
+	case OSVersion:
+		return "OSVersion", d.osInfo.version, true
+	case ProcessorArchitecture:
+		return "ProcessorArchitecture", d.osInfo.architecture, true
+	}
+	return "", "", false
+}
@@ -0,0 +1,305 @@
+//go:build linux
+
+package kvp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// poolRecordSize is the size of a single key-value record in a pool file
+const poolRecordSize = HvKvpExchangeMaxKeySize + HvKvpExchangeMaxValueSize
+
+// poolFile caches the records of a single .kvp_pool_N file.  Access to the
+// file is serialized with fcntl record locks, which conflict with the ones
+// hv_kvp_daemon uses so that other writers see a consistent file.
+type poolFile struct {
+	path    string
+	records ValuePairs
+}
+
+func newPoolFile(dir string, poolID PoolID) *poolFile {
+	return &poolFile{path: filepath.Join(dir, fmt.Sprintf("%s%d", DefaultKVPBaseName, poolID))}
+}
+
+// lockFile takes a read or write lock on the whole file, waiting for other
+// holders to release it.  The lock belongs to the open file rather than the
+// process, so goroutines that open the file separately exclude each other
+// and closing another descriptor of the file does not drop it.  These locks
+// still conflict with the process locks of hv_kvp_daemon.
+func lockFile(f *os.File, lockType int16) error {
+	lk := unix.Flock_t{Type: lockType, Whence: io.SeekStart}
+	for {
+		err := unix.FcntlFlock(f.Fd(), unix.F_OFD_SETLKW, &lk)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+func unlockFile(f *os.File) error {
+	lk := unix.Flock_t{Type: unix.F_UNLCK, Whence: io.SeekStart}
+	return unix.FcntlFlock(f.Fd(), unix.F_OFD_SETLK, &lk)
+}
+
+func (p *poolFile) open() (*os.File, error) {
+	return os.OpenFile(p.path, os.O_RDWR|os.O_CREATE, DefaultKVPFileWritePermissions)
+}
+
+func (p *poolFile) read(f *os.File) error {
+	_, err := p.readData(f)
+	return err
+}
+
+// readData decodes the records of the file and returns its raw content
+func (p *poolFile) readData(f *os.File) ([]byte, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	p.records = decodeRecords(data)
+	return data, nil
+}
+
+// load reads the pool file, creating it if it does not exist yet.  Other
+// writers can change the file at any time, so it is read again under the
+// lock whenever the host reads a pool.
+func (p *poolFile) load() error {
+	f, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f, unix.F_RDLCK); err != nil {
+		return err
+	}
+	defer unlockFile(f) //nolint:errcheck
+
+	return p.read(f)
+}
+
+// modify applies fn to the current content of the pool file and writes the
+// result back while holding the write lock, so concurrent updates are not
+// lost.  The file is updated in place, readers like hv_kvp_daemon keep
+// their lock on it, so only the records from the first changed one on are
+// written and the file is shortened only once that write succeeded.  A
+// failed update leaves the records before the change untouched.
+func (p *poolFile) modify(fn func(ValuePairs) (ValuePairs, error)) error {
+	f, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f, unix.F_WRLCK); err != nil {
+		return err
+	}
+	defer unlockFile(f) //nolint:errcheck
+
+	data, err := p.readData(f)
+	if err != nil {
+		return err
+	}
+
+	records, err := fn(p.records)
+	if err != nil {
+		return err
+	}
+
+	encoded := records.encode()
+	off := changedRecord(data, encoded)
+	if off < len(encoded) {
+		if _, err := f.WriteAt(encoded[off:], int64(off)); err != nil {
+			return err
+		}
+	}
+	if len(encoded) < len(data) {
+		if err := f.Truncate(int64(len(encoded))); err != nil {
+			return err
+		}
+	}
+	p.records = records
+	return nil
+}
+
+// changedRecord returns the offset of the first record that differs
+// between the old and the new content of a pool file
+func changedRecord(old, updated []byte) int {
+	off := 0
+	for off+poolRecordSize <= min(len(old), len(updated)) &&
+		bytes.Equal(old[off:off+poolRecordSize], updated[off:off+poolRecordSize]) {
+		off += poolRecordSize
+	}
+	return off
+}
+
+func (p *poolFile) get(key string) (ValuePair, error) {
+	return p.records.GetValueByKey(key)
+}
+
+// set adds the key or replaces the value of an existing one
+func (p *poolFile) set(key, value string) error {
+	return p.modify(func(vps ValuePairs) (ValuePairs, error) {
+		vps, _, _ = vps.set(key, value)
+		return vps, nil
+	})
+}
+
+func (p *poolFile) delete(key string) error {
+	return p.modify(func(vps ValuePairs) (ValuePairs, error) {
+		vps, _, found := vps.remove(key)
+		if !found {
+			return nil, ErrKeyNotFound
+		}
+		return vps, nil
+	})
+}
+
+// set adds the key or replaces the value of an existing one, returning the
+// previous value if there was one
+func (vp ValuePairs) set(key, value string) (ValuePairs, string, bool) {
+	for i := range vp {
+		if vp[i].Key == key {
+			old := vp[i].Value
+			vp[i].Value = value
+			return vp, old, true
+		}
+	}
+	return append(vp, ValuePair{Key: key, Value: value}), "", false
+}
+
+// remove deletes the key, returning the value it had
+func (vp ValuePairs) remove(key string) (ValuePairs, string, bool) {
+	for i := range vp {
+		if vp[i].Key == key {
+			old := vp[i].Value
+			return append(vp[:i], vp[i+1:]...), old, true
+		}
+	}
+	return vp, "", false
+}
+
+// encode serializes the pairs in the fixed size record format of the pool
+// files
+func (vp ValuePairs) encode() (poolFile []byte) {
+	for _, entry := range vp {
+		// These have to be padded with nulls
+		emptyKey := make([]byte, HvKvpExchangeMaxKeySize)
+		emptyVal := make([]byte, HvKvpExchangeMaxValueSize)
+		_ = copy(emptyKey, entry.Key)
+		_ = copy(emptyVal, entry.Value)
+		poolFile = append(poolFile, emptyKey...)
+		poolFile = append(poolFile, emptyVal...)
+	}
+	return
+}
+
+// decodeRecords parses the fixed size records of a pool file, a trailing
+// partial record is ignored like hv_kvp_daemon does
+func decodeRecords(data []byte) ValuePairs {
+	var vps ValuePairs
+	for len(data) >= poolRecordSize {
+		key := data[:HvKvpExchangeMaxKeySize]
+		value := data[HvKvpExchangeMaxKeySize:poolRecordSize]
+		data = data[poolRecordSize:]
+		if i := bytes.IndexByte(key, 0); i >= 0 {
+			key = key[:i]
+		}
+		if len(key) == 0 {
+			continue
+		}
+		vps = append(vps, ValuePair{Key: string(key), Value: cString(value, HvKvpExchangeMaxValueSize)})
+	}
+	return vps
+}
+
+// decodeRecord parses a single key-value record
+func decodeRecord(record []byte) (ValuePair, error) {
+	key := record[:HvKvpExchangeMaxKeySize]
+	value := record[HvKvpExchangeMaxKeySize:]
+	k := bytes.IndexByte(key, 0)
+	if k < 0 {
+		return ValuePair{}, fmt.Errorf("key is not terminated: %w", ErrCorruptRecord)
+	}
+	if k == 0 {
+		return ValuePair{}, fmt.Errorf("key is empty: %w", ErrCorruptRecord)
+	}
+	v := bytes.IndexByte(value, 0)
+	if v < 0 {
+		return ValuePair{}, fmt.Errorf("value is not terminated: %w", ErrCorruptRecord)
+	}
+	return ValuePair{Key: string(key[:k]), Value: string(value[:v])}, nil
+}
+
+// DecodePoolFile parses the content of a .kvp_pool_N file.  Unlike
+// hv_kvp_daemon it does not skip damaged data, a partial trailing record
+// or a record without a valid key or value is reported as a *PoolFileError.
+func DecodePoolFile(data []byte) (ValuePairs, error) {
+	var vps ValuePairs
+	for i := 0; len(data) > 0; i++ {
+		if len(data) < poolRecordSize {
+			return vps, &PoolFileError{Record: i, Err: fmt.Errorf("%d of %d bytes: %w", len(data), poolRecordSize, ErrTruncatedPoolFile)}
+		}
+		vp, err := decodeRecord(data[:poolRecordSize])
+		if err != nil {
+			return vps, &PoolFileError{Record: i, Err: err}
+		}
+		vps = append(vps, vp)
+		data = data[poolRecordSize:]
+	}
+	return vps, nil
+}
+
+// ReadPoolFile reads and decodes a single pool file while holding a read
+// lock on it, so a daemon updating the file at the same time is waited for
+func ReadPoolFile(path string) (ValuePairs, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := lockFile(f, unix.F_RDLCK); err != nil {
+		return nil, err
+	}
+	defer unlockFile(f) //nolint:errcheck
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	vps, err := DecodePoolFile(data)
+	var poolErr *PoolFileError
+	if errors.As(err, &poolErr) {
+		poolErr.Path = path
+	}
+	return vps, err
+}
+
+// ReadFromFS reads the pool files a kvp daemon stored in path, the
+// counterpart of WriteToFS.  Pools without a file are left out.
+func ReadFromFS(path string) (KeyValuePair, error) {
+	kv := make(KeyValuePair)
+	for poolID := PoolID(0); poolID < PoolCount; poolID++ {
+		vps, err := ReadPoolFile(filepath.Join(path, fmt.Sprintf("%s%d", DefaultKVPBaseName, poolID)))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+		kv[poolID] = vps
+	}
+	return kv, nil
+}
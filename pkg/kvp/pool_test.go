@@ -0,0 +1,147 @@
+//go:build linux
+
+package kvp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDecodePoolFile(t *testing.T) {
+	valid := ValuePairs{{Key: "a", Value: "1"}, {Key: "b", Value: ""}}
+
+	unterminatedKey := valid.encode()
+	for i := range HvKvpExchangeMaxKeySize {
+		unterminatedKey[poolRecordSize+i] = 'k'
+	}
+	unterminatedValue := valid.encode()
+	for i := HvKvpExchangeMaxKeySize; i < poolRecordSize; i++ {
+		unterminatedValue[i] = 'v'
+	}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		want   ValuePairs
+		err    error
+		record int
+	}{
+		{name: "empty", data: nil},
+		{name: "valid", data: valid.encode(), want: valid},
+		{name: "truncated", data: valid.encode()[:poolRecordSize+10], want: valid[:1], err: ErrTruncatedPoolFile, record: 1},
+		{name: "empty key", data: make([]byte, poolRecordSize), err: ErrCorruptRecord},
+		{name: "unterminated key", data: unterminatedKey, want: valid[:1], err: ErrCorruptRecord, record: 1},
+		{name: "unterminated value", data: unterminatedValue, err: ErrCorruptRecord},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodePoolFile(tt.data)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if tt.err == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var poolErr *PoolFileError
+			if !errors.Is(err, tt.err) || !errors.As(err, &poolErr) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if poolErr.Record != tt.record {
+				t.Errorf("error is for record %d, want %d", poolErr.Record, tt.record)
+			}
+		})
+	}
+}
+
+func TestReadFromFS(t *testing.T) {
+	dir := t.TempDir()
+	kv := KeyValuePair{
+		PoolExternal: {{Key: "ignition.config.0", Value: "{}"}},
+		PoolGuest:    {{Key: "a", Value: "1"}, {Key: "b", Value: "2"}},
+	}
+	if err := kv.WriteToFS(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadFromFS(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, kv) {
+		t.Errorf("got %v, want %v", got, kv)
+	}
+
+	path := filepath.Join(dir, ".kvp_pool_1")
+	if err := os.Truncate(path, poolRecordSize+1); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadFromFS(dir)
+	var poolErr *PoolFileError
+	if !errors.As(err, &poolErr) || poolErr.Path != path || !errors.Is(err, ErrTruncatedPoolFile) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestPoolModifyInPlace(t *testing.T) {
+	dir := t.TempDir()
+	pool := newPoolFile(dir, PoolGuest)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := pool.set(key, key+"1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := os.Stat(pool.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pool.set("b", "b2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.delete("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.Stat(pool.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("pool file was replaced instead of updated in place")
+	}
+	vps, err := ReadPoolFile(pool.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ValuePairs{{"b", "b2"}, {"c", "c1"}}); !reflect.DeepEqual(vps, want) {
+		t.Errorf("got %v, want %v", vps, want)
+	}
+}
+
+func TestChangedRecord(t *testing.T) {
+	records := ValuePairs{{"a", "1"}, {"b", "2"}, {"c", "3"}}
+	tests := []struct {
+		name    string
+		updated ValuePairs
+		want    int
+	}{
+		{name: "unchanged", updated: records, want: 3 * poolRecordSize},
+		{name: "appended", updated: append(records[:3:3], ValuePair{"d", "4"}), want: 3 * poolRecordSize},
+		{name: "value changed", updated: ValuePairs{{"a", "1"}, {"b", "x"}, {"c", "3"}}, want: poolRecordSize},
+		{name: "first removed", updated: records[1:], want: 0},
+		{name: "last removed", updated: records[:2], want: 2 * poolRecordSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := changedRecord(records.encode(), tt.updated.encode()); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+//go:build linux
+
+package kvp
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	// ErrPoolNotWritable means the pool is owned by the host or generated by
+	// the daemon, so the guest cannot publish to it
+	ErrPoolNotWritable = errors.New("kvp pool is not writable by the guest")
+	// ErrInvalidKey means the key is empty or too long for a record
+	ErrInvalidKey = errors.New("invalid kvp key")
+	// ErrValueTooLong means the value does not fit in a record
+	ErrValueTooLong = errors.New("kvp value too long")
+)
+
+// Publish stores a key-value pair in one of the guest pools, PoolGuest or
+// PoolAutoInternal, for the host to read.  The pool file is rewritten while
+// holding its write lock, so a running kvp daemon (this package's or
+// hv_kvp_daemon) serves either the old or the new content to the host.
+func Publish(pool PoolID, key, value string) error {
+	return publish(DefaultKVPFilePath, pool, key, value)
+}
+
+// Delete removes a key previously published to a guest pool, it returns
+// ErrKeyNotFound if the key does not exist
+func Delete(pool PoolID, key string) error {
+	return unpublish(DefaultKVPFilePath, pool, key)
+}
+
+func checkGuestPool(pool PoolID, key string) error {
+	if pool != PoolGuest && pool != PoolAutoInternal {
+		return fmt.Errorf("pool %d: %w", pool, ErrPoolNotWritable)
+	}
+	// The records keep a terminating NUL
+	if key == "" || len(key) >= HvKvpExchangeMaxKeySize {
+		return fmt.Errorf("key %q: %w", key, ErrInvalidKey)
+	}
+	return nil
+}
+
+func publish(dir string, pool PoolID, key, value string) error {
+	if err := checkGuestPool(pool, key); err != nil {
+		return err
+	}
+	if len(value) >= HvKvpExchangeMaxValueSize {
+		return fmt.Errorf("key %q: %d bytes: %w", key, len(value), ErrValueTooLong)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return newPoolFile(dir, pool).set(key, value)
+}
+
+func unpublish(dir string, pool PoolID, key string) error {
+	if err := checkGuestPool(pool, key); err != nil {
+		return err
+	}
+	if err := newPoolFile(dir, pool).delete(key); err != nil {
+		return fmt.Errorf("key %q: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+//go:build linux
+
+package kvp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPublish(t *testing.T) {
+	sim := NewSimulator()
+	d := NewDaemon()
+	d.PoolPath = t.TempDir()
+	d.Transport = sim.Transport()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+	if err := sim.Register(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, vp := range []ValuePair{{"ready", "false"}, {"version", "1.0"}, {"ready", "true"}} {
+		if err := publish(d.PoolPath, PoolGuest, vp.Key, vp.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := publish(d.PoolPath, PoolAutoInternal, "internal", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	vps, err := sim.Enumerate(PoolGuest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ValuePairs{{"ready", "true"}, {"version", "1.0"}}); !reflect.DeepEqual(vps, want) {
+		t.Errorf("host sees %v, want %v", vps, want)
+	}
+	if v, err := sim.Get(PoolAutoInternal, "internal"); err != nil || v != "x" {
+		t.Errorf("get returned %q, %v", v, err)
+	}
+
+	if err := unpublish(d.PoolPath, PoolGuest, "ready"); err != nil {
+		t.Fatal(err)
+	}
+	if err := unpublish(d.PoolPath, PoolGuest, "ready"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("second delete returned %v", err)
+	}
+	vps, err = sim.Enumerate(PoolGuest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ValuePairs{{"version", "1.0"}}); !reflect.DeepEqual(vps, want) {
+		t.Errorf("host sees %v after delete, want %v", vps, want)
+	}
+}
+
+func TestPublishConcurrent(t *testing.T) {
+	const (
+		writers = 8
+		keys    = 20
+	)
+	dir := t.TempDir()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range keys {
+				if err := publish(dir, PoolGuest, fmt.Sprintf("w%d-k%d", w, k), "v"); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	vps, err := ReadPoolFile(filepath.Join(dir, fmt.Sprintf("%s%d", DefaultKVPBaseName, PoolGuest)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vps) != writers*keys {
+		t.Fatalf("pool has %d records, want %d", len(vps), writers*keys)
+	}
+	for w := range writers {
+		for k := range keys {
+			if _, err := vps.GetValueByKey(fmt.Sprintf("w%d-k%d", w, k)); err != nil {
+				t.Errorf("w%d-k%d: %v", w, k, err)
+			}
+		}
+	}
+}
+
+func TestPublishInvalid(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name  string
+		pool  PoolID
+		key   string
+		value string
+		err   error
+	}{
+		{name: "host pool", pool: PoolExternal, key: "a", err: ErrPoolNotWritable},
+		{name: "auto pool", pool: PoolAuto, key: "a", err: ErrPoolNotWritable},
+		{name: "empty key", pool: PoolGuest, err: ErrInvalidKey},
+		{name: "long key", pool: PoolGuest, key: strings.Repeat("k", HvKvpExchangeMaxKeySize), err: ErrInvalidKey},
+		{name: "long value", pool: PoolGuest, key: "a", value: strings.Repeat("v", HvKvpExchangeMaxValueSize), err: ErrValueTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := publish(dir, tt.pool, tt.key, tt.value); !errors.Is(err, tt.err) {
+				t.Errorf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
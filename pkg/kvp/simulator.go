@@ -0,0 +1,195 @@
+//go:build linux
+
+package kvp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/containers/libhvee/pkg/hvutils"
+)
+
+var (
+	// ErrTransportClosed is returned once either side of a simulated
+	// transport was closed
+	ErrTransportClosed = hvutils.ErrTransportClosed
+	// ErrNoReply means the guest did not answer a simulated request in time
+	ErrNoReply = hvutils.ErrNoReply
+)
+
+// StatusError is returned when the guest answers a request with a
+// failure code
+type StatusError struct {
+	Operation uint8
+	Code      uint32
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("hv_kvp operation %d failed with status %#x", e.Operation, e.Code)
+}
+
+// Simulator plays the kernel side of the hv_kvp device in process.  It
+// speaks the same wire format as the kernel, so any guest logic that runs
+// on a Transport can be exercised without a Hyper-V guest.
+type Simulator struct {
+	// Version is sent to the guest when it registers
+	Version string
+	// ReplyTimeout bounds how long requests wait for the guest's answer
+	ReplyTimeout time.Duration
+
+	dev *hvutils.Simulator
+}
+
+// NewSimulator creates a simulator, the guest side is obtained with
+// Transport()
+func NewSimulator() *Simulator {
+	return &Simulator{
+		Version:      "3.1",
+		ReplyTimeout: 5 * time.Second,
+		dev:          hvutils.NewSimulator(),
+	}
+}
+
+// Transport returns the guest end of the simulated device
+func (s *Simulator) Transport() Transport {
+	return s.dev.Transport()
+}
+
+// Close shuts the simulated device down, the guest sees ErrTransportClosed
+func (s *Simulator) Close() {
+	s.dev.Close()
+}
+
+// send queues a message for the guest
+func (s *Simulator) send(msg *hvKvpMsg) error {
+	return s.dev.Send(msg.bytes())
+}
+
+// recv waits for the next message written by the guest
+func (s *Simulator) recv() (*hvKvpMsg, error) {
+	data, err := s.dev.Recv(s.ReplyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != hvKvpMsgSize {
+		return nil, fmt.Errorf("guest wrote %d bytes: %w", len(data), ErrUnableToReadFromKVP)
+	}
+	var msg hvKvpMsg
+	copy(msg.bytes(), data)
+	return &msg, nil
+}
+
+// request sends msg and checks the reply of the guest
+func (s *Simulator) request(msg *hvKvpMsg) (*hvKvpMsg, error) {
+	op := msg.kvpHdr.operation
+	if err := s.send(msg); err != nil {
+		return nil, err
+	}
+	reply, err := s.recv()
+	if err != nil {
+		return nil, err
+	}
+	if code := reply.errorCode(); code != HvSOk {
+		return reply, &StatusError{Operation: op, Code: code}
+	}
+	return reply, nil
+}
+
+func newRequest(op uint8, pool PoolID) *hvKvpMsg {
+	msg := &hvKvpMsg{}
+	msg.kvpHdr.operation = op
+	msg.kvpHdr.pool = uint8(pool)
+	return msg
+}
+
+// Register waits for the guest to register and completes the handshake
+func (s *Simulator) Register() error {
+	msg, err := s.recv()
+	if err != nil {
+		return err
+	}
+	if op := msg.kvpHdr.operation; op != OpRegister1 {
+		return fmt.Errorf("expected registration from guest, got operation %d", op)
+	}
+	reply := newRequest(OpRegister1, 0)
+	putCString(reply.register().version[:], s.Version)
+	return s.send(reply)
+}
+
+// Set sends a key-value pair to the guest like the host does when an item
+// is added or modified
+func (s *Simulator) Set(pool PoolID, key, value string) error {
+	msg := newRequest(OpSet, pool)
+	data := &msg.kvpSet.data
+	data.keySize = putCString(data.key[:], key)
+	data.valueSize = putCString(data.value[:], value)
+	_, err := s.request(msg)
+	return err
+}
+
+// Get asks the guest for the value of a key
+func (s *Simulator) Get(pool PoolID, key string) (string, error) {
+	msg := newRequest(OpGet, pool)
+	data := &msg.get().data
+	data.keySize = putCString(data.key[:], key)
+	reply, err := s.request(msg)
+	if err != nil {
+		return "", err
+	}
+	data = &reply.get().data
+	return cString(data.value[:], data.valueSize), nil
+}
+
+// Delete removes a key from the guest
+func (s *Simulator) Delete(pool PoolID, key string) error {
+	msg := newRequest(OpDelete, pool)
+	del := msg.delete()
+	del.keySize = putCString(del.key[:], key)
+	_, err := s.request(msg)
+	return err
+}
+
+// Enumerate reads a whole pool from the guest, one index at a time until
+// the guest reports there is nothing more
+func (s *Simulator) Enumerate(pool PoolID) (ValuePairs, error) {
+	var vps ValuePairs
+	for index := uint32(0); ; index++ {
+		msg := newRequest(OpEnumerate, pool)
+		msg.enumerate().index = index
+		reply, err := s.request(msg)
+		if err != nil {
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) && statusErr.Code == HvSCont {
+				return vps, nil
+			}
+			return vps, err
+		}
+		data := &reply.enumerate().data
+		vps = append(vps, ValuePair{
+			Key:   cString(data.key[:], data.keySize),
+			Value: cString(data.value[:], data.valueSize),
+		})
+	}
+}
+
+// GetIPInfo asks the guest for the configuration of an adapter
+func (s *Simulator) GetIPInfo(adapterID string) (*IPConfig, error) {
+	msg := newRequest(OpGetIPInfo, 0)
+	putUTF16String(msg.ipAddrValue().adapterID[:], adapterID)
+	reply, err := s.request(msg)
+	if err != nil {
+		return nil, err
+	}
+	config := &IPConfig{}
+	config.decode(reply.ipAddrValue())
+	return config, nil
+}
+
+// SetIPInfo pushes an adapter configuration to the guest
+func (s *Simulator) SetIPInfo(config *IPConfig) error {
+	msg := newRequest(OpSetIPInfo, 0)
+	config.encode(msg.ipAddrValue())
+	_, err := s.request(msg)
+	return err
+}
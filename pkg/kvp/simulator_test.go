@@ -0,0 +1,131 @@
+//go:build linux
+
+package kvp
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestReadKeyValuePairs(t *testing.T) {
+	sim := NewSimulator()
+	defer sim.Close()
+
+	type result struct {
+		kv  KeyValuePair
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		kv, err := ReadKeyValuePairs(sim.Transport())
+		done <- result{kv, err}
+	}()
+
+	if err := sim.Register(); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []ValuePair{{"ignition.config.0", "{\"ignition\":"}, {"ignition.config.1", "{}}"}} {
+		if err := sim.Set(DefaultKVPPoolID, item.Key, item.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sim.Set(PoolAutoExternal, "host", "value"); err != nil {
+		t.Fatal(err)
+	}
+	var statusErr *StatusError
+	if err := sim.Delete(DefaultKVPPoolID, "ignition.config.0"); !errors.As(err, &statusErr) || statusErr.Code != HvEFail {
+		t.Errorf("delete returned %v, want a failure status", err)
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if len(res.kv) != PoolCount {
+		t.Errorf("got %d pools, want %d", len(res.kv), PoolCount)
+	}
+	ign, err := res.kv.GetSplitKeyValues("ignition.config.", DefaultKVPPoolID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ign != "{\"ignition\":{}}" {
+		t.Errorf("reassembled %q", ign)
+	}
+	if vp, err := res.kv[PoolAutoExternal].GetValueByKey("host"); err != nil || vp.Value != "value" {
+		t.Errorf("pool 3 lookup returned %v, %v", vp, err)
+	}
+}
+
+func TestDaemonWithSimulator(t *testing.T) {
+	sim := NewSimulator()
+	d := NewDaemon()
+	d.PoolPath = t.TempDir()
+	d.Transport = sim.Transport()
+	d.SetIPInfo = func(config *IPConfig) error {
+		if config.AdapterID != "00-15-5D-00-00-01" {
+			return errors.New("unexpected adapter")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- d.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if err := sim.Register(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := ValuePairs{{"a", "1"}, {"b", "2"}}
+	for _, vp := range want {
+		if err := sim.Set(PoolGuest, vp.Key, vp.Value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sim.Set(PoolGuest, "a", "3"); err != nil {
+		t.Fatal(err)
+	}
+	want[0].Value = "3"
+
+	got, err := sim.Enumerate(PoolGuest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("enumerate returned %v, want %v", got, want)
+	}
+
+	if v, err := sim.Get(PoolGuest, "b"); err != nil || v != "2" {
+		t.Errorf("get returned %q, %v", v, err)
+	}
+	if err := sim.Delete(PoolGuest, "b"); err != nil {
+		t.Fatal(err)
+	}
+	var statusErr *StatusError
+	if _, err := sim.Get(PoolGuest, "b"); !errors.As(err, &statusErr) || statusErr.Code != HvSCont {
+		t.Errorf("get of a deleted key returned %v", err)
+	}
+
+	intrinsic, err := sim.Enumerate(PoolAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(intrinsic) != ProcessorArchitecture+1 || intrinsic[OSName].Key != "OSName" {
+		t.Errorf("unexpected intrinsic items %v", intrinsic)
+	}
+
+	if err := sim.SetIPInfo(&IPConfig{AdapterID: "00-15-5D-00-00-01"}); err != nil {
+		t.Error(err)
+	}
+	if err := sim.SetIPInfo(&IPConfig{AdapterID: "00-15-5D-00-00-02"}); !errors.As(err, &statusErr) || statusErr.Code != HvEFail {
+		t.Errorf("set ip info for an unknown adapter returned %v", err)
+	}
+}
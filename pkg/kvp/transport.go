@@ -0,0 +1,49 @@
+//go:build linux
+
+package kvp
+
+import (
+	"github.com/containers/libhvee/pkg/hvutils"
+)
+
+// Transport carries raw hv_kvp messages between the guest and the kernel
+type Transport = hvutils.Transport
+
+// OpenKernelTransport opens the hyperv kvp character device at path, which
+// is usually KernelDevice
+func OpenKernelTransport(path string) (Transport, error) {
+	return hvutils.OpenDevice(path)
+}
+
+// register announces the guest to the kernel, which answers with an
+// OpRegister1 message of its own
+func register(t Transport) error {
+	var msg hvKvpMsg
+	msg.kvpHdr.operation = OpRegister1
+	return writeMessage(t, &msg)
+}
+
+// nextMessage waits up to timeout milliseconds for a message and reads it
+// into msg.  It reports false if no message arrived in time.
+func nextMessage(t Transport, timeout int, msg *hvKvpMsg) (bool, error) {
+	*msg = hvKvpMsg{}
+	l, ok, err := hvutils.NextMessage(t, timeout, msg.bytes())
+	if err != nil || !ok {
+		return false, err
+	}
+	if l != hvKvpMsgSize {
+		return false, ErrUnableToReadFromKVP
+	}
+	return true, nil
+}
+
+func writeMessage(t Transport, msg *hvKvpMsg) error {
+	l, err := t.Write(msg.bytes())
+	if err != nil {
+		return err
+	}
+	if l != hvKvpMsgSize {
+		return ErrUnableToWriteToKVP
+	}
+	return nil
+}
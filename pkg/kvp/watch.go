@@ -0,0 +1,241 @@
+//go:build linux
+
+package kvp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// EventType describes how a key changed
+type EventType int
+
+const (
+	// EventAdd means the host created a new key
+	EventAdd EventType = iota
+	// EventModify means the host changed the value of an existing key
+	EventModify
+	// EventDelete means the host removed a key
+	EventDelete
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventAdd:
+		return "add"
+	case EventModify:
+		return "modify"
+	case EventDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("unknown (%d)", int(e))
+}
+
+// Event is a single change pushed by the host
+type Event struct {
+	Type EventType
+	Pool PoolID
+	Key  string
+	// Value is the new value, or the last known one for EventDelete
+	Value string
+}
+
+// Watcher delivers the changes the host makes to the key-value pairs of the
+// guest.  Events are queued until they are received, so a slow reader never
+// holds up the host.
+type Watcher struct {
+	events chan Event
+	err    error
+	state  KeyValuePair
+
+	// mu guards the events not delivered yet, notify wakes the delivery
+	// when one is queued and stopped is closed when the channel is done
+	mu      sync.Mutex
+	pending []Event
+	notify  chan struct{}
+	stopped chan struct{}
+}
+
+// Watch keeps the kernel channel open and reports every change until ctx
+// is cancelled.  The keys present when the channel opens are reported as
+// EventAdd.  The kernel only allows a single reader, so Watch cannot be
+// used while a kvp daemon is running.
+func Watch(ctx context.Context) (*Watcher, error) {
+	t, err := OpenKernelTransport(KernelDevice)
+	if err != nil {
+		return nil, err
+	}
+	w, err := WatchTransport(ctx, t)
+	if err != nil {
+		_ = t.Close()
+	}
+	return w, err
+}
+
+// WatchTransport is like Watch but uses the given transport, which is
+// closed once the watch ends
+func WatchTransport(ctx context.Context, t Transport) (*Watcher, error) {
+	if err := register(t); err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		events:  make(chan Event),
+		state:   make(KeyValuePair),
+		notify:  make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+	go func() {
+		defer close(w.stopped)
+		defer t.Close()
+		w.err = w.run(ctx, t)
+	}()
+	go w.deliver(ctx)
+	return w, nil
+}
+
+// Events returns the channel changes are delivered on.  It is closed when
+// the watch ends.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Err returns the error that ended the watch.  It is only valid once the
+// events channel is closed, and is nil if the context was cancelled.
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+func (w *Watcher) run(ctx context.Context, t Transport) error {
+	var msg hvKvpMsg
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		ok, err := nextMessage(t, Timeout, &msg)
+		if err != nil {
+			return err
+		}
+		if !ok || msg.kvpHdr.operation == OpRegister1 {
+			continue
+		}
+
+		ev, code := w.handle(&msg)
+		msg.setError(code)
+		if err := writeMessage(t, &msg); err != nil {
+			return err
+		}
+
+		if ev != nil {
+			w.queue(*ev)
+		}
+	}
+}
+
+// queue adds an event for deliver
+func (w *Watcher) queue(ev Event) {
+	w.mu.Lock()
+	w.pending = append(w.pending, ev)
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends the queued events until the watch ends.  Events queued
+// before the channel failed are still delivered, those left when ctx is
+// cancelled are dropped.
+func (w *Watcher) deliver(ctx context.Context) {
+	defer close(w.events)
+	for {
+		w.mu.Lock()
+		var ev *Event
+		if len(w.pending) > 0 {
+			ev = &w.pending[0]
+			w.pending = w.pending[1:]
+		}
+		w.mu.Unlock()
+
+		if ev == nil {
+			select {
+			case <-w.notify:
+				continue
+			case <-w.stopped:
+				// Events queued right before the channel stopped
+				w.mu.Lock()
+				empty := len(w.pending) == 0
+				w.mu.Unlock()
+				if empty {
+					return
+				}
+				continue
+			case <-ctx.Done():
+				<-w.stopped
+				return
+			}
+		}
+
+		select {
+		case w.events <- *ev:
+		case <-ctx.Done():
+			<-w.stopped
+			return
+		}
+	}
+}
+
+// handle applies a request to the known state and returns the event it
+// caused, if any.  Reads are answered from the known state since the
+// watcher owns the channel.
+func (w *Watcher) handle(msg *hvKvpMsg) (*Event, uint32) {
+	poolID := PoolID(msg.kvpHdr.pool)
+	if int(poolID) >= PoolCount {
+		return nil, HvEFail
+	}
+
+	switch msg.kvpHdr.operation {
+	case OpSet:
+		data := &msg.kvpSet.data
+		key := cString(data.key[:], data.keySize)
+		value := cString(data.value[:], data.valueSize)
+		vps, old, existed := w.state[poolID].set(key, value)
+		w.state[poolID] = vps
+		switch {
+		case !existed:
+			return &Event{Type: EventAdd, Pool: poolID, Key: key, Value: value}, HvSOk
+		case old != value:
+			return &Event{Type: EventModify, Pool: poolID, Key: key, Value: value}, HvSOk
+		}
+		return nil, HvSOk
+	case OpDelete:
+		del := msg.delete()
+		key := cString(del.key[:], del.keySize)
+		vps, old, existed := w.state[poolID].remove(key)
+		if !existed {
+			return nil, HvSCont
+		}
+		w.state[poolID] = vps
+		return &Event{Type: EventDelete, Pool: poolID, Key: key, Value: old}, HvSOk
+	case OpGet:
+		data := &msg.get().data
+		vp, err := w.state[poolID].GetValueByKey(cString(data.key[:], data.keySize))
+		if err != nil {
+			return nil, HvSCont
+		}
+		data.valueSize = putCString(data.value[:], vp.Value)
+		return nil, HvSOk
+	case OpEnumerate:
+		enum := msg.enumerate()
+		vps := w.state[poolID]
+		if int(enum.index) >= len(vps) {
+			return nil, HvSCont
+		}
+		enum.data.keySize = putCString(enum.data.key[:], vps[enum.index].Key)
+		enum.data.valueSize = putCString(enum.data.value[:], vps[enum.index].Value)
+		return nil, HvSOk
+	}
+	return nil, HvErrorNotSupported
+}
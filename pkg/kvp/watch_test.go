@@ -0,0 +1,137 @@
+//go:build linux
+
+package kvp
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func nextEvent(t *testing.T, w *Watcher) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-w.Events():
+		if !ok {
+			t.Fatalf("watch ended early: %v", w.Err())
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return Event{}
+}
+
+func TestWatch(t *testing.T) {
+	sim := NewSimulator()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registered := make(chan error, 1)
+	go func() { registered <- sim.Register() }()
+	w, err := WatchTransport(ctx, sim.Transport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-registered; err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		do   func() error
+		want Event
+	}{
+		{
+			do:   func() error { return sim.Set(PoolExternal, "ignition.config.0", "{}") },
+			want: Event{Type: EventAdd, Pool: PoolExternal, Key: "ignition.config.0", Value: "{}"},
+		},
+		{
+			do:   func() error { return sim.Set(PoolExternal, "ignition.config.0", `{"a":1}`) },
+			want: Event{Type: EventModify, Pool: PoolExternal, Key: "ignition.config.0", Value: `{"a":1}`},
+		},
+		{
+			do:   func() error { return sim.Delete(PoolExternal, "ignition.config.0") },
+			want: Event{Type: EventDelete, Pool: PoolExternal, Key: "ignition.config.0", Value: `{"a":1}`},
+		},
+	}
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatal(err)
+		}
+		if ev := nextEvent(t, w); ev != step.want {
+			t.Errorf("got event %+v, want %+v", ev, step.want)
+		}
+	}
+
+	// Setting the same value again is not a change
+	if err := sim.Set(PoolExternal, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, w)
+	if err := sim.Set(PoolExternal, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := sim.Get(PoolExternal, "a"); err != nil || v != "1" {
+		t.Errorf("get returned %q, %v", v, err)
+	}
+
+	var statusErr *StatusError
+	if err := sim.Delete(PoolExternal, "missing"); !errors.As(err, &statusErr) || statusErr.Code != HvSCont {
+		t.Errorf("delete of a missing key returned %v", err)
+	}
+
+	cancel()
+	for ev := range w.Events() {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	if err := w.Err(); err != nil {
+		t.Errorf("watch ended with %v", err)
+	}
+}
+
+func TestWatchSlowReader(t *testing.T) {
+	sim := NewSimulator()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	registered := make(chan error, 1)
+	go func() { registered <- sim.Register() }()
+	w, err := WatchTransport(ctx, sim.Transport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-registered; err != nil {
+		t.Fatal(err)
+	}
+
+	// The host is answered while nobody reads the events
+	const count = 100
+	for i := range count {
+		if err := sim.Set(PoolExternal, "key", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range count {
+		ev := nextEvent(t, w)
+		if ev.Value != strconv.Itoa(i) {
+			t.Fatalf("event %d has value %q", i, ev.Value)
+		}
+	}
+
+	// Events queued before the channel fails are still delivered
+	if err := sim.Set(PoolExternal, "last", "1"); err != nil {
+		t.Fatal(err)
+	}
+	sim.Close()
+	if ev := nextEvent(t, w); ev.Key != "last" {
+		t.Errorf("got event %+v", ev)
+	}
+	for ev := range w.Events() {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	if w.Err() == nil {
+		t.Error("watch ended without an error")
+	}
+}
@@ -0,0 +1,119 @@
+// Package nocloud builds the seed image of the cloud-init NoCloud data
+// source: an ISO 9660 volume labelled cidata holding user-data, meta-data
+// and optionally network-config.  It runs on any OS.
+package nocloud
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/containers/libhvee/pkg/iso9660"
+)
+
+// VolumeID is the label cloud-init looks for
+const VolumeID = "cidata"
+
+const (
+	UserDataFile      = "user-data"
+	MetaDataFile      = "meta-data"
+	NetworkConfigFile = "network-config"
+)
+
+// ErrReservedFile means an extra file would replace one of the data source
+// files
+var ErrReservedFile = errors.New("file name reserved for the nocloud data source")
+
+// Config is the content of the seed image
+type Config struct {
+	// UserData is the user-data file, usually a #cloud-config document
+	UserData []byte
+	// MetaData is the meta-data file.  When empty it is generated from
+	// InstanceID and Hostname.
+	MetaData []byte
+	// NetworkConfig is the optional network-config file
+	NetworkConfig []byte
+	// InstanceID identifies the instance in generated meta-data, a random
+	// id by default so every new image counts as a first boot
+	InstanceID string
+	// Hostname is the local-hostname of generated meta-data
+	Hostname string
+	// Files are extra files by slash separated path
+	Files map[string][]byte
+	// ModTime is recorded in the image, the time of writing by default
+	ModTime time.Time
+}
+
+// WriteISO writes the seed image to w
+func (c *Config) WriteISO(w io.Writer) error {
+	metaData, err := c.metaData()
+	if err != nil {
+		return err
+	}
+
+	iso := iso9660.NewWriter(iso9660.Options{VolumeID: VolumeID, ModTime: c.ModTime})
+	if err := iso.AddFile(UserDataFile, c.UserData); err != nil {
+		return err
+	}
+	if err := iso.AddFile(MetaDataFile, metaData); err != nil {
+		return err
+	}
+	if c.NetworkConfig != nil {
+		if err := iso.AddFile(NetworkConfigFile, c.NetworkConfig); err != nil {
+			return err
+		}
+	}
+	for p, data := range c.Files {
+		switch p {
+		case UserDataFile, MetaDataFile, NetworkConfigFile:
+			return fmt.Errorf("%q: %w", p, ErrReservedFile)
+		}
+		if err := iso.AddFile(p, data); err != nil {
+			return err
+		}
+	}
+	_, err = iso.WriteTo(w)
+	return err
+}
+
+// CreateISO writes the seed image to a new file at path, it fails with an
+// error matching os.ErrExist when the file exists
+func (c *Config) CreateISO(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("creating cloud-init image: %w", err)
+	}
+	if err = c.WriteISO(f); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("creating cloud-init image %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) metaData() ([]byte, error) {
+	if len(c.MetaData) > 0 {
+		return c.MetaData, nil
+	}
+	id := c.InstanceID
+	if id == "" {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		id = "iid-" + hex.EncodeToString(b)
+	}
+	data := fmt.Sprintf("instance-id: %q\n", id)
+	if c.Hostname != "" {
+		data += fmt.Sprintf("local-hostname: %q\n", c.Hostname)
+	}
+	return []byte(data), nil
+}
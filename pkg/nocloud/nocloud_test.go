@@ -0,0 +1,138 @@
+package nocloud
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/containers/libhvee/pkg/iso9660"
+)
+
+// rootFiles reads the files in the root of the Joliet tree of img, with
+// the volume label
+func rootFiles(t *testing.T, img []byte) (string, map[string]string) {
+	t.Helper()
+	sector := func(s uint32) []byte { return img[int(s)*iso9660.SectorSize:] }
+	decode := func(b []byte) string {
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(u))
+	}
+
+	var svd []byte
+	for s := uint32(16); ; s++ {
+		d := sector(s)
+		if string(d[1:6]) != "CD001" || d[0] == 255 {
+			t.Fatal("no joliet volume descriptor")
+		}
+		if d[0] == 2 {
+			svd = d
+			break
+		}
+	}
+	label := strings.TrimRight(decode(svd[40:72]), " ")
+
+	files := make(map[string]string)
+	root := svd[156:]
+	dir := sector(binary.LittleEndian.Uint32(root[2:]))[:binary.LittleEndian.Uint32(root[10:])]
+	for off := 0; off < len(dir) && dir[off] != 0; off += int(dir[off]) {
+		r := dir[off:]
+		id := r[33 : 33+r[32]]
+		if len(id) == 1 || r[25]&2 != 0 {
+			continue
+		}
+		name := strings.TrimSuffix(decode(id), ";1")
+		extent, size := binary.LittleEndian.Uint32(r[2:]), binary.LittleEndian.Uint32(r[10:])
+		files[name] = string(sector(extent)[:size])
+	}
+	return label, files
+}
+
+func TestWriteISO(t *testing.T) {
+	c := &Config{
+		UserData:      []byte("#cloud-config\nusers: []\n"),
+		NetworkConfig: []byte("version: 2\n"),
+		InstanceID:    "vm-1",
+		Hostname:      "guest",
+		Files:         map[string][]byte{"extra.sh": []byte("#!/bin/sh\n")},
+	}
+	var buf bytes.Buffer
+	if err := c.WriteISO(&buf); err != nil {
+		t.Fatal(err)
+	}
+	label, files := rootFiles(t, buf.Bytes())
+	if label != VolumeID {
+		t.Errorf("label %q", label)
+	}
+	want := map[string]string{
+		UserDataFile:      "#cloud-config\nusers: []\n",
+		MetaDataFile:      "instance-id: \"vm-1\"\nlocal-hostname: \"guest\"\n",
+		NetworkConfigFile: "version: 2\n",
+		"extra.sh":        "#!/bin/sh\n",
+	}
+	if len(files) != len(want) {
+		t.Errorf("got files %v", files)
+	}
+	for name, content := range want {
+		if files[name] != content {
+			t.Errorf("%s: got %q, want %q", name, files[name], content)
+		}
+	}
+}
+
+func TestMetaData(t *testing.T) {
+	c := &Config{MetaData: []byte("instance-id: given\n"), InstanceID: "ignored"}
+	if got, _ := c.metaData(); string(got) != "instance-id: given\n" {
+		t.Errorf("got %q", got)
+	}
+
+	// Without an instance id every image gets a new one
+	c = &Config{}
+	a, _ := c.metaData()
+	b, _ := c.metaData()
+	if !strings.HasPrefix(string(a), "instance-id: \"iid-") || bytes.Equal(a, b) {
+		t.Errorf("generated %q and %q", a, b)
+	}
+	if strings.Contains(string(a), "local-hostname") {
+		t.Errorf("hostname without one set: %q", a)
+	}
+}
+
+func TestCreateISO(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seed.iso")
+	if err := (&Config{UserData: []byte("#cloud-config\n")}).CreateISO(path); err != nil {
+		t.Fatal(err)
+	}
+	img, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, files := rootFiles(t, img); files[UserDataFile] != "#cloud-config\n" {
+		t.Errorf("got files %v", files)
+	}
+
+	// An existing file is left alone
+	if err := (&Config{}).CreateISO(path); !errors.Is(err, os.ErrExist) {
+		t.Errorf("got %v, want %v", err, os.ErrExist)
+	}
+	if again, err := os.ReadFile(path); err != nil || !bytes.Equal(again, img) {
+		t.Errorf("existing image changed: %v", err)
+	}
+
+	// A failed image does not stay behind
+	failed := filepath.Join(t.TempDir(), "failed.iso")
+	c := &Config{Files: map[string][]byte{MetaDataFile: nil}}
+	if err := c.CreateISO(failed); !errors.Is(err, ErrReservedFile) {
+		t.Errorf("got %v, want %v", err, ErrReservedFile)
+	}
+	if _, err := os.Stat(failed); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("image left behind: %v", err)
+	}
+}
@@ -0,0 +1,360 @@
+// Package qcow2 reads QEMU copy-on-write images of version 2 and 3 without
+// QEMU.  Images with a backing file, encryption, an external data file or
+// extended L2 entries are not supported.
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Magic is the start of every qcow2 image
+var Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+const (
+	headerV2Length = 72
+	headerV3Length = 104
+
+	minClusterBits = 9
+	maxClusterBits = 21
+
+	// maxL1Size is the largest L1 table QEMU accepts, in bytes
+	maxL1Size = 32 << 20
+
+	// Incompatible feature bits
+	incompatDirty        = 1 << 0
+	incompatCorrupt      = 1 << 1
+	incompatExternalData = 1 << 2
+	incompatCompression  = 1 << 3
+	incompatExtendedL2   = 1 << 4
+	incompatKnown        = incompatDirty | incompatCorrupt | incompatExternalData | incompatCompression | incompatExtendedL2
+
+	l1OffsetMask   = 0x00fffffffffffe00
+	l2OffsetMask   = 0x00fffffffffffe00
+	l2Compressed   = 1 << 62
+	l2ZeroFlag     = 1 << 0
+	compressedUnit = 512
+)
+
+// CompressionType is the algorithm of compressed clusters
+type CompressionType uint8
+
+const (
+	CompressionDeflate CompressionType = 0
+	CompressionZstd    CompressionType = 1
+)
+
+var (
+	// ErrInvalidMagic means the data is not a qcow2 image
+	ErrInvalidMagic = errors.New("not a qcow2 image")
+	// ErrUnsupported means the image uses a feature this package does not
+	// implement
+	ErrUnsupported = errors.New("unsupported qcow2 feature")
+	// ErrCorrupt means the image structures are inconsistent
+	ErrCorrupt = errors.New("corrupt qcow2 image")
+)
+
+// Header holds the fields of the image header this package uses
+type Header struct {
+	Version         uint32
+	ClusterBits     uint32
+	Size            uint64
+	L1Size          uint32
+	L1TableOffset   uint64
+	Incompatible    uint64
+	CompressionType CompressionType
+	// HasBackingFile is set when the image only holds changes on top of
+	// another image
+	HasBackingFile bool
+	Encrypted      bool
+}
+
+// Image is an open qcow2 image, it reads like the virtual disk it holds
+type Image struct {
+	Header Header
+
+	r           io.ReaderAt
+	closer      io.Closer
+	clusterSize uint64
+	l1          []uint64
+
+	// The last L2 table read, conversions read clusters in order
+	mu       sync.Mutex
+	l2Offset uint64
+	l2       []uint64
+}
+
+// Open opens the qcow2 image at path
+func Open(path string) (*Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	img, err := NewImage(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	img.closer = f
+	return img, nil
+}
+
+// NewImage reads the header and L1 table of the image held by r
+func NewImage(r io.ReaderAt) (*Image, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{Header: h, r: r, clusterSize: 1 << h.ClusterBits}
+
+	// Each L2 table maps one cluster worth of entries
+	entriesPerL2 := img.clusterSize / 8
+	needed := divRoundUp(h.Size, img.clusterSize*entriesPerL2)
+	if uint64(h.L1Size) < needed {
+		return nil, fmt.Errorf("l1 table of %d entries for %d: %w", h.L1Size, needed, ErrCorrupt)
+	}
+	// The header is not trusted with the size of an allocation
+	l1Bytes := uint64(h.L1Size) * 8
+	if l1Bytes > maxL1Size {
+		return nil, fmt.Errorf("l1 table of %d entries: %w", h.L1Size, ErrCorrupt)
+	}
+	if size, ok := readerSize(r); ok && (h.L1TableOffset > uint64(size) || uint64(size)-h.L1TableOffset < l1Bytes) {
+		return nil, fmt.Errorf("l1 table past the end of the image: %w", ErrCorrupt)
+	}
+	buf := make([]byte, l1Bytes)
+	if _, err := r.ReadAt(buf, int64(h.L1TableOffset)); err != nil {
+		return nil, fmt.Errorf("reading l1 table: %w", err)
+	}
+	img.l1 = make([]uint64, h.L1Size)
+	for i := range img.l1 {
+		img.l1[i] = binary.BigEndian.Uint64(buf[i*8:])
+	}
+	return img, nil
+}
+
+// readerSize returns the size of the data behind r, when r knows it
+func readerSize(r io.ReaderAt) (int64, bool) {
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		return r.Size(), true
+	case interface{ Stat() (os.FileInfo, error) }:
+		if info, err := r.Stat(); err == nil {
+			return info.Size(), true
+		}
+	}
+	return 0, false
+}
+
+func readHeader(r io.ReaderAt) (Header, error) {
+	var h Header
+	buf := make([]byte, headerV3Length+8)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return h, err
+	}
+	if n < headerV2Length {
+		return h, ErrInvalidMagic
+	}
+	buf = buf[:n]
+	if !bytes.Equal(buf[0:4], Magic) {
+		return h, ErrInvalidMagic
+	}
+
+	h.Version = binary.BigEndian.Uint32(buf[4:8])
+	h.HasBackingFile = binary.BigEndian.Uint64(buf[8:16]) != 0
+	h.ClusterBits = binary.BigEndian.Uint32(buf[20:24])
+	h.Size = binary.BigEndian.Uint64(buf[24:32])
+	h.Encrypted = binary.BigEndian.Uint32(buf[32:36]) != 0
+	h.L1Size = binary.BigEndian.Uint32(buf[36:40])
+	h.L1TableOffset = binary.BigEndian.Uint64(buf[40:48])
+
+	switch h.Version {
+	case 2:
+	case 3:
+		if n < headerV3Length {
+			return h, fmt.Errorf("short version 3 header: %w", ErrCorrupt)
+		}
+		h.Incompatible = binary.BigEndian.Uint64(buf[72:80])
+		headerLength := binary.BigEndian.Uint32(buf[100:104])
+		if h.Incompatible&incompatCompression != 0 {
+			if headerLength <= headerV3Length || n <= headerV3Length {
+				return h, fmt.Errorf("compression type missing: %w", ErrCorrupt)
+			}
+			h.CompressionType = CompressionType(buf[104])
+		}
+	default:
+		return h, fmt.Errorf("version %d: %w", h.Version, ErrUnsupported)
+	}
+
+	switch {
+	case h.ClusterBits < minClusterBits || h.ClusterBits > maxClusterBits:
+		return h, fmt.Errorf("cluster bits %d: %w", h.ClusterBits, ErrCorrupt)
+	case h.HasBackingFile:
+		return h, fmt.Errorf("backing file: %w", ErrUnsupported)
+	case h.Encrypted:
+		return h, fmt.Errorf("encryption: %w", ErrUnsupported)
+	case h.Incompatible&^incompatKnown != 0:
+		return h, fmt.Errorf("incompatible features %#x: %w", h.Incompatible&^incompatKnown, ErrUnsupported)
+	case h.Incompatible&incompatCorrupt != 0:
+		return h, fmt.Errorf("image is marked corrupt: %w", ErrCorrupt)
+	case h.Incompatible&incompatExternalData != 0:
+		return h, fmt.Errorf("external data file: %w", ErrUnsupported)
+	case h.Incompatible&incompatExtendedL2 != 0:
+		return h, fmt.Errorf("extended l2 entries: %w", ErrUnsupported)
+	case h.CompressionType != CompressionDeflate && h.CompressionType != CompressionZstd:
+		return h, fmt.Errorf("compression type %d: %w", h.CompressionType, ErrUnsupported)
+	}
+	return h, nil
+}
+
+// Close closes the image if it was opened with Open
+func (img *Image) Close() error {
+	if img.closer == nil {
+		return nil
+	}
+	return img.closer.Close()
+}
+
+// Size returns the size of the virtual disk
+func (img *Image) Size() uint64 {
+	return img.Header.Size
+}
+
+// ClusterSize returns the allocation unit of the image
+func (img *Image) ClusterSize() uint64 {
+	return img.clusterSize
+}
+
+// ReadAt reads the virtual disk, unallocated and zero clusters read as
+// zeros
+func (img *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		pos := uint64(off) + uint64(n)
+		if pos >= img.Header.Size {
+			return n, io.EOF
+		}
+		within := pos % img.clusterSize
+		l := int(min(uint64(len(p)-n), img.clusterSize-within, img.Header.Size-pos))
+		if err := img.readCluster(p[n:n+l], pos-within, within); err != nil {
+			return n, err
+		}
+		n += l
+	}
+	return n, nil
+}
+
+// readCluster fills buf with data of the cluster at the virtual offset
+// cluster, starting within bytes into it
+func (img *Image) readCluster(buf []byte, cluster uint64, within uint64) error {
+	entry, err := img.l2Entry(cluster)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case entry&l2Compressed != 0:
+		data, err := img.decompress(entry)
+		if err != nil {
+			return fmt.Errorf("cluster at %d: %w", cluster, err)
+		}
+		copy(buf, data[within:])
+	case entry&l2ZeroFlag != 0 && img.Header.Version >= 3, entry&l2OffsetMask == 0:
+		clear(buf)
+	default:
+		hostOffset := entry & l2OffsetMask
+		if hostOffset%img.clusterSize != 0 {
+			return fmt.Errorf("cluster at %d stored at unaligned %d: %w", cluster, hostOffset, ErrCorrupt)
+		}
+		if _, err := img.r.ReadAt(buf, int64(hostOffset+within)); err != nil {
+			return fmt.Errorf("cluster at %d: %w", cluster, err)
+		}
+	}
+	return nil
+}
+
+// l2Entry returns the L2 entry describing the cluster at a virtual offset,
+// zero if its L2 table is not allocated
+func (img *Image) l2Entry(cluster uint64) (uint64, error) {
+	entriesPerL2 := img.clusterSize / 8
+	index := cluster / img.clusterSize
+	l1Index := index / entriesPerL2
+	if l1Index >= uint64(len(img.l1)) {
+		return 0, fmt.Errorf("cluster at %d beyond the l1 table: %w", cluster, ErrCorrupt)
+	}
+	l2Offset := img.l1[l1Index] & l1OffsetMask
+	if l2Offset == 0 {
+		return 0, nil
+	}
+	if l2Offset%img.clusterSize != 0 {
+		return 0, fmt.Errorf("l2 table at unaligned %d: %w", l2Offset, ErrCorrupt)
+	}
+
+	img.mu.Lock()
+	defer img.mu.Unlock()
+	if img.l2 == nil || img.l2Offset != l2Offset {
+		buf := make([]byte, img.clusterSize)
+		if _, err := img.r.ReadAt(buf, int64(l2Offset)); err != nil {
+			return 0, fmt.Errorf("reading l2 table: %w", err)
+		}
+		l2 := make([]uint64, entriesPerL2)
+		for i := range l2 {
+			l2[i] = binary.BigEndian.Uint64(buf[i*8:])
+		}
+		img.l2, img.l2Offset = l2, l2Offset
+	}
+	return img.l2[index%entriesPerL2], nil
+}
+
+// decompress reads and inflates a compressed cluster
+func (img *Image) decompress(entry uint64) ([]byte, error) {
+	// The descriptor holds the host offset in its low bits and the number
+	// of additional 512 byte sectors above them
+	offsetBits := 62 - (img.Header.ClusterBits - 8)
+	hostOffset := entry & (1<<offsetBits - 1)
+	sectors := (entry&(1<<62-1))>>offsetBits + 1
+	length := sectors*compressedUnit - hostOffset%compressedUnit
+
+	compressed := make([]byte, length)
+	n, err := img.r.ReadAt(compressed, int64(hostOffset))
+	// The last compressed cluster may end before the file does
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	compressed = compressed[:n]
+
+	out := make([]byte, img.clusterSize)
+	switch img.Header.CompressionType {
+	case CompressionDeflate:
+		fr := flate.NewReader(bytes.NewReader(compressed))
+		defer fr.Close()
+		if _, err := io.ReadFull(fr, out); err != nil {
+			return nil, fmt.Errorf("inflating: %w: %w", ErrCorrupt, err)
+		}
+	case CompressionZstd:
+		dec, err := zstd.NewReader(bytes.NewReader(compressed), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		if _, err := io.ReadFull(dec, out); err != nil {
+			return nil, fmt.Errorf("decompressing: %w: %w", ErrCorrupt, err)
+		}
+	}
+	return out, nil
+}
+
+func divRoundUp(a, b uint64) uint64 {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,201 @@
+package qcow2
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	testClusterBits = 16
+	testClusterSize = 1 << testClusterBits
+	testSize        = 16 * testClusterSize
+)
+
+// cluster describes how the test image stores one cluster
+type cluster struct {
+	data       []byte
+	zero       bool
+	compressed bool
+}
+
+// buildImage lays out a single L2 table image: the header in cluster 0,
+// the L1 table in cluster 1, the L2 table in cluster 2 and data after it
+func buildImage(t *testing.T, version uint32, compression CompressionType, clusters map[int]cluster) []byte {
+	t.Helper()
+
+	img := make([]byte, 3*testClusterSize)
+	copy(img, Magic)
+	binary.BigEndian.PutUint32(img[4:], version)
+	binary.BigEndian.PutUint32(img[20:], testClusterBits)
+	binary.BigEndian.PutUint64(img[24:], testSize)
+	binary.BigEndian.PutUint32(img[36:], 1)
+	binary.BigEndian.PutUint64(img[40:], testClusterSize)
+	if version == 3 {
+		binary.BigEndian.PutUint32(img[96:], 4)
+		binary.BigEndian.PutUint32(img[100:], headerV3Length)
+		if compression != CompressionDeflate {
+			binary.BigEndian.PutUint64(img[72:], incompatCompression)
+			binary.BigEndian.PutUint32(img[100:], headerV3Length+8)
+			img[104] = byte(compression)
+		}
+	}
+	binary.BigEndian.PutUint64(img[testClusterSize:], 2*testClusterSize|1<<63)
+
+	for i := 0; i < testSize/testClusterSize; i++ {
+		c, ok := clusters[i]
+		if !ok {
+			continue
+		}
+		var entry uint64
+		switch {
+		case c.compressed:
+			compressed := compress(t, compression, c.data)
+			// Compressed data does not need to start on a sector
+			offset := uint64(len(img)) + 100
+			img = append(img, make([]byte, 100)...)
+			img = append(img, compressed...)
+			offsetBits := 62 - (testClusterBits - 8)
+			sectors := (offset%compressedUnit+uint64(len(compressed))+compressedUnit-1)/compressedUnit - 1
+			entry = l2Compressed | sectors<<offsetBits | offset
+			// Pad so the next cluster stays aligned
+			img = append(img, make([]byte, testClusterSize-len(img)%testClusterSize)...)
+		case c.zero:
+			entry = l2ZeroFlag
+			if c.data != nil {
+				// A stale allocation the zero flag hides
+				entry |= uint64(len(img))
+				img = append(img, c.data...)
+			}
+		default:
+			entry = uint64(len(img)) | 1<<63
+			img = append(img, c.data...)
+		}
+		// img grows, so the L2 table is addressed through it
+		binary.BigEndian.PutUint64(img[2*testClusterSize+i*8:], entry)
+	}
+	return img
+}
+
+func compress(t *testing.T, compression CompressionType, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	switch compression {
+	case CompressionDeflate:
+		w, err := flate.NewWriter(&buf, flate.BestCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		w.Close()
+	case CompressionZstd:
+		w, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		w.Close()
+	}
+	return buf.Bytes()
+}
+
+func fill(b byte) []byte {
+	return bytes.Repeat([]byte{b}, testClusterSize)
+}
+
+func TestReadAt(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		version     uint32
+		compression CompressionType
+	}{
+		{"v2", 2, CompressionDeflate},
+		{"v3", 3, CompressionDeflate},
+		{"v3 zstd", 3, CompressionZstd},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clusters := map[int]cluster{
+				0: {data: fill('a')},
+				2: {data: fill('c'), compressed: true},
+				5: {data: fill('f')},
+			}
+			if tt.version == 3 {
+				clusters[3] = cluster{data: fill('x'), zero: true}
+			}
+			data := buildImage(t, tt.version, tt.compression, clusters)
+
+			img, err := NewImage(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Size() != testSize || img.ClusterSize() != testClusterSize {
+				t.Errorf("size %d cluster size %d", img.Size(), img.ClusterSize())
+			}
+
+			got, err := io.ReadAll(io.NewSectionReader(img, 0, int64(img.Size())))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := make([]byte, testSize)
+			copy(want, fill('a'))
+			copy(want[2*testClusterSize:], fill('c'))
+			copy(want[5*testClusterSize:], fill('f'))
+			if !bytes.Equal(got, want) {
+				t.Error("content differs")
+			}
+
+			// Reads crossing clusters
+			buf := make([]byte, 10)
+			if _, err := img.ReadAt(buf, 2*testClusterSize-5); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != "\x00\x00\x00\x00\x00ccccc" {
+				t.Errorf("read %q", buf)
+			}
+			if _, err := img.ReadAt(buf, testSize-5); !errors.Is(err, io.EOF) {
+				t.Errorf("read past end: %v", err)
+			}
+		})
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func([]byte)
+		want   error
+	}{
+		{"magic", func(b []byte) { b[0] = 'X' }, ErrInvalidMagic},
+		{"version", func(b []byte) { binary.BigEndian.PutUint32(b[4:], 4) }, ErrUnsupported},
+		{"backing file", func(b []byte) { binary.BigEndian.PutUint64(b[8:], 512) }, ErrUnsupported},
+		{"encryption", func(b []byte) { binary.BigEndian.PutUint32(b[32:], 2) }, ErrUnsupported},
+		{"extended l2", func(b []byte) { binary.BigEndian.PutUint64(b[72:], incompatExtendedL2) }, ErrUnsupported},
+		{"unknown feature", func(b []byte) { binary.BigEndian.PutUint64(b[72:], 1<<40) }, ErrUnsupported},
+		{"marked corrupt", func(b []byte) { binary.BigEndian.PutUint64(b[72:], incompatCorrupt) }, ErrCorrupt},
+		{"cluster bits", func(b []byte) { binary.BigEndian.PutUint32(b[20:], 30) }, ErrCorrupt},
+		{"short l1", func(b []byte) { binary.BigEndian.PutUint64(b[24:], 1<<40) }, ErrCorrupt},
+		{"huge l1", func(b []byte) { binary.BigEndian.PutUint32(b[36:], 0xffffffff) }, ErrCorrupt},
+		{"l1 past the end", func(b []byte) { binary.BigEndian.PutUint64(b[40:], 1<<40) }, ErrCorrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := buildImage(t, 3, CompressionDeflate, nil)
+			tt.modify(data)
+			if _, err := NewImage(bytes.NewReader(data)); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// Dirty images are readable, the refcounts are not used
+	data := buildImage(t, 3, CompressionDeflate, nil)
+	binary.BigEndian.PutUint64(data[72:], incompatDirty)
+	if _, err := NewImage(bytes.NewReader(data)); err != nil {
+		t.Errorf("dirty image: %v", err)
+	}
+}
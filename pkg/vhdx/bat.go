@@ -0,0 +1,218 @@
+package vhdx
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// BlockState is the state of a block recorded in the BAT
+type BlockState uint8
+
+// Payload block states
+const (
+	PayloadBlockNotPresent       BlockState = 0
+	PayloadBlockUndefined        BlockState = 1
+	PayloadBlockZero             BlockState = 2
+	PayloadBlockUnmapped         BlockState = 3
+	PayloadBlockFullyPresent     BlockState = 6
+	PayloadBlockPartiallyPresent BlockState = 7
+)
+
+// Sector bitmap block states
+const (
+	SectorBitmapBlockNotPresent BlockState = 0
+	SectorBitmapBlockPresent    BlockState = 6
+)
+
+const (
+	batEntrySize = 8
+	// sectorsPerBitmap is the number of sectors one sector bitmap block
+	// describes
+	sectorsPerBitmap = 1 << 23
+
+	batStateMask  = 0x7
+	batOffsetMask = ^uint64(MiB - 1)
+)
+
+// ErrParentRequired means reading the data needs the parent of a
+// differencing disk
+var ErrParentRequired = errors.New("data is in the parent disk")
+
+// BATEntry is an entry of the block allocation table
+type BATEntry struct {
+	State BlockState
+	// FileOffset is the location of the block in the file in bytes, zero
+	// when no space is allocated
+	FileOffset uint64
+}
+
+func decodeBATEntry(v uint64) BATEntry {
+	return BATEntry{State: BlockState(v & batStateMask), FileOffset: v & batOffsetMask}
+}
+
+// ChunkRatio is the number of payload blocks described by one sector bitmap
+// block
+func (f *File) ChunkRatio() uint64 {
+	return uint64(sectorsPerBitmap) * uint64(f.Metadata.LogicalSectorSize) / uint64(f.Metadata.BlockSize)
+}
+
+// PayloadBlocks is the number of blocks needed to hold the virtual disk
+func (f *File) PayloadBlocks() uint64 {
+	return divRoundUp(f.Metadata.VirtualSize, uint64(f.Metadata.BlockSize))
+}
+
+// batEntries is the number of entries the BAT of the file holds
+func (f *File) batEntries() uint64 {
+	chunkRatio := f.ChunkRatio()
+	payload := f.PayloadBlocks()
+	if f.Metadata.HasParent {
+		return divRoundUp(payload, chunkRatio) * (chunkRatio + 1)
+	}
+	return payload + (payload-1)/chunkRatio
+}
+
+// PayloadBlock returns the BAT entry of payload block i
+func (f *File) PayloadBlock(i uint64) BATEntry {
+	return f.BAT[i+i/f.ChunkRatio()]
+}
+
+// SectorBitmapBlock returns the BAT entry of the sector bitmap of chunk i,
+// only differencing disks are guaranteed to have one for every chunk
+func (f *File) SectorBitmapBlock(i uint64) (BATEntry, bool) {
+	chunkRatio := f.ChunkRatio()
+	index := i*(chunkRatio+1) + chunkRatio
+	if index >= uint64(len(f.BAT)) {
+		return BATEntry{}, false
+	}
+	return f.BAT[index], true
+}
+
+func readBAT(r io.ReaderAt, region RegionEntry, entries uint64) ([]BATEntry, error) {
+	if entries*batEntrySize > uint64(region.Length) {
+		return nil, fmt.Errorf("%d bat entries do not fit a region of %d bytes: %w", entries, region.Length, ErrCorrupt)
+	}
+	buf := make([]byte, entries*batEntrySize)
+	if _, err := r.ReadAt(buf, int64(region.FileOffset)); err != nil {
+		return nil, fmt.Errorf("reading bat: %w", err)
+	}
+	bat := make([]BATEntry, entries)
+	for i := range bat {
+		bat[i] = decodeBATEntry(binary.LittleEndian.Uint64(buf[i*batEntrySize:]))
+	}
+	return bat, nil
+}
+
+// Validate checks that the file can be used: the log is empty, the regions
+// do not overlap and every allocated block lies inside the file without
+// overlapping a region or another block
+func (f *File) Validate() error {
+	if !f.Header.LogGUID.IsZero() {
+		return ErrLogReplayRequired
+	}
+
+	type extent struct {
+		name       string
+		start, end uint64
+	}
+	extents := []extent{{"headers", 0, headerSectionSize}}
+	if f.Header.LogLength > 0 {
+		extents = append(extents, extent{"log", f.Header.LogOffset, f.Header.LogOffset + uint64(f.Header.LogLength)})
+	}
+	for _, r := range f.Regions {
+		extents = append(extents, extent{"region " + r.GUID.String(), r.FileOffset, r.FileOffset + uint64(r.Length)})
+	}
+
+	chunkRatio := f.ChunkRatio()
+	for i, e := range f.BAT {
+		bitmap := uint64(i)%(chunkRatio+1) == chunkRatio
+		if bitmap {
+			switch e.State {
+			case SectorBitmapBlockNotPresent:
+				continue
+			case SectorBitmapBlockPresent:
+				extents = append(extents, extent{fmt.Sprintf("sector bitmap %d", i), e.FileOffset, e.FileOffset + MiB})
+				continue
+			}
+			return fmt.Errorf("bat entry %d has sector bitmap state %d: %w", i, e.State, ErrCorrupt)
+		}
+
+		switch e.State {
+		case PayloadBlockFullyPresent, PayloadBlockPartiallyPresent:
+		case PayloadBlockNotPresent, PayloadBlockUndefined, PayloadBlockZero, PayloadBlockUnmapped:
+			if e.FileOffset == 0 {
+				continue
+			}
+		default:
+			return fmt.Errorf("bat entry %d has payload state %d: %w", i, e.State, ErrCorrupt)
+		}
+		if e.State == PayloadBlockPartiallyPresent && !f.Metadata.HasParent {
+			return fmt.Errorf("bat entry %d is partially present without a parent: %w", i, ErrCorrupt)
+		}
+		if e.FileOffset == 0 {
+			return fmt.Errorf("bat entry %d is present without an offset: %w", i, ErrCorrupt)
+		}
+		extents = append(extents, extent{fmt.Sprintf("payload block %d", i), e.FileOffset, e.FileOffset + uint64(f.Metadata.BlockSize)})
+	}
+
+	sort.Slice(extents, func(i, j int) bool { return extents[i].start < extents[j].start })
+	for i, e := range extents {
+		if e.end > uint64(f.size) {
+			return fmt.Errorf("%s ends at %d past the end of the file at %d: %w", e.name, e.end, f.size, ErrCorrupt)
+		}
+		if i > 0 && e.start < extents[i-1].end {
+			return fmt.Errorf("%s overlaps %s: %w", e.name, extents[i-1].name, ErrCorrupt)
+		}
+	}
+	return nil
+}
+
+// ReadAt reads the content of the virtual disk.  Blocks that are not
+// allocated read as zeros, except in a differencing disk where their data
+// is in the parent and ErrParentRequired is returned.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if !f.Header.LogGUID.IsZero() {
+		return 0, ErrLogReplayRequired
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	size := int64(f.Metadata.VirtualSize)
+	blockSize := int64(f.Metadata.BlockSize)
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= size {
+			return n, io.EOF
+		}
+		block, within := pos/blockSize, pos%blockSize
+		l := int(min(int64(len(p)-n), blockSize-within, size-pos))
+		buf := p[n : n+l]
+
+		e := f.PayloadBlock(uint64(block))
+		switch e.State {
+		case PayloadBlockFullyPresent:
+			if _, err := f.r.ReadAt(buf, int64(e.FileOffset)+within); err != nil {
+				return n, err
+			}
+		case PayloadBlockNotPresent:
+			if f.Metadata.HasParent {
+				return n, fmt.Errorf("block %d: %w", block, ErrParentRequired)
+			}
+			clear(buf)
+		case PayloadBlockPartiallyPresent:
+			return n, fmt.Errorf("block %d: %w", block, ErrParentRequired)
+		default:
+			clear(buf)
+		}
+		n += l
+	}
+	return n, nil
+}
+
+func divRoundUp(a, b uint64) uint64 {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,71 @@
+package vhdx
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containers/libhvee/pkg/qcow2"
+)
+
+// Convert writes a dynamic VHDX file to w holding the size bytes of the
+// raw disk image read from r
+func Convert(w io.WriterAt, r io.ReaderAt, size uint64, opts *WriterOptions) error {
+	vw, err := NewWriter(w, size, opts)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, vw.opts.BlockSize)
+	if _, err := io.CopyBuffer(vw, io.NewSectionReader(r, 0, int64(size)), buf); err != nil {
+		return fmt.Errorf("copying disk content: %w", err)
+	}
+	return vw.Close()
+}
+
+// ConvertFile creates a dynamic VHDX file at dst from the raw or qcow2
+// image at src.  dst must not exist, it is removed if the conversion fails.
+func ConvertFile(dst string, src string, opts *WriterOptions) (retErr error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var (
+		r    io.ReaderAt = in
+		size uint64
+	)
+	magic := make([]byte, len(qcow2.Magic))
+	if _, err := in.ReadAt(magic, 0); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if bytes.Equal(magic, qcow2.Magic) {
+		img, err := qcow2.NewImage(in)
+		if err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+		r, size = img, img.Size()
+	} else {
+		st, err := in.Stat()
+		if err != nil {
+			return err
+		}
+		size = uint64(st.Size())
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := out.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+		if retErr != nil {
+			_ = os.Remove(dst)
+		}
+	}()
+	return Convert(out, r, size, opts)
+}
@@ -0,0 +1,53 @@
+package vhdx
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// GUID is a globally unique identifier in its on-disk form, where the first
+// three groups are little endian
+type GUID [16]byte
+
+// String formats the GUID as XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX
+func (g GUID) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10], g[10:16])
+}
+
+// IsZero reports whether all bytes of the GUID are zero
+func (g GUID) IsZero() bool {
+	return g == GUID{}
+}
+
+// ParseGUID parses a GUID formatted like GUID.String, with or without braces
+func ParseGUID(s string) (GUID, error) {
+	var g GUID
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	parts := strings.Split(s, "-")
+	if len(parts) != 5 || len(parts[0]) != 8 || len(parts[1]) != 4 || len(parts[2]) != 4 || len(parts[3]) != 4 || len(parts[4]) != 12 {
+		return g, fmt.Errorf("invalid guid %q", s)
+	}
+	b, err := hex.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return g, fmt.Errorf("invalid guid %q: %w", s, err)
+	}
+	binary.LittleEndian.PutUint32(g[0:4], binary.BigEndian.Uint32(b[0:4]))
+	binary.LittleEndian.PutUint16(g[4:6], binary.BigEndian.Uint16(b[4:6]))
+	binary.LittleEndian.PutUint16(g[6:8], binary.BigEndian.Uint16(b[6:8]))
+	copy(g[8:], b[8:])
+	return g, nil
+}
+
+func mustParseGUID(s string) GUID {
+	g, err := ParseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
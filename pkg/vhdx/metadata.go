@@ -0,0 +1,231 @@
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	metadataTableSize  = 64 * KiB
+	metadataEntrySize  = 32
+	maxMetadataEntries = 2047
+
+	metadataIsUser     = 1 << 0
+	metadataIsRequired = 1 << 2
+
+	fileParametersLeaveBlocksAllocated = 1 << 0
+	fileParametersHasParent            = 1 << 1
+
+	parentLocatorEntrySize = 12
+)
+
+var (
+	metadataSignature = []byte("metadata")
+
+	// Metadata item identifiers
+	FileParametersItem     = mustParseGUID("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	VirtualDiskSizeItem    = mustParseGUID("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	VirtualDiskIDItem      = mustParseGUID("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	LogicalSectorSizeItem  = mustParseGUID("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	PhysicalSectorSizeItem = mustParseGUID("CDA348C7-445D-4471-9CC9-E9885251C556")
+	ParentLocatorItem      = mustParseGUID("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+
+	// ParentLocatorVHDX is the only parent locator type defined for VHDX
+	ParentLocatorVHDX = mustParseGUID("B04AEFB7-D19E-4A81-B789-25B8E9445913")
+)
+
+// Parent locator keys
+const (
+	ParentLinkageKey     = "parent_linkage"
+	ParentLinkage2Key    = "parent_linkage2"
+	RelativePathKey      = "relative_path"
+	VolumePathKey        = "volume_path"
+	AbsoluteWin32PathKey = "absolute_win32_path"
+)
+
+// Metadata holds the known system metadata items of a VHDX file
+type Metadata struct {
+	// BlockSize is the size of a payload block in bytes
+	BlockSize            uint32
+	LeaveBlocksAllocated bool
+	// HasParent is set for differencing disks
+	HasParent bool
+	// VirtualSize is the size of the disk seen by the guest in bytes
+	VirtualSize        uint64
+	VirtualDiskID      GUID
+	LogicalSectorSize  uint32
+	PhysicalSectorSize uint32
+	// ParentLocator is only present on differencing disks
+	ParentLocator *ParentLocator
+}
+
+// ParentLocator tells where the parent of a differencing disk is
+type ParentLocator struct {
+	Type GUID
+	// Entries maps the keys of the locator, such as RelativePathKey, to
+	// their values
+	Entries map[string]string
+}
+
+// ParentLinkage returns the DataWriteGUID the parent must have
+func (p *ParentLocator) ParentLinkage() (GUID, error) {
+	return ParseGUID(p.Entries[ParentLinkageKey])
+}
+
+// metadataEntry locates an item inside the metadata region
+type metadataEntry struct {
+	item   GUID
+	offset uint32
+	length uint32
+	flags  uint32
+}
+
+func readMetadata(r io.ReaderAt, region RegionEntry) (Metadata, error) {
+	var m Metadata
+
+	table := make([]byte, metadataTableSize)
+	if _, err := r.ReadAt(table, int64(region.FileOffset)); err != nil {
+		return m, fmt.Errorf("reading metadata table: %w", err)
+	}
+	if !bytes.Equal(table[0:8], metadataSignature) {
+		return m, fmt.Errorf("metadata table: %w", ErrInvalidSignature)
+	}
+	count := binary.LittleEndian.Uint16(table[10:12])
+	if count > maxMetadataEntries {
+		return m, fmt.Errorf("metadata table with %d entries: %w", count, ErrCorrupt)
+	}
+
+	items := make(map[GUID][]byte)
+	for i := 0; i < int(count); i++ {
+		b := table[32+i*metadataEntrySize:][:metadataEntrySize]
+		var e metadataEntry
+		copy(e.item[:], b[0:16])
+		e.offset = binary.LittleEndian.Uint32(b[16:20])
+		e.length = binary.LittleEndian.Uint32(b[20:24])
+		e.flags = binary.LittleEndian.Uint32(b[24:28])
+
+		if e.flags&metadataIsUser != 0 {
+			continue
+		}
+		if !knownMetadataItem(e.item) {
+			if e.flags&metadataIsRequired != 0 {
+				return m, fmt.Errorf("required metadata item %s: %w", e.item, ErrUnsupported)
+			}
+			continue
+		}
+		if e.length == 0 {
+			continue
+		}
+		if e.offset < metadataTableSize || uint64(e.offset)+uint64(e.length) > uint64(region.Length) {
+			return m, fmt.Errorf("metadata item %s at %d with length %d: %w", e.item, e.offset, e.length, ErrCorrupt)
+		}
+		data := make([]byte, e.length)
+		if _, err := r.ReadAt(data, int64(region.FileOffset)+int64(e.offset)); err != nil {
+			return m, fmt.Errorf("reading metadata item %s: %w", e.item, err)
+		}
+		items[e.item] = data
+	}
+
+	for _, item := range []struct {
+		id   GUID
+		name string
+		size int
+	}{
+		{FileParametersItem, "file parameters", 8},
+		{VirtualDiskSizeItem, "virtual disk size", 8},
+		{VirtualDiskIDItem, "virtual disk id", 16},
+		{LogicalSectorSizeItem, "logical sector size", 4},
+		{PhysicalSectorSizeItem, "physical sector size", 4},
+	} {
+		if len(items[item.id]) < item.size {
+			return m, fmt.Errorf("%s metadata missing: %w", item.name, ErrCorrupt)
+		}
+	}
+
+	params := items[FileParametersItem]
+	m.BlockSize = binary.LittleEndian.Uint32(params[0:4])
+	flags := binary.LittleEndian.Uint32(params[4:8])
+	m.LeaveBlocksAllocated = flags&fileParametersLeaveBlocksAllocated != 0
+	m.HasParent = flags&fileParametersHasParent != 0
+	m.VirtualSize = binary.LittleEndian.Uint64(items[VirtualDiskSizeItem])
+	copy(m.VirtualDiskID[:], items[VirtualDiskIDItem])
+	m.LogicalSectorSize = binary.LittleEndian.Uint32(items[LogicalSectorSizeItem])
+	m.PhysicalSectorSize = binary.LittleEndian.Uint32(items[PhysicalSectorSizeItem])
+
+	if err := m.check(); err != nil {
+		return m, err
+	}
+
+	if m.HasParent {
+		data, ok := items[ParentLocatorItem]
+		if !ok {
+			return m, fmt.Errorf("parent locator missing: %w", ErrCorrupt)
+		}
+		locator, err := parseParentLocator(data)
+		if err != nil {
+			return m, err
+		}
+		m.ParentLocator = locator
+	}
+	return m, nil
+}
+
+func knownMetadataItem(id GUID) bool {
+	switch id {
+	case FileParametersItem, VirtualDiskSizeItem, VirtualDiskIDItem,
+		LogicalSectorSizeItem, PhysicalSectorSizeItem, ParentLocatorItem:
+		return true
+	}
+	return false
+}
+
+// check validates the values against the limits of the specification
+func (m *Metadata) check() error {
+	if m.BlockSize < 1*MiB || m.BlockSize > 256*MiB || m.BlockSize&(m.BlockSize-1) != 0 {
+		return fmt.Errorf("block size %d: %w", m.BlockSize, ErrCorrupt)
+	}
+	if m.LogicalSectorSize != 512 && m.LogicalSectorSize != 4096 {
+		return fmt.Errorf("logical sector size %d: %w", m.LogicalSectorSize, ErrCorrupt)
+	}
+	if m.PhysicalSectorSize != 512 && m.PhysicalSectorSize != 4096 {
+		return fmt.Errorf("physical sector size %d: %w", m.PhysicalSectorSize, ErrCorrupt)
+	}
+	if m.VirtualSize == 0 || m.VirtualSize > 64*1024*1024*MiB || m.VirtualSize%uint64(m.LogicalSectorSize) != 0 {
+		return fmt.Errorf("virtual size %d: %w", m.VirtualSize, ErrCorrupt)
+	}
+	return nil
+}
+
+func parseParentLocator(data []byte) (*ParentLocator, error) {
+	if len(data) < 20 {
+		return nil, fmt.Errorf("parent locator of %d bytes: %w", len(data), ErrCorrupt)
+	}
+	p := &ParentLocator{Entries: make(map[string]string)}
+	copy(p.Type[:], data[0:16])
+	if p.Type != ParentLocatorVHDX {
+		return nil, fmt.Errorf("parent locator type %s: %w", p.Type, ErrUnsupported)
+	}
+
+	count := int(binary.LittleEndian.Uint16(data[18:20]))
+	if 20+count*parentLocatorEntrySize > len(data) {
+		return nil, fmt.Errorf("parent locator with %d entries: %w", count, ErrCorrupt)
+	}
+	for i := 0; i < count; i++ {
+		b := data[20+i*parentLocatorEntrySize:][:parentLocatorEntrySize]
+		keyOffset := int(binary.LittleEndian.Uint32(b[0:4]))
+		valueOffset := int(binary.LittleEndian.Uint32(b[4:8]))
+		keyLength := int(binary.LittleEndian.Uint16(b[8:10]))
+		valueLength := int(binary.LittleEndian.Uint16(b[10:12]))
+		if keyOffset+keyLength > len(data) || valueOffset+valueLength > len(data) {
+			return nil, fmt.Errorf("parent locator entry %d: %w", i, ErrCorrupt)
+		}
+		key := decodeUTF16(data[keyOffset : keyOffset+keyLength])
+		p.Entries[key] = decodeUTF16(data[valueOffset : valueOffset+valueLength])
+	}
+	if _, err := p.ParentLinkage(); err != nil {
+		return nil, fmt.Errorf("parent locator linkage: %w", ErrCorrupt)
+	}
+	return p, nil
+}
@@ -0,0 +1,324 @@
+// Package vhdx reads and validates VHDX virtual hard disk files without
+// Hyper-V, following the VHDX format specification version 1.0.
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"unicode/utf16"
+)
+
+const (
+	KiB = 1024
+	MiB = 1024 * KiB
+
+	fileIdentifierOffset = 0
+	headerOffset1        = 64 * KiB
+	headerOffset2        = 128 * KiB
+	regionTableOffset1   = 192 * KiB
+	regionTableOffset2   = 256 * KiB
+
+	headerSize      = 4 * KiB
+	regionTableSize = 64 * KiB
+	// headerSectionSize is the space taken by the identifier, the headers
+	// and the region tables at the start of the file
+	headerSectionSize = 1 * MiB
+
+	maxRegionEntries = 2047
+	regionEntrySize  = 32
+	creatorSize      = 512
+)
+
+var (
+	fileSignature        = []byte("vhdxfile")
+	headerSignature      = []byte("head")
+	regionTableSignature = []byte("regi")
+
+	// Region identifiers
+	BATRegion      = mustParseGUID("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	MetadataRegion = mustParseGUID("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+)
+
+var (
+	// ErrInvalidSignature means a structure does not start with the
+	// signature the format requires, the file is not a VHDX file or is
+	// damaged
+	ErrInvalidSignature = errors.New("invalid vhdx signature")
+	// ErrChecksumMismatch means the CRC-32C of a structure does not match
+	// its content
+	ErrChecksumMismatch = errors.New("vhdx checksum mismatch")
+	// ErrNoValidHeader means neither of the two headers can be used
+	ErrNoValidHeader = errors.New("no valid vhdx header")
+	// ErrUnsupported means the file uses a version or a required feature
+	// this package does not know
+	ErrUnsupported = errors.New("unsupported vhdx feature")
+	// ErrCorrupt means the structures of the file are inconsistent
+	ErrCorrupt = errors.New("corrupt vhdx file")
+	// ErrLogReplayRequired means the file was not closed cleanly and its
+	// log must be replayed, which this package does not do
+	ErrLogReplayRequired = errors.New("vhdx log replay required")
+)
+
+// castagnoli is the CRC-32C table all checksums of the format use
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Header is one of the two headers of a VHDX file, the valid one with the
+// highest sequence number is current
+type Header struct {
+	SequenceNumber uint64
+	FileWriteGUID  GUID
+	DataWriteGUID  GUID
+	// LogGUID is zero unless the log holds entries to replay
+	LogGUID    GUID
+	LogVersion uint16
+	Version    uint16
+	LogLength  uint32
+	LogOffset  uint64
+}
+
+// RegionEntry locates a region of the file
+type RegionEntry struct {
+	GUID       GUID
+	FileOffset uint64
+	Length     uint32
+	Required   bool
+}
+
+// File is an open VHDX file
+type File struct {
+	// Creator identifies the program that created the file
+	Creator string
+	// Header is the current header
+	Header Header
+	// Regions are the entries of the region table
+	Regions  []RegionEntry
+	Metadata Metadata
+	// BAT is the block allocation table, it interleaves the entries of
+	// payload blocks with those of sector bitmap blocks
+	BAT []BATEntry
+
+	r      io.ReaderAt
+	size   int64
+	closer io.Closer
+}
+
+// Open opens the VHDX file at path
+func Open(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	file, err := NewFile(f, st.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	file.closer = f
+	return file, nil
+}
+
+// NewFile reads the structures of the VHDX file of the given size held by
+// r
+func NewFile(r io.ReaderAt, size int64) (*File, error) {
+	f := &File{r: r, size: size}
+
+	var err error
+	if f.Creator, err = readFileIdentifier(r); err != nil {
+		return nil, err
+	}
+	if f.Header, err = readHeaders(r); err != nil {
+		return nil, err
+	}
+	if f.Regions, err = readRegionTables(r); err != nil {
+		return nil, err
+	}
+
+	metadata, ok := f.Region(MetadataRegion)
+	if !ok {
+		return nil, fmt.Errorf("metadata region missing: %w", ErrCorrupt)
+	}
+	if f.Metadata, err = readMetadata(r, metadata); err != nil {
+		return nil, err
+	}
+
+	bat, ok := f.Region(BATRegion)
+	if !ok {
+		return nil, fmt.Errorf("bat region missing: %w", ErrCorrupt)
+	}
+	if f.BAT, err = readBAT(r, bat, f.batEntries()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Close closes the file if it was opened with Open
+func (f *File) Close() error {
+	if f.closer == nil {
+		return nil
+	}
+	return f.closer.Close()
+}
+
+// Size returns the size of the file on disk
+func (f *File) Size() int64 {
+	return f.size
+}
+
+// Region looks up a region by its identifier
+func (f *File) Region(id GUID) (RegionEntry, bool) {
+	for _, r := range f.Regions {
+		if r.GUID == id {
+			return r, true
+		}
+	}
+	return RegionEntry{}, false
+}
+
+func readFileIdentifier(r io.ReaderAt) (string, error) {
+	buf := make([]byte, len(fileSignature)+creatorSize)
+	if _, err := r.ReadAt(buf, fileIdentifierOffset); err != nil {
+		return "", fmt.Errorf("reading file identifier: %w", err)
+	}
+	if !bytes.Equal(buf[:len(fileSignature)], fileSignature) {
+		return "", fmt.Errorf("file identifier: %w", ErrInvalidSignature)
+	}
+	return decodeUTF16(buf[len(fileSignature):]), nil
+}
+
+// readHeaders returns the current header.  A header that cannot be read
+// is skipped as long as the other one is valid.
+func readHeaders(r io.ReaderAt) (Header, error) {
+	var (
+		current Header
+		found   bool
+		errs    []error
+	)
+	for _, off := range []int64{headerOffset1, headerOffset2} {
+		h, err := readHeader(r, off)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("header at %d: %w", off, err))
+			continue
+		}
+		if !found || h.SequenceNumber > current.SequenceNumber {
+			current = h
+			found = true
+		}
+	}
+	if !found {
+		return current, fmt.Errorf("%w: %w", ErrNoValidHeader, errors.Join(errs...))
+	}
+	if current.Version != 1 {
+		return current, fmt.Errorf("header version %d: %w", current.Version, ErrUnsupported)
+	}
+	return current, nil
+}
+
+func readHeader(r io.ReaderAt, off int64) (Header, error) {
+	var h Header
+	buf := make([]byte, headerSize)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return h, err
+	}
+	if !bytes.Equal(buf[0:4], headerSignature) {
+		return h, ErrInvalidSignature
+	}
+	if err := verifyChecksum(buf, 4); err != nil {
+		return h, err
+	}
+
+	h.SequenceNumber = binary.LittleEndian.Uint64(buf[8:16])
+	copy(h.FileWriteGUID[:], buf[16:32])
+	copy(h.DataWriteGUID[:], buf[32:48])
+	copy(h.LogGUID[:], buf[48:64])
+	h.LogVersion = binary.LittleEndian.Uint16(buf[64:66])
+	h.Version = binary.LittleEndian.Uint16(buf[66:68])
+	h.LogLength = binary.LittleEndian.Uint32(buf[68:72])
+	h.LogOffset = binary.LittleEndian.Uint64(buf[72:80])
+	return h, nil
+}
+
+// readRegionTables returns the entries of the first valid region table
+func readRegionTables(r io.ReaderAt) ([]RegionEntry, error) {
+	var errs []error
+	for _, off := range []int64{regionTableOffset1, regionTableOffset2} {
+		entries, err := readRegionTable(r, off)
+		if err == nil {
+			return entries, nil
+		}
+		errs = append(errs, fmt.Errorf("region table at %d: %w", off, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+func readRegionTable(r io.ReaderAt, off int64) ([]RegionEntry, error) {
+	buf := make([]byte, regionTableSize)
+	if _, err := r.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf[0:4], regionTableSignature) {
+		return nil, ErrInvalidSignature
+	}
+	if err := verifyChecksum(buf, 4); err != nil {
+		return nil, err
+	}
+	count := binary.LittleEndian.Uint32(buf[8:12])
+	if count > maxRegionEntries {
+		return nil, fmt.Errorf("%d entries: %w", count, ErrCorrupt)
+	}
+
+	entries := make([]RegionEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		b := buf[16+i*regionEntrySize:][:regionEntrySize]
+		var e RegionEntry
+		copy(e.GUID[:], b[0:16])
+		e.FileOffset = binary.LittleEndian.Uint64(b[16:24])
+		e.Length = binary.LittleEndian.Uint32(b[24:28])
+		e.Required = binary.LittleEndian.Uint32(b[28:32])&1 != 0
+
+		if e.GUID != BATRegion && e.GUID != MetadataRegion && e.Required {
+			return nil, fmt.Errorf("required region %s: %w", e.GUID, ErrUnsupported)
+		}
+		if e.FileOffset%MiB != 0 || e.Length%MiB != 0 || e.FileOffset < headerSectionSize {
+			return nil, fmt.Errorf("region %s at %d with length %d: %w", e.GUID, e.FileOffset, e.Length, ErrCorrupt)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// verifyChecksum checks the CRC-32C of a structure, computed with its
+// checksum field at off set to zero
+func verifyChecksum(buf []byte, off int) error {
+	want := binary.LittleEndian.Uint32(buf[off:])
+	binary.LittleEndian.PutUint32(buf[off:], 0)
+	got := crc32.Checksum(buf, castagnoli)
+	binary.LittleEndian.PutUint32(buf[off:], want)
+	if got != want {
+		return fmt.Errorf("got %08x, want %08x: %w", got, want, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// decodeUTF16 decodes a little endian UTF-16 string, stopping at the first
+// NUL
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,425 @@
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"testing"
+)
+
+// fixture describes a VHDX file built by the tests.  The metadata region
+// is at 1 MiB, the BAT at 2 MiB, the log at 3 MiB and the payload blocks
+// follow.
+type fixture struct {
+	virtualSize        uint64
+	blockSize          uint32
+	logicalSectorSize  uint32
+	physicalSectorSize uint32
+	parent             map[string]string
+	// blocks holds the data of fully present payload blocks
+	blocks map[uint64][]byte
+	// extraRegion is added to the region table when set
+	extraRegion *RegionEntry
+	logGUID     GUID
+}
+
+func defaultFixture() *fixture {
+	return &fixture{
+		virtualSize:        4 * MiB,
+		blockSize:          1 * MiB,
+		logicalSectorSize:  512,
+		physicalSectorSize: 4096,
+		blocks:             map[uint64][]byte{1: bytes.Repeat([]byte("vhdx"), MiB/4)},
+	}
+}
+
+var testDiskID = mustParseGUID("01234567-89AB-CDEF-0123-456789ABCDEF")
+
+const (
+	fixtureMetadataOffset = 1 * MiB
+	fixtureBATOffset      = 2 * MiB
+	fixtureLogOffset      = 3 * MiB
+	fixtureDataOffset     = 4 * MiB
+)
+
+func (fx *fixture) build(t *testing.T) []byte {
+	t.Helper()
+
+	f := &File{Metadata: Metadata{
+		BlockSize:         fx.blockSize,
+		LogicalSectorSize: fx.logicalSectorSize,
+		VirtualSize:       fx.virtualSize,
+		HasParent:         fx.parent != nil,
+	}}
+	entries := f.batEntries()
+	data := make([]byte, fixtureDataOffset+uint64(len(fx.blocks))*uint64(fx.blockSize))
+
+	copy(data, fileSignature)
+	putUTF16(data[8:], "libhvee test")
+
+	for i, off := range []int{headerOffset1, headerOffset2} {
+		h := data[off : off+headerSize]
+		copy(h, headerSignature)
+		binary.LittleEndian.PutUint64(h[8:], uint64(i+1))
+		copy(h[48:], fx.logGUID[:])
+		binary.LittleEndian.PutUint16(h[66:], 1)
+		binary.LittleEndian.PutUint32(h[68:], MiB)
+		binary.LittleEndian.PutUint64(h[72:], fixtureLogOffset)
+		putChecksum(h, 4)
+	}
+
+	regions := []RegionEntry{
+		{GUID: MetadataRegion, FileOffset: fixtureMetadataOffset, Length: MiB, Required: true},
+		{GUID: BATRegion, FileOffset: fixtureBATOffset, Length: MiB, Required: true},
+	}
+	if fx.extraRegion != nil {
+		regions = append(regions, *fx.extraRegion)
+	}
+	for _, off := range []int{regionTableOffset1, regionTableOffset2} {
+		rt := data[off : off+regionTableSize]
+		copy(rt, regionTableSignature)
+		binary.LittleEndian.PutUint32(rt[8:], uint32(len(regions)))
+		for i, r := range regions {
+			e := rt[16+i*regionEntrySize:]
+			copy(e, r.GUID[:])
+			binary.LittleEndian.PutUint64(e[16:], r.FileOffset)
+			binary.LittleEndian.PutUint32(e[24:], r.Length)
+			if r.Required {
+				binary.LittleEndian.PutUint32(e[28:], 1)
+			}
+		}
+		putChecksum(rt, 4)
+	}
+
+	md := data[fixtureMetadataOffset : fixtureMetadataOffset+MiB]
+	copy(md, metadataSignature)
+	params := make([]byte, 8)
+	binary.LittleEndian.PutUint32(params, fx.blockSize)
+	if fx.parent != nil {
+		binary.LittleEndian.PutUint32(params[4:], fileParametersHasParent)
+	}
+	items := []struct {
+		id   GUID
+		data []byte
+	}{
+		{FileParametersItem, params},
+		{VirtualDiskSizeItem, binary.LittleEndian.AppendUint64(nil, fx.virtualSize)},
+		{VirtualDiskIDItem, testDiskID[:]},
+		{LogicalSectorSizeItem, binary.LittleEndian.AppendUint32(nil, fx.logicalSectorSize)},
+		{PhysicalSectorSizeItem, binary.LittleEndian.AppendUint32(nil, fx.physicalSectorSize)},
+	}
+	if fx.parent != nil {
+		items = append(items, struct {
+			id   GUID
+			data []byte
+		}{ParentLocatorItem, buildParentLocator(fx.parent)})
+	}
+	binary.LittleEndian.PutUint16(md[10:], uint16(len(items)))
+	itemOffset := metadataTableSize
+	for i, item := range items {
+		e := md[32+i*metadataEntrySize:]
+		copy(e, item.id[:])
+		binary.LittleEndian.PutUint32(e[16:], uint32(itemOffset))
+		binary.LittleEndian.PutUint32(e[20:], uint32(len(item.data)))
+		binary.LittleEndian.PutUint32(e[24:], metadataIsRequired)
+		copy(md[itemOffset:], item.data)
+		itemOffset += len(item.data)
+	}
+
+	bat := data[fixtureBATOffset : fixtureBATOffset+MiB]
+	if entries*batEntrySize > uint64(len(bat)) {
+		t.Fatalf("fixture needs %d bat entries", entries)
+	}
+	next := uint64(fixtureDataOffset)
+	for i := uint64(0); i < f.PayloadBlocks(); i++ {
+		index := i + i/f.ChunkRatio()
+		block, ok := fx.blocks[i]
+		if !ok {
+			continue
+		}
+		binary.LittleEndian.PutUint64(bat[index*batEntrySize:], next|uint64(PayloadBlockFullyPresent))
+		copy(data[next:], block)
+		next += uint64(fx.blockSize)
+	}
+	return data
+}
+
+func buildParentLocator(entries map[string]string) []byte {
+	// Keys are sorted so the layout is stable
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	header := make([]byte, 20+len(keys)*parentLocatorEntrySize)
+	copy(header, ParentLocatorVHDX[:])
+	binary.LittleEndian.PutUint16(header[18:], uint16(len(keys)))
+	var strs []byte
+	for i, k := range keys {
+		key, value := encodeUTF16(k), encodeUTF16(entries[k])
+		e := header[20+i*parentLocatorEntrySize:]
+		binary.LittleEndian.PutUint32(e[0:], uint32(len(header)+len(strs)))
+		binary.LittleEndian.PutUint32(e[4:], uint32(len(header)+len(strs)+len(key)))
+		binary.LittleEndian.PutUint16(e[8:], uint16(len(key)))
+		binary.LittleEndian.PutUint16(e[10:], uint16(len(value)))
+		strs = append(strs, key...)
+		strs = append(strs, value...)
+	}
+	return append(header, strs...)
+}
+
+func putUTF16(b []byte, s string) {
+	copy(b, encodeUTF16(s))
+}
+
+func openFixture(t *testing.T, data []byte) (*File, error) {
+	t.Helper()
+	return NewFile(bytes.NewReader(data), int64(len(data)))
+}
+
+func TestOpenDynamic(t *testing.T) {
+	fx := defaultFixture()
+	f, err := openFixture(t, fx.build(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Creator != "libhvee test" {
+		t.Errorf("creator %q", f.Creator)
+	}
+	if f.Header.SequenceNumber != 2 {
+		t.Errorf("header sequence %d, want the newest", f.Header.SequenceNumber)
+	}
+	want := Metadata{
+		BlockSize:          MiB,
+		VirtualSize:        4 * MiB,
+		VirtualDiskID:      testDiskID,
+		LogicalSectorSize:  512,
+		PhysicalSectorSize: 4096,
+	}
+	if f.Metadata != want {
+		t.Errorf("metadata %+v, want %+v", f.Metadata, want)
+	}
+	if len(f.BAT) != 4 {
+		t.Errorf("%d bat entries", len(f.BAT))
+	}
+	if e := f.PayloadBlock(1); e.State != PayloadBlockFullyPresent || e.FileOffset != fixtureDataOffset {
+		t.Errorf("block 1 %+v", e)
+	}
+	if err := f.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	content, err := io.ReadAll(io.NewSectionReader(f, 0, int64(f.Metadata.VirtualSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]byte, 4*MiB)
+	copy(expected[MiB:], fx.blocks[1])
+	if !bytes.Equal(content, expected) {
+		t.Error("content differs")
+	}
+}
+
+func TestOpenDifferencing(t *testing.T) {
+	fx := defaultFixture()
+	fx.parent = map[string]string{
+		ParentLinkageKey:     "{83F3F0A6-8E7E-4F4A-9F0F-2A0E6A3D2A11}",
+		RelativePathKey:      `.\base.vhdx`,
+		AbsoluteWin32PathKey: `C:\disks\base.vhdx`,
+	}
+	f, err := openFixture(t, fx.build(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !f.Metadata.HasParent || f.Metadata.ParentLocator == nil {
+		t.Fatal("parent missing")
+	}
+	for k, v := range fx.parent {
+		if got := f.Metadata.ParentLocator.Entries[k]; got != v {
+			t.Errorf("%s = %q, want %q", k, got, v)
+		}
+	}
+	linkage, err := f.Metadata.ParentLocator.ParentLinkage()
+	if err != nil || linkage.String() != "83F3F0A6-8E7E-4F4A-9F0F-2A0E6A3D2A11" {
+		t.Errorf("linkage %s: %v", linkage, err)
+	}
+	if uint64(len(f.BAT)) != f.ChunkRatio()+1 {
+		t.Errorf("%d bat entries", len(f.BAT))
+	}
+	if _, ok := f.SectorBitmapBlock(0); !ok {
+		t.Error("sector bitmap entry missing")
+	}
+	if err := f.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	buf := make([]byte, 512)
+	if _, err := f.ReadAt(buf, MiB); err != nil {
+		t.Error(err)
+	}
+	if _, err := f.ReadAt(buf, 0); !errors.Is(err, ErrParentRequired) {
+		t.Errorf("got %v, want %v", err, ErrParentRequired)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	data := defaultFixture().build(t)
+	// Damage the newest header, the older one takes over
+	data[headerOffset2+100] ^= 0xff
+	f, err := openFixture(t, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Header.SequenceNumber != 1 {
+		t.Errorf("header sequence %d", f.Header.SequenceNumber)
+	}
+
+	data[headerOffset1+100] ^= 0xff
+	_, err = openFixture(t, data)
+	if !errors.Is(err, ErrNoValidHeader) || !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("got %v, want %v", err, ErrNoValidHeader)
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(fx *fixture, data []byte)
+		want   error
+	}{
+		{
+			name:   "signature",
+			modify: func(_ *fixture, data []byte) { copy(data, "notvhdx!") },
+			want:   ErrInvalidSignature,
+		},
+		{
+			name: "region tables",
+			modify: func(_ *fixture, data []byte) {
+				data[regionTableOffset1+100] ^= 0xff
+				data[regionTableOffset2+100] ^= 0xff
+			},
+			want: ErrChecksumMismatch,
+		},
+		{
+			name: "metadata signature",
+			modify: func(_ *fixture, data []byte) {
+				copy(data[fixtureMetadataOffset:], "nothing!")
+			},
+			want: ErrInvalidSignature,
+		},
+		{
+			name: "block size",
+			modify: func(_ *fixture, data []byte) {
+				binary.LittleEndian.PutUint32(data[fixtureMetadataOffset+metadataTableSize:], 3*MiB)
+			},
+			want: ErrCorrupt,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fx := defaultFixture()
+			data := fx.build(t)
+			tt.modify(fx, data)
+			if _, err := openFixture(t, data); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequiredRegion(t *testing.T) {
+	fx := defaultFixture()
+	fx.extraRegion = &RegionEntry{
+		GUID:       mustParseGUID("11111111-2222-3333-4444-555555555555"),
+		FileOffset: 8 * MiB,
+		Length:     MiB,
+		Required:   true,
+	}
+	if _, err := openFixture(t, fx.build(t)); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("got %v, want %v", err, ErrUnsupported)
+	}
+
+	fx.extraRegion.Required = false
+	if _, err := openFixture(t, fx.build(t)); err != nil {
+		t.Errorf("optional region: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	fx := defaultFixture()
+	fx.blocks[2] = make([]byte, MiB)
+	data := fx.build(t)
+
+	f, err := openFixture(t, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	f.BAT[2].FileOffset = f.BAT[1].FileOffset
+	if err := f.Validate(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("overlap: got %v", err)
+	}
+	f.BAT[2].FileOffset = uint64(len(data))
+	if err := f.Validate(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("past end: got %v", err)
+	}
+	f.BAT[2].FileOffset = fixtureBATOffset
+	if err := f.Validate(); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("bat overlap: got %v", err)
+	}
+
+	fx.logGUID = mustParseGUID("11111111-2222-3333-4444-555555555555")
+	f, err = openFixture(t, fx.build(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Validate(); !errors.Is(err, ErrLogReplayRequired) {
+		t.Errorf("got %v, want %v", err, ErrLogReplayRequired)
+	}
+}
+
+func TestBATLayout(t *testing.T) {
+	f := &File{Metadata: Metadata{BlockSize: MiB, LogicalSectorSize: 512, VirtualSize: 4097 * MiB}}
+	if f.ChunkRatio() != 4096 {
+		t.Fatalf("chunk ratio %d", f.ChunkRatio())
+	}
+	if f.batEntries() != 4098 {
+		t.Errorf("%d entries", f.batEntries())
+	}
+
+	f.BAT = make([]BATEntry, f.batEntries())
+	f.BAT[4097] = BATEntry{State: PayloadBlockFullyPresent, FileOffset: 5 * MiB}
+	if e := f.PayloadBlock(4096); e.FileOffset != 5*MiB {
+		t.Errorf("block 4096 maps to %+v", e)
+	}
+
+	f.Metadata.HasParent = true
+	if f.batEntries() != 2*4097 {
+		t.Errorf("%d differencing entries", f.batEntries())
+	}
+}
+
+func TestGUID(t *testing.T) {
+	g, err := ParseGUID("{2DC27766-F623-4200-9D64-115E9BFD4A08}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x66, 0x77, 0xc2, 0x2d, 0x23, 0xf6, 0x00, 0x42, 0x9d, 0x64, 0x11, 0x5e, 0x9b, 0xfd, 0x4a, 0x08}
+	if !bytes.Equal(g[:], want) {
+		t.Errorf("encoded % x", g[:])
+	}
+	if g.String() != "2DC27766-F623-4200-9D64-115E9BFD4A08" {
+		t.Errorf("formatted %s", g)
+	}
+	if _, err := ParseGUID("2DC27766-F623"); err == nil {
+		t.Error("short guid parsed")
+	}
+}
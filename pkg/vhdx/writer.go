@@ -0,0 +1,287 @@
+package vhdx
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"unicode/utf16"
+)
+
+const (
+	// DefaultBlockSize is the block size Hyper-V uses for dynamic disks
+	DefaultBlockSize = 32 * MiB
+
+	metadataIsVirtualDisk = 1 << 1
+
+	// The writer places the log, the metadata and the BAT after the
+	// headers, payload blocks follow the BAT
+	writerLogOffset      = headerSectionSize
+	writerLogLength      = 1 * MiB
+	writerMetadataOffset = writerLogOffset + writerLogLength
+	writerMetadataLength = 1 * MiB
+	writerBATOffset      = writerMetadataOffset + writerMetadataLength
+)
+
+// ErrSizeExceeded means more data was written than the virtual size
+var ErrSizeExceeded = errors.New("write beyond the virtual size")
+
+// zeroChunk is compared against to find blocks that need no space
+var zeroChunk = make([]byte, 64*KiB)
+
+// WriterOptions control the layout of a VHDX file created by Writer
+type WriterOptions struct {
+	// BlockSize is the allocation unit, DefaultBlockSize when zero.
+	// Smaller blocks make sparse images smaller.
+	BlockSize uint32
+	// LogicalSectorSize is 512 by default
+	LogicalSectorSize uint32
+	// PhysicalSectorSize is 4096 by default
+	PhysicalSectorSize uint32
+	// Creator is recorded in the file identifier
+	Creator string
+}
+
+// Writer creates a dynamic VHDX file from the content of the virtual disk,
+// written in order.  Blocks holding only zeros take no space in the file.
+type Writer struct {
+	w       io.WriterAt
+	opts    WriterOptions
+	file    *File
+	buf     []byte
+	block   uint64
+	next    uint64
+	written uint64
+	closed  bool
+}
+
+// NewWriter starts a VHDX file with a virtual disk of size bytes in w,
+// which must be empty.  The size is rounded up to the logical sector size.
+func NewWriter(w io.WriterAt, size uint64, opts *WriterOptions) (*Writer, error) {
+	var o WriterOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.BlockSize == 0 {
+		o.BlockSize = DefaultBlockSize
+	}
+	if o.LogicalSectorSize == 0 {
+		o.LogicalSectorSize = 512
+	}
+	if o.PhysicalSectorSize == 0 {
+		o.PhysicalSectorSize = 4096
+	}
+
+	f := &File{Metadata: Metadata{
+		BlockSize:          o.BlockSize,
+		VirtualSize:        divRoundUp(size, uint64(o.LogicalSectorSize)) * uint64(o.LogicalSectorSize),
+		LogicalSectorSize:  o.LogicalSectorSize,
+		PhysicalSectorSize: o.PhysicalSectorSize,
+	}}
+	if err := f.Metadata.check(); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(f.Metadata.VirtualDiskID[:]); err != nil {
+		return nil, err
+	}
+	f.BAT = make([]BATEntry, f.batEntries())
+
+	return &Writer{
+		w:    w,
+		opts: o,
+		file: f,
+		buf:  make([]byte, 0, o.BlockSize),
+		next: writerBATOffset + batLength(len(f.BAT)),
+	}, nil
+}
+
+// Write adds p to the content of the virtual disk
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed vhdx writer")
+	}
+	if w.written+uint64(len(p)) > w.file.Metadata.VirtualSize {
+		return 0, ErrSizeExceeded
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		l := min(cap(w.buf)-len(w.buf), len(p))
+		w.buf = append(w.buf, p[:l]...)
+		p = p[l:]
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	w.written += uint64(n)
+	return n, nil
+}
+
+// flush stores the current block unless it holds only zeros
+func (w *Writer) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	if !isZero(w.buf) {
+		// A partial last block is padded so the file holds whole blocks
+		clear(w.buf[len(w.buf):cap(w.buf)])
+		block := w.buf[:cap(w.buf)]
+		if _, err := w.w.WriteAt(block, int64(w.next)); err != nil {
+			return err
+		}
+		index := w.block + w.block/w.file.ChunkRatio()
+		w.file.BAT[index] = BATEntry{State: PayloadBlockFullyPresent, FileOffset: w.next}
+		w.next += uint64(len(block))
+	}
+	w.block++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close writes the remaining data and the structures describing it.  The
+// headers go last, so the file is only valid once Close succeeds.  The
+// underlying writer is not closed.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	bat := make([]byte, batLength(len(w.file.BAT)))
+	for i, e := range w.file.BAT {
+		binary.LittleEndian.PutUint64(bat[i*batEntrySize:], e.FileOffset|uint64(e.State))
+	}
+	if _, err := w.w.WriteAt(bat, writerBATOffset); err != nil {
+		return err
+	}
+	if _, err := w.w.WriteAt(make([]byte, writerLogLength), writerLogOffset); err != nil {
+		return err
+	}
+	if _, err := w.w.WriteAt(w.metadata(), writerMetadataOffset); err != nil {
+		return err
+	}
+
+	regions := w.regionTable(len(bat))
+	for _, off := range []int64{regionTableOffset1, regionTableOffset2} {
+		if _, err := w.w.WriteAt(regions, off); err != nil {
+			return err
+		}
+	}
+
+	var fileWrite, dataWrite GUID
+	if _, err := rand.Read(fileWrite[:]); err != nil {
+		return err
+	}
+	if _, err := rand.Read(dataWrite[:]); err != nil {
+		return err
+	}
+	for i, off := range []int64{headerOffset1, headerOffset2} {
+		h := make([]byte, headerSize)
+		copy(h, headerSignature)
+		binary.LittleEndian.PutUint64(h[8:], uint64(i))
+		copy(h[16:], fileWrite[:])
+		copy(h[32:], dataWrite[:])
+		binary.LittleEndian.PutUint16(h[66:], 1)
+		binary.LittleEndian.PutUint32(h[68:], writerLogLength)
+		binary.LittleEndian.PutUint64(h[72:], writerLogOffset)
+		putChecksum(h, 4)
+		if _, err := w.w.WriteAt(h, off); err != nil {
+			return err
+		}
+	}
+
+	ident := make([]byte, headerOffset1)
+	copy(ident, fileSignature)
+	creator := encodeUTF16(w.opts.Creator)
+	copy(ident[len(fileSignature):len(fileSignature)+creatorSize-2], creator)
+	_, err := w.w.WriteAt(ident, fileIdentifierOffset)
+	return err
+}
+
+func (w *Writer) metadata() []byte {
+	m := &w.file.Metadata
+	params := make([]byte, 8)
+	binary.LittleEndian.PutUint32(params, m.BlockSize)
+
+	items := []struct {
+		id    GUID
+		flags uint32
+		data  []byte
+	}{
+		{FileParametersItem, metadataIsRequired, params},
+		{VirtualDiskSizeItem, metadataIsVirtualDisk | metadataIsRequired, binary.LittleEndian.AppendUint64(nil, m.VirtualSize)},
+		{VirtualDiskIDItem, metadataIsVirtualDisk | metadataIsRequired, m.VirtualDiskID[:]},
+		{LogicalSectorSizeItem, metadataIsVirtualDisk | metadataIsRequired, binary.LittleEndian.AppendUint32(nil, m.LogicalSectorSize)},
+		{PhysicalSectorSizeItem, metadataIsVirtualDisk | metadataIsRequired, binary.LittleEndian.AppendUint32(nil, m.PhysicalSectorSize)},
+	}
+
+	buf := make([]byte, writerMetadataLength)
+	copy(buf, metadataSignature)
+	binary.LittleEndian.PutUint16(buf[10:], uint16(len(items)))
+	offset := metadataTableSize
+	for i, item := range items {
+		e := buf[32+i*metadataEntrySize:]
+		copy(e, item.id[:])
+		binary.LittleEndian.PutUint32(e[16:], uint32(offset))
+		binary.LittleEndian.PutUint32(e[20:], uint32(len(item.data)))
+		binary.LittleEndian.PutUint32(e[24:], item.flags)
+		copy(buf[offset:], item.data)
+		offset += len(item.data)
+	}
+	return buf
+}
+
+func (w *Writer) regionTable(batLength int) []byte {
+	regions := []RegionEntry{
+		{GUID: BATRegion, FileOffset: writerBATOffset, Length: uint32(batLength), Required: true},
+		{GUID: MetadataRegion, FileOffset: writerMetadataOffset, Length: writerMetadataLength, Required: true},
+	}
+	buf := make([]byte, regionTableSize)
+	copy(buf, regionTableSignature)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(regions)))
+	for i, r := range regions {
+		e := buf[16+i*regionEntrySize:]
+		copy(e, r.GUID[:])
+		binary.LittleEndian.PutUint64(e[16:], r.FileOffset)
+		binary.LittleEndian.PutUint32(e[24:], r.Length)
+		binary.LittleEndian.PutUint32(e[28:], 1)
+	}
+	putChecksum(buf, 4)
+	return buf
+}
+
+// batLength is the size of the BAT region, a multiple of 1 MiB
+func batLength(entries int) uint64 {
+	return max(divRoundUp(uint64(entries)*batEntrySize, MiB), 1) * MiB
+}
+
+func isZero(b []byte) bool {
+	for len(b) > 0 {
+		l := min(len(b), len(zeroChunk))
+		if !bytes.Equal(b[:l], zeroChunk[:l]) {
+			return false
+		}
+		b = b[l:]
+	}
+	return true
+}
+
+func putChecksum(b []byte, off int) {
+	binary.LittleEndian.PutUint32(b[off:], 0)
+	binary.LittleEndian.PutUint32(b[off:], crc32.Checksum(b, castagnoli))
+}
+
+func encodeUTF16(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, c)
+	}
+	return b
+}
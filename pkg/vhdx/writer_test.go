@@ -0,0 +1,183 @@
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/libhvee/pkg/qcow2"
+)
+
+// testContent returns a disk image of size bytes where the blocks listed in
+// zero hold only zeros
+func testContent(size int, zero ...int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, b := range zero {
+		clear(data[b*MiB : min((b+1)*MiB, size)])
+	}
+	return data
+}
+
+// checkContent verifies that the virtual disk of f holds want followed by
+// zeros
+func checkContent(t *testing.T, f *File, want []byte) {
+	t.Helper()
+	got, err := io.ReadAll(io.NewSectionReader(f, 0, int64(f.Metadata.VirtualSize)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got[:len(want)], want) {
+		t.Error("content differs")
+	}
+	if !isZero(got[len(want):]) {
+		t.Error("padding is not zero")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	// Not a multiple of the block or the sector size
+	content := testContent(5*MiB+100, 1, 3)
+	path := filepath.Join(t.TempDir(), "disk.vhdx")
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &WriterOptions{BlockSize: MiB, Creator: "libhvee test"}
+	if err := Convert(out, bytes.NewReader(content), uint64(len(content)), opts); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Creator != "libhvee test" {
+		t.Errorf("creator %q", f.Creator)
+	}
+	if f.Metadata.VirtualSize != 5*MiB+512 || f.Metadata.BlockSize != MiB || f.Metadata.HasParent {
+		t.Errorf("metadata %+v", f.Metadata)
+	}
+	if f.Metadata.LogicalSectorSize != 512 || f.Metadata.PhysicalSectorSize != 4096 {
+		t.Errorf("sector sizes %d/%d", f.Metadata.LogicalSectorSize, f.Metadata.PhysicalSectorSize)
+	}
+	for i := uint64(0); i < f.PayloadBlocks(); i++ {
+		want := PayloadBlockFullyPresent
+		if i == 1 || i == 3 {
+			want = PayloadBlockNotPresent
+		}
+		if e := f.PayloadBlock(i); e.State != want {
+			t.Errorf("block %d is in state %d, want %d", i, e.State, want)
+		}
+	}
+	// Headers, log, metadata and BAT take 4 MiB, four blocks are stored
+	if f.Size() != 8*MiB {
+		t.Errorf("file of %d bytes", f.Size())
+	}
+	checkContent(t, f, content)
+}
+
+func TestWriterErrors(t *testing.T) {
+	var buf writerAtBuffer
+	w, err := NewWriter(&buf, MiB, &WriterOptions{BlockSize: MiB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, MiB+1)); !errors.Is(err, ErrSizeExceeded) {
+		t.Errorf("got %v, want %v", err, ErrSizeExceeded)
+	}
+	if _, err := NewWriter(&buf, MiB, &WriterOptions{BlockSize: 3 * MiB}); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("block size: got %v", err)
+	}
+	if _, err := NewWriter(&buf, 0, nil); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("empty disk: got %v", err)
+	}
+}
+
+func TestConvertFile(t *testing.T) {
+	dir := t.TempDir()
+
+	content := testContent(3*MiB, 0)
+	raw := filepath.Join(dir, "disk.raw")
+	if err := os.WriteFile(raw, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	qcow := filepath.Join(dir, "disk.qcow2")
+	if err := os.WriteFile(qcow, buildQcow2(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, src := range []string{raw, qcow} {
+		t.Run(filepath.Ext(src), func(t *testing.T) {
+			dst := src + ".vhdx"
+			if err := ConvertFile(dst, src, &WriterOptions{BlockSize: MiB}); err != nil {
+				t.Fatal(err)
+			}
+			f, err := Open(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if err := f.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if f.PayloadBlock(0).State != PayloadBlockNotPresent {
+				t.Error("zero block allocated")
+			}
+			checkContent(t, f, content)
+
+			// The destination is never overwritten
+			if err := ConvertFile(dst, src, nil); !errors.Is(err, os.ErrExist) {
+				t.Errorf("got %v, want %v", err, os.ErrExist)
+			}
+		})
+	}
+}
+
+// buildQcow2 stores content in a version 2 qcow2 image with 64 KiB
+// clusters, leaving clusters of zeros unallocated
+func buildQcow2(content []byte) []byte {
+	const clusterSize = 64 * KiB
+
+	img := make([]byte, 3*clusterSize)
+	copy(img, qcow2.Magic)
+	binary.BigEndian.PutUint32(img[4:], 2)
+	binary.BigEndian.PutUint32(img[20:], 16)
+	binary.BigEndian.PutUint64(img[24:], uint64(len(content)))
+	binary.BigEndian.PutUint32(img[36:], 1)
+	binary.BigEndian.PutUint64(img[40:], clusterSize)
+	binary.BigEndian.PutUint64(img[clusterSize:], 2*clusterSize)
+
+	for i := 0; i*clusterSize < len(content); i++ {
+		c := content[i*clusterSize:][:clusterSize]
+		if isZero(c) {
+			continue
+		}
+		binary.BigEndian.PutUint64(img[2*clusterSize+i*8:], uint64(len(img)))
+		img = append(img, c...)
+	}
+	return img
+}
+
+// writerAtBuffer is an in-memory io.WriterAt
+type writerAtBuffer struct {
+	data []byte
+}
+
+func (b *writerAtBuffer) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(b.data) {
+		b.data = append(b.data, make([]byte, end-len(b.data))...)
+	}
+	return copy(b.data[off:], p), nil
+}
@@ -64,6 +64,13 @@ func NextObject(enum *Enum, target interface{}) (bool, error) {
 
 // Next returns the next object instance in this iteration
 func (e *Enum) Next() (instance *Instance, err error) {
+	instance, _, err = e.next(WBEM_INFINITE)
+	return instance, err
+}
+
+// next waits up to timeout milliseconds for the next object, timedOut is
+// set when none arrived in time
+func (e *Enum) next(timeout uint32) (instance *Instance, timedOut bool, err error) {
 	var res uintptr
 	var apObjects *ole.IUnknown
 	var uReturned uint32
@@ -71,23 +78,25 @@ func (e *Enum) Next() (instance *Instance, err error) {
 	res, _, _ = syscall.SyscallN(
 		e.vTable.Next,                       // IEnumWbemClassObject::Next()
 		uintptr(unsafe.Pointer(e.enum)),     // IEnumWbemClassObject   ptr
-		uintptr(WBEM_INFINITE),              // [in]  long             lTimeout,
+		uintptr(timeout),                    // [in]  long             lTimeout,
 		uintptr(1),                          // [in]  ULONG            uCount,
 		uintptr(unsafe.Pointer(&apObjects)), // [out] IWbemClassObject **apObjects,
 		uintptr(unsafe.Pointer(&uReturned))) // [out] ULONG            *puReturned)
 	if int(res) < 0 {
-		return nil, NewWmiError(res)
+		return nil, false, NewWmiError(res)
 	}
 
 	if uReturned < 1 {
 		switch res {
 		case WBEM_S_NO_ERROR, WBEM_S_FALSE:
 			// No more elements
-			return nil, nil
+			return nil, false, nil
+		case WBEM_S_TIMEDOUT:
+			return nil, true, nil
 		default:
-			return nil, fmt.Errorf("failure advancing enumeration (%d)", res)
+			return nil, false, fmt.Errorf("failure advancing enumeration (%d)", res)
 		}
 	}
 
-	return newInstance(apObjects, e.service), nil
+	return newInstance(apObjects, e.service), false, nil
 }
@@ -3,11 +3,17 @@
 package wmiext
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"time"
 )
 
+// ErrJobTerminated reports a job that stopped after WaitJobContext asked it
+// to terminate, it no longer uses the resources it worked on
+var ErrJobTerminated = errors.New("job terminated")
+
 type JobError struct {
 	ErrorCode   int
 	Description string
@@ -20,28 +26,121 @@ func (err *JobError) Error() string {
 	return fmt.Sprintf("Job failed with error code: %d", err.ErrorCode)
 }
 
+// JobState is the state of a CIM_ConcreteJob
+type JobState uint16
+
+const (
+	JobStateNew          JobState = 2
+	JobStateStarting     JobState = 3
+	JobStateRunning      JobState = 4
+	JobStateSuspended    JobState = 5
+	JobStateShuttingDown JobState = 6
+	JobStateCompleted    JobState = 7
+	JobStateTerminated   JobState = 8
+	JobStateKilled       JobState = 9
+	JobStateException    JobState = 10
+)
+
+// Finished reports whether the job stopped running, successfully or not
+func (s JobState) Finished() bool {
+	return s >= JobStateCompleted
+}
+
+// Requested state that asks a job to stop
+const jobRequestTerminate = 4
+
+const jobPollInterval = 100 * time.Millisecond
+
+// How many times in a row refreshing a job may fail before the wait gives up
+const maxRefetchErrors = 5
+
+// How long a job asked to terminate may take to stop
+const jobTerminateTimeout = 30 * time.Second
+
+// JobProgress describes a running job
+type JobProgress struct {
+	State           JobState
+	PercentComplete uint16
+	// JobStatus is the free form status the provider reports
+	JobStatus string
+}
+
 // WaitJob waits on the specified job instance until it has completed and
 // returns a JobError containing the result code in the event of
 // a failure.
 func WaitJob(service *Service, job *Instance) error {
+	return WaitJobProgress(service, job, nil)
+}
+
+// WaitJobProgress is like WaitJob, and calls progress with the completion
+// percentage of the job every time it changes
+func WaitJobProgress(service *Service, job *Instance, progress func(percent uint16)) error {
+	var status func(JobProgress)
+	if progress != nil {
+		lastPercent := -1
+		status = func(p JobProgress) {
+			if int(p.PercentComplete) != lastPercent {
+				lastPercent = int(p.PercentComplete)
+				progress(p.PercentComplete)
+			}
+		}
+	}
+	return WaitJobContext(context.Background(), service, job, status)
+}
+
+// WaitJobContext is like WaitJob, and calls progress, if not nil, every
+// time the state, percentage or status of the job changes.  When ctx ends
+// first the job is asked to terminate and the error wraps ctx.Err(), and
+// ErrJobTerminated once the job stopped.
+func WaitJobContext(ctx context.Context, service *Service, job *Instance, progress func(JobProgress)) error {
 	var jobs []*Instance
+	var last *JobProgress
 	defer func() {
 		for _, job := range jobs {
 			job.Close()
 		}
 	}()
+
+	refetchErrors := 0
+	timer := time.NewTimer(jobPollInterval)
+	defer timer.Stop()
 	for {
 		state, _, _, err := job.GetAsAny("JobState")
 		if err != nil {
 			return err
 		}
-		time.Sleep(100 * time.Millisecond)
-		job, _ = service.RefetchObject(job)
-		jobs = append(jobs, job)
-		// 7+ = completed
-		if state.(int32) >= 7 {
+		current := JobProgress{State: JobState(state.(int32))}
+		if progress != nil {
+			if percent, err := job.GetAsUint("PercentComplete"); err == nil {
+				current.PercentComplete = uint16(percent)
+			}
+			current.JobStatus, _ = job.GetAsString("JobStatus")
+			if last == nil || *last != current {
+				last = &current
+				progress(current)
+			}
+		}
+		if current.State.Finished() {
 			break
 		}
+
+		select {
+		case <-ctx.Done():
+			return cancelJob(ctx, service, job)
+		case <-timer.C:
+			timer.Reset(jobPollInterval)
+		}
+		refetched, err := service.RefetchObject(job)
+		if err != nil {
+			// The job state is read again from the last instance
+			if refetchErrors++; refetchErrors >= maxRefetchErrors {
+				return fmt.Errorf("could not refresh job state: %w", err)
+			}
+			continue
+		}
+		refetchErrors = 0
+		job = refetched
+		jobs = append(jobs, job)
 	}
 
 	result, _, _, err := job.GetAsAny("ErrorCode")
@@ -65,3 +164,48 @@ func WaitJob(service *Service, job *Instance) error {
 
 	return nil
 }
+
+// cancelJob asks a job to terminate after ctx ended and waits until it
+// stops, not every job can be terminated
+func cancelJob(ctx context.Context, service *Service, job *Instance) error {
+	var res int32
+	err := job.BeginInvoke("RequestStateChange").
+		In("RequestedState", uint16(jobRequestTerminate)).
+		Execute().
+		Out("ReturnValue", &res).
+		End()
+	if err == nil && res != 0 && res != 4096 {
+		err = fmt.Errorf("result code %d", res)
+	}
+	if err == nil {
+		err = waitJobStopped(service, job)
+	}
+	if err != nil {
+		return fmt.Errorf("job abandoned, terminating it failed: %w: %w", ctx.Err(), err)
+	}
+	return fmt.Errorf("%w: %w", ErrJobTerminated, ctx.Err())
+}
+
+// waitJobStopped polls a job asked to terminate until it reaches a finished
+// state
+func waitJobStopped(service *Service, job *Instance) error {
+	deadline := time.Now().Add(jobTerminateTimeout)
+	for {
+		refetched, err := service.RefetchObject(job)
+		if err != nil {
+			return fmt.Errorf("could not refresh job state: %w", err)
+		}
+		state, _, _, err := refetched.GetAsAny("JobState")
+		refetched.Close()
+		if err != nil {
+			return err
+		}
+		if JobState(state.(int32)).Finished() {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("job still running after %s", jobTerminateTimeout)
+		}
+		time.Sleep(jobPollInterval)
+	}
+}
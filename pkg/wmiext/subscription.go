@@ -0,0 +1,75 @@
+//go:build windows
+
+package wmiext
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/go-ole/go-ole"
+)
+
+// Subscription delivers the events matching a notification query.  WMI
+// queues events until they are read with Next.
+type Subscription struct {
+	enum *Enum
+}
+
+// Subscribe starts an event notification query, for example
+//
+//	SELECT * FROM __InstanceModificationEvent WITHIN 1 WHERE TargetInstance ISA 'Msvm_ComputerSystem'
+func (s *Service) Subscribe(wql string) (*Subscription, error) {
+	var err error
+	var pEnum *ole.IUnknown
+	var strQuery *uint16
+	var strQL *uint16
+
+	if strQL, err = syscall.UTF16PtrFromString("WQL"); err != nil {
+		return nil, err
+	}
+
+	if strQuery, err = syscall.UTF16PtrFromString(wql); err != nil {
+		return nil, err
+	}
+
+	// Notification queries must be semisynchronous
+	flags := WBEM_FLAG_FORWARD_ONLY | WBEM_FLAG_RETURN_IMMEDIATELY
+
+	hres, _, _ := syscall.SyscallN(
+		s.vTable.ExecNotificationQuery,     // IWbemServices::ExecNotificationQuery(
+		uintptr(unsafe.Pointer(s.service)), // IWbemServices ptr
+		uintptr(unsafe.Pointer(strQL)),     // [in] const BSTR           strQueryLanguage,
+		uintptr(unsafe.Pointer(strQuery)),  // [in] const BSTR           strQuery,
+		uintptr(flags),                     // [in] long                 lFlags,
+		uintptr(0),                         // [in] IWbemContext         *pCtx,
+		uintptr(unsafe.Pointer(&pEnum)))    // [out] IEnumWbemClassObject **ppEnum)
+	if hres != 0 {
+		return nil, NewWmiError(hres)
+	}
+
+	if err = CoSetProxyBlanket(pEnum); err != nil {
+		pEnum.Release()
+		return nil, err
+	}
+
+	return &Subscription{enum: newEnum(pEnum, s)}, nil
+}
+
+// Next waits up to timeout for the next event, a negative timeout waits
+// forever.  It returns nil without an error when no event arrived in time.
+func (sub *Subscription) Next(timeout time.Duration) (*Instance, error) {
+	ms := uint32(WBEM_INFINITE)
+	if timeout >= 0 {
+		ms = uint32(min(timeout.Milliseconds(), WBEM_INFINITE-1))
+	}
+	event, _, err := sub.enum.next(ms)
+	return event, err
+}
+
+// Close cancels the query
+func (sub *Subscription) Close() {
+	if sub != nil {
+		sub.enum.Close()
+	}
+}
@@ -1,12 +1,18 @@
 package e2e
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/containers/libhvee/pkg/hypervctl"
+	"github.com/containers/libhvee/pkg/nocloud"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"go.podman.io/storage/pkg/stringid"
 )
 
 var (
@@ -67,4 +73,277 @@ var _ = Describe("basic operation test", func() {
 		Expect(err).To(BeNil())
 		noDefer = true
 	})
+
+	It("pause, resume, save, reset, turn off", func() {
+		tvm, err := newDefaultVM()
+		Expect(err).To(BeNil())
+		defer removeOnError(tvm)
+
+		Expect(tvm.vm.Pause()).To(MatchError(hypervctl.ErrMachineNotRunning))
+		Expect(tvm.vm.TurnOff()).To(MatchError(hypervctl.ErrMachineNotRunning))
+
+		err = tvm.vm.Start()
+		Expect(err).To(BeNil())
+		err = tvm.refresh()
+		Expect(err).To(BeNil())
+
+		Expect(tvm.vm.Pause()).To(Succeed())
+		Expect(tvm.vm.State()).To(Equal(hypervctl.Paused))
+		Expect(tvm.vm.Pause()).To(MatchError(hypervctl.ErrMachineAlreadyPaused))
+
+		Expect(tvm.vm.Resume()).To(Succeed())
+		Expect(tvm.vm.State()).To(Equal(hypervctl.Enabled))
+		Expect(tvm.vm.Resume()).To(MatchError(hypervctl.ErrMachineAlreadyRunning))
+
+		Expect(tvm.vm.Save()).To(Succeed())
+		Expect(tvm.vm.State()).To(Equal(hypervctl.Saved))
+		Expect(tvm.vm.Resume()).To(Succeed())
+
+		Expect(tvm.vm.Reset()).To(Succeed())
+		Expect(tvm.vm.State()).To(Equal(hypervctl.Enabled))
+
+		Expect(tvm.vm.TurnOff()).To(Succeed())
+		Expect(tvm.vm.State()).To(Equal(hypervctl.Disabled))
+
+		err = tvm.vm.Remove(tvm.config.DiskPath)
+		Expect(err).To(BeNil())
+	})
+
+	It("create, list, rename, apply and delete checkpoints", func() {
+		tvm, err := newDefaultVM()
+		Expect(err).To(BeNil())
+		defer removeOnError(tvm)
+
+		first, err := tvm.vm.CreateCheckpoint("first", hypervctl.CheckpointStandard)
+		Expect(err).To(BeNil())
+		Expect(first.Name).To(Equal("first"))
+
+		second, err := tvm.vm.CreateCheckpoint("", hypervctl.CheckpointStandard)
+		Expect(err).To(BeNil())
+		Expect(second.ParentID).To(Equal(first.InstanceID))
+		Expect(second.Rename("second")).To(Succeed())
+
+		checkpoints, err := tvm.vm.Checkpoints()
+		Expect(err).To(BeNil())
+		Expect(checkpoints).To(HaveLen(2))
+
+		found, err := tvm.vm.GetCheckpoint("second")
+		Expect(err).To(BeNil())
+		Expect(found.InstanceID).To(Equal(second.InstanceID))
+		_, err = tvm.vm.GetCheckpoint("missing")
+		Expect(err).To(MatchError(hypervctl.ErrCheckpointNotFound))
+
+		Expect(first.Apply()).To(Succeed())
+		Expect(first.DeleteSubtree()).To(Succeed())
+		checkpoints, err = tvm.vm.Checkpoints()
+		Expect(err).To(BeNil())
+		Expect(checkpoints).To(BeEmpty())
+
+		err = tvm.vm.Remove(tvm.config.DiskPath)
+		Expect(err).To(BeNil())
+	})
+
+	It("clone a machine onto a differencing disk", func() {
+		tvm, err := newDefaultVM()
+		Expect(err).To(BeNil())
+		defer removeOnError(tvm)
+
+		cloneName := stringid.GenerateRandomID()
+		clone, err := tvm.vmm.Clone(tvm.vm, cloneName, nil)
+		Expect(err).To(BeNil())
+		cloneDisk := filepath.Join(filepath.Dir(tvm.config.DiskPath), cloneName+".vhdx")
+
+		config, err := clone.GetConfig(cloneDisk)
+		Expect(err).To(BeNil())
+		Expect(config.Hardware.CPUs).To(Equal(tvm.config.CPUs))
+		Expect(config.Hardware.Memory).To(Equal(tvm.config.Memory))
+
+		Expect(clone.Remove(cloneDisk)).To(Succeed())
+
+		// The parent disk was made read-only by the clone
+		Expect(os.Chmod(tvm.config.DiskPath, 0644)).To(Succeed())
+		err = tvm.vm.Remove(tvm.config.DiskPath)
+		Expect(err).To(BeNil())
+	})
+
+	It("watch state changes", func() {
+		tvm, err := newDefaultVM()
+		Expect(err).To(BeNil())
+		defer removeOnError(tvm)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		watcher, err := tvm.vmm.WatchStates(ctx)
+		Expect(err).To(BeNil())
+		changes := watcher.Changes()
+
+		Expect(tvm.vm.Start()).To(Succeed())
+		Eventually(changes, 30*time.Second).Should(Receive(SatisfyAll(
+			HaveField("ElementName", tvm.name),
+			HaveField("State", hypervctl.Enabled),
+		)))
+
+		// Stopping waits for the state change event
+		Expect(tvm.vm.StopWithForce()).To(Succeed())
+		Expect(tvm.refresh()).To(Succeed())
+		Expect(tvm.vm.State()).To(Equal(hypervctl.Disabled))
+
+		cancel()
+		Eventually(changes, 5*time.Second).Should(BeClosed())
+		Expect(watcher.Err()).To(BeNil())
+		Expect(tvm.vm.Remove(tvm.config.DiskPath)).To(Succeed())
+	})
+
+	It("wait for the guest to be ready", func() {
+		tvm, err := newDefaultVM()
+		Expect(err).To(BeNil())
+		defer removeOnError(tvm)
+
+		Expect(tvm.vm.Start()).To(Succeed())
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+		defer cancel()
+		Expect(tvm.vm.WaitForReady(ctx, &hypervctl.ReadyCriteria{IPAddress: true})).To(Succeed())
+
+		summary, err := tvm.vm.GetSummaryInformation(hypervctl.SummaryRequestCommon)
+		Expect(err).To(BeNil())
+		Expect(summary.HeartbeatStatus()).To(Equal(hypervctl.IntegrationStatusOK))
+
+		// A key the guest never publishes times out
+		shortCtx, shortCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer shortCancel()
+		err = tvm.vm.WaitForReady(shortCtx, &hypervctl.ReadyCriteria{GuestKey: "libhvee-missing"})
+		Expect(errors.Is(err, hypervctl.ErrGuestReadyTimeout)).To(BeTrue())
+		Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+
+		Expect(tvm.vm.StopWithForce()).To(Succeed())
+		err = tvm.vm.WaitForReady(ctx, nil)
+		Expect(errors.Is(err, hypervctl.ErrMachineStopped)).To(BeTrue())
+		Expect(tvm.vm.Remove(tvm.config.DiskPath)).To(Succeed())
+	})
+
+	It("configure integration services", func() {
+		tvm := &testVM{name: stringid.GenerateRandomID()}
+		config := defaultConfig
+		config.IntegrationServices = map[hypervctl.IntegrationService]bool{
+			hypervctl.IntegrationTimeSync:     false,
+			hypervctl.IntegrationGuestService: true,
+		}
+		tvm.config = &config
+		Expect(tvm.copyCacheDiskToVm()).To(Succeed())
+
+		var err error
+		tvm.vmm, tvm.vm, err = newVM(tvm.name, &config)
+		Expect(err).To(BeNil())
+		defer removeOnError(tvm)
+
+		enabled := func() map[hypervctl.IntegrationService]bool {
+			states, err := tvm.vm.GetIntegrationServices()
+			Expect(err).To(BeNil())
+			m := make(map[hypervctl.IntegrationService]bool)
+			for _, s := range states {
+				m[s.Service] = s.Enabled
+			}
+			return m
+		}
+		services := enabled()
+		Expect(services).To(HaveKeyWithValue(hypervctl.IntegrationTimeSync, false))
+		Expect(services).To(HaveKeyWithValue(hypervctl.IntegrationGuestService, true))
+		Expect(services).To(HaveKeyWithValue(hypervctl.IntegrationHeartbeat, true))
+
+		Expect(tvm.vm.SetIntegrationServices(map[hypervctl.IntegrationService]bool{
+			hypervctl.IntegrationTimeSync: true,
+			hypervctl.IntegrationVss:      false,
+		})).To(Succeed())
+		services = enabled()
+		Expect(services).To(HaveKeyWithValue(hypervctl.IntegrationTimeSync, true))
+		Expect(services).To(HaveKeyWithValue(hypervctl.IntegrationVss, false))
+
+		Expect(tvm.vm.SetIntegrationServices(map[hypervctl.IntegrationService]bool{"Bogus": true})).ToNot(Succeed())
+		Expect(tvm.vm.Remove(tvm.config.DiskPath)).To(Succeed())
+	})
+
+	It("copy a file to the guest", func() {
+		tvm := &testVM{name: stringid.GenerateRandomID()}
+		config := defaultConfig
+		config.IntegrationServices = map[hypervctl.IntegrationService]bool{
+			hypervctl.IntegrationGuestService: true,
+		}
+		tvm.config = &config
+		Expect(tvm.copyCacheDiskToVm()).To(Succeed())
+
+		var err error
+		tvm.vmm, tvm.vm, err = newVM(tvm.name, &config)
+		Expect(err).To(BeNil())
+		defer removeOnError(tvm)
+
+		src := filepath.Join(GinkgoT().TempDir(), "libhvee.txt")
+		Expect(os.WriteFile(src, []byte("copied by libhvee\n"), 0644)).To(Succeed())
+
+		// Copying needs a running guest
+		err = tvm.vm.CopyFileToGuest(src, "/tmp/libhvee.txt", nil)
+		Expect(errors.Is(err, hypervctl.ErrMachineNotRunning)).To(BeTrue())
+
+		Expect(tvm.vm.Start()).To(Succeed())
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Minute)
+		defer cancel()
+		Expect(tvm.vm.WaitForReady(ctx, nil)).To(Succeed())
+
+		var percent []uint16
+		Expect(tvm.vm.CopyFileToGuestContext(ctx, src, "/tmp/libhvee/libhvee.txt", &hypervctl.CopyFileOptions{
+			CreateDirectories: true,
+			Progress:          func(p uint16) { percent = append(percent, p) },
+		})).To(Succeed())
+		Expect(percent).ToNot(BeEmpty())
+
+		// The file exists now
+		Expect(tvm.vm.CopyFileToGuest(src, "/tmp/libhvee/libhvee.txt", nil)).ToNot(Succeed())
+		Expect(tvm.vm.CopyFileToGuest(src, "/tmp/libhvee/libhvee.txt", &hypervctl.CopyFileOptions{Overwrite: true})).To(Succeed())
+
+		Expect(tvm.vm.StopWithForce()).To(Succeed())
+		Expect(tvm.vm.Remove(tvm.config.DiskPath)).To(Succeed())
+	})
+
+	It("remove a partially created machine", func() {
+		name := stringid.GenerateRandomID()
+		config := defaultConfig
+		config.DiskPath = filepath.Join(defaultDiskPath, name+"-missing.vhdx")
+		config.CloudInit = &nocloud.Config{UserData: []byte("#cloud-config\n")}
+
+		// Attaching the missing disk fails after the system was defined
+		vmm := hypervctl.NewVirtualMachineManager()
+		err := vmm.NewVirtualMachine(name, &config)
+		Expect(err).ToNot(BeNil())
+		var rollbackErr *hypervctl.RollbackError
+		Expect(errors.As(err, &rollbackErr)).To(BeFalse())
+
+		exists, err := vmm.Exists(name)
+		Expect(err).To(BeNil())
+		Expect(exists).To(BeFalse())
+		Expect(hypervctl.CloudInitISOPath(name, config.DiskPath)).ToNot(BeAnExistingFile())
+	})
+
+	It("attach a generated cloud-init image", func() {
+		tvm := &testVM{name: stringid.GenerateRandomID()}
+		config := defaultConfig
+		config.CloudInit = &nocloud.Config{
+			UserData: []byte("#cloud-config\n"),
+			Hostname: "libhvee",
+		}
+		tvm.config = &config
+		Expect(tvm.copyCacheDiskToVm()).To(Succeed())
+
+		var err error
+		tvm.vmm, tvm.vm, err = newVM(tvm.name, &config)
+		Expect(err).To(BeNil())
+		defer removeOnError(tvm)
+
+		iso := hypervctl.CloudInitISOPath(tvm.name, config.DiskPath)
+		Expect(iso).To(BeAnExistingFile())
+
+		// The image replaces an explicit DVD
+		config.DVDDiskPath = iso
+		Expect(tvm.vmm.NewVirtualMachine(stringid.GenerateRandomID(), &config)).ToNot(Succeed())
+
+		Expect(tvm.vm.Remove(config.DiskPath)).To(Succeed())
+		Expect(iso).ToNot(BeAnExistingFile())
+	})
 })
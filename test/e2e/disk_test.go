@@ -1,9 +1,14 @@
 package e2e
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/containers/libhvee/pkg/hypervctl"
+	"github.com/containers/libhvee/pkg/wmiext"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"go.podman.io/common/pkg/strongunits"
@@ -51,4 +56,70 @@ var _ = Describe("Disk tests", func() {
 		Expect(strongunits.ToMib(newSize)).To(Equal(strongunits.ToMib(newDiskSize)))
 
 	})
+
+	It("Disk management", func() {
+		dir := filepath.Dir(tvm.config.DiskPath)
+
+		child := filepath.Join(dir, tvm.name+"-child.vhdx")
+		err := hypervctl.CreateDisk(child, &hypervctl.DiskOptions{ParentPath: tvm.config.DiskPath})
+		Expect(err).To(BeNil())
+		defer os.Remove(child)
+
+		settings, err := hypervctl.GetDiskSettings(child)
+		Expect(err).To(BeNil())
+		Expect(hypervctl.DiskType(settings.Type)).To(Equal(hypervctl.DiskTypeDifferencing))
+		chain, err := hypervctl.GetDiskParentChain(child)
+		Expect(err).To(BeNil())
+		Expect(chain).To(HaveLen(1))
+		Expect(hypervctl.ValidateDisk(child)).To(Succeed())
+
+		state, err := hypervctl.GetDiskState(child)
+		Expect(err).To(BeNil())
+		Expect(state.InUse).To(BeFalse())
+		Expect(hypervctl.MergeDisk(child, tvm.config.DiskPath)).To(Succeed())
+
+		fixed := filepath.Join(dir, tvm.name+"-fixed.vhdx")
+		err = hypervctl.CreateDisk(fixed, &hypervctl.DiskOptions{
+			Type:              hypervctl.DiskTypeFixed,
+			Size:              strongunits.MiB(64).ToBytes(),
+			LogicalSectorSize: 512,
+		})
+		Expect(err).To(BeNil())
+		defer os.Remove(fixed)
+
+		converted := filepath.Join(dir, tvm.name+"-converted.vhd")
+		err = hypervctl.ConvertDisk(fixed, converted, &hypervctl.DiskOptions{Type: hypervctl.DiskTypeDynamic})
+		Expect(err).To(BeNil())
+		defer os.Remove(converted)
+		settings, err = hypervctl.GetDiskSettings(converted)
+		Expect(err).To(BeNil())
+		Expect(hypervctl.DiskFormat(settings.Format)).To(Equal(hypervctl.DiskFormatVHD))
+		Expect(hypervctl.CompactDisk(converted, hypervctl.CompactFull)).To(Succeed())
+
+		// The image holds more than a GiB of data
+		err = hypervctl.ResizeDisk(tvm.config.DiskPath, strongunits.GiB(1))
+		Expect(err).To(MatchError(hypervctl.ErrDiskShrinkUnsafe))
+	})
+
+	It("Disk conversion progress and cancellation", func() {
+		dir := filepath.Dir(tvm.config.DiskPath)
+
+		var updates []wmiext.JobProgress
+		converted := filepath.Join(dir, tvm.name+"-converted.vhdx")
+		err := hypervctl.ConvertDiskContext(context.Background(), tvm.config.DiskPath, converted, nil, func(p wmiext.JobProgress) {
+			updates = append(updates, p)
+		})
+		Expect(err).To(BeNil())
+		defer os.Remove(converted)
+		Expect(updates).ToNot(BeEmpty())
+		Expect(updates[len(updates)-1].State).To(Equal(wmiext.JobStateCompleted))
+
+		// A conversion that is given up on leaves nothing behind
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		canceled := filepath.Join(dir, tvm.name+"-canceled.vhdx")
+		err = hypervctl.ConvertDiskContext(ctx, tvm.config.DiskPath, canceled, nil, nil)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		Expect(canceled).ToNot(BeAnExistingFile())
+	})
 })